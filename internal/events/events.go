@@ -2,61 +2,129 @@ package events
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"log/slog"
 	"time"
+	"unicode/utf8"
+
+	"github.com/sethgrid/kverr"
 
 	"github.com/sethgrid/helloworld/internal/db"
+	"github.com/sethgrid/helloworld/logger"
 )
 
-// UserEvent represents something the user will want to know about
-type UserEvent struct {
-	dbManager *db.Manager
-	closer    chan struct{}
+// Event types written by the app.
+const (
+	// TypeMessage is a free form message for the user, e.g. from a user_event task.
+	TypeMessage = "message"
+)
+
+// MaxMessageLength is the longest message activity_log can hold, in characters.
+const MaxMessageLength = 255
+
+// maxVerbLength is the longest request verb activity_log can hold.
+const maxVerbLength = 6
+
+// ErrInvalidEvent is returned by Write for events activity_log can't hold.
+var ErrInvalidEvent = errors.New("invalid event")
 
-	UserID    int64     `json:"user_id,omitempty"`
+// Event is something the user will want to know about, stored as a row in activity_log.
+type Event struct {
+	ID     int64  `json:"id,omitempty"`
+	Type   string `json:"type"`
+	UserID int64  `json:"user_id"`
+	// Message is shown to the user; at most MaxMessageLength characters.
+	Message string `json:"message"`
+	// RequestPath and RequestVerb are the request that caused the event, if any.
+	RequestPath string `json:"request_path,omitempty"`
+	RequestVerb string `json:"request_verb,omitempty"`
+	// MatcherID and APIKeyID are the matcher and API key involved, or 0.
+	MatcherID int64 `json:"matcher_id,omitempty"`
+	APIKeyID  int64 `json:"apikey_id,omitempty"`
+	// IsPublic events are shown to the user; others are kept for support and auditing.
+	IsPublic bool `json:"is_public"`
+	// CreatedAt defaults to the time the event is written.
 	CreatedAt time.Time `json:"created_at,omitempty"`
-	Message   string    `json:"message,omitempty"`
+}
+
+// Validate checks the event fits in activity_log.
+func (e Event) Validate() error {
+	switch {
+	case e.Type == "":
+		return fmt.Errorf("%w: type is required", ErrInvalidEvent)
+	case e.UserID == 0:
+		return fmt.Errorf("%w: user_id is required", ErrInvalidEvent)
+	case utf8.RuneCountInString(e.Message) > MaxMessageLength:
+		return fmt.Errorf("%w: message is longer than %d characters", ErrInvalidEvent, MaxMessageLength)
+	case len(e.RequestVerb) > maxVerbLength:
+		return fmt.Errorf("%w: request verb %q is too long", ErrInvalidEvent, e.RequestVerb)
+	}
+	return nil
+}
 
-	logger *slog.Logger
+// UserEvent stores events in the activity_log table.
+type UserEvent struct {
+	dbManager *db.Manager
+	logger    *slog.Logger
 }
 
 func NewUserEvent(dbManager *db.Manager, maxEventsPerUser int, logger *slog.Logger) *UserEvent {
-	closeCh := make(chan struct{})
-	ue := &UserEvent{dbManager: dbManager, closer: closeCh, logger: logger}
-
-	// Start scheduled work goroutine
-	go func() {
-		t := time.NewTicker(1 * time.Hour)
-		defer t.Stop()
-
-		for {
-			select {
-			case <-closeCh:
-				return
-			case <-t.C:
-				ue.logger.Info("scheduled work: call some function")
-				// add key value pairs for structured logs
-				recordsUpdated := 3
-				ue.logger.Info("scheduled work complete", "update_count", recordsUpdated)
-			}
-		}
-	}()
-
-	return ue
+	return &UserEvent{dbManager: dbManager, logger: logger}
 }
 
-// Close cleans up the work loop that is created when a new UserEvent is created
+// Close releases the event store. The db manager is shared and closed by its owner.
 func (evt *UserEvent) Close() error {
-	close(evt.closer)
 	return nil
 }
 
-// Write would write to a hypotetical stream or db
-func (evt *UserEvent) Write(userID int64, message string) error {
-	evt.logger.Info("writing event message", "user_id", userID, "msg", message)
+// ScheduledWork is the event store's periodic maintenance. It runs as a task enqueued by the
+// scheduler, so the logger comes from the task context when there is one.
+func (evt *UserEvent) ScheduledWork(ctx context.Context) error {
+	log := logger.FromCtx(ctx, evt.logger)
+	log.Info("scheduled work: call some function")
+	// add key value pairs for structured logs
+	recordsUpdated := 3
+	log.Info("scheduled work complete", "update_count", recordsUpdated)
 	return nil
 }
 
+// Write stores the event in activity_log. The error wraps ErrInvalidEvent if the event doesn't
+// pass Validate, in which case writing it again won't help.
+func (evt *UserEvent) Write(ctx context.Context, event Event) error {
+	if err := event.Validate(); err != nil {
+		return kverr.New(err, "user_id", event.UserID, "event_type", event.Type)
+	}
+	if evt.dbManager == nil {
+		return kverr.New(errors.New("event store not configured"), "user_id", event.UserID, "event_type", event.Type)
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+
+	err := timeDBOperation("write_event", func() error {
+		_, err := evt.dbManager.Writer.ExecContext(ctx, `
+			INSERT INTO activity_log (type, user_id, message, request_path, request_verb, matcher_id, apikey_id, is_public, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, event.Type, event.UserID, event.Message, nullString(event.RequestPath), nullString(event.RequestVerb),
+			event.MatcherID, event.APIKeyID, event.IsPublic, event.CreatedAt)
+		return err
+	})
+	if err != nil {
+		return kverr.New(fmt.Errorf("unable to write event: %w", err), "user_id", event.UserID, "event_type", event.Type)
+	}
+
+	log := logger.FromCtx(ctx, evt.logger)
+	log.Debug("event written", "user_id", event.UserID, "event_type", event.Type)
+	return nil
+}
+
+// nullString stores empty strings as NULL in nullable columns.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
 // IsAvailable pings the database to check if the event store is available.
 // Returns true if the ping succeeds, false otherwise.
 func (evt *UserEvent) IsAvailable() bool {
@@ -0,0 +1,88 @@
+//go:build unitintegration
+
+// the build tag keeps the MySQL tests out of go test ./...; run them against a local database
+// (make db-restart) with go test ./... -tags=unitintegration
+package events
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sethgrid/helloworld/internal/db"
+	"github.com/sethgrid/helloworld/logger"
+)
+
+// testDSN defaults to the docker compose database and can be overridden with HELLOWORLD_TEST_DSN.
+func testDSN() string {
+	if dsn := os.Getenv("HELLOWORLD_TEST_DSN"); dsn != "" {
+		return dsn
+	}
+	return "testuser:testuser@tcp(127.0.0.1:3306)/helloworld?parseTime=true"
+}
+
+func TestMySQLWrite(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	dbManager, err := db.NewManager("", testDSN(), "", log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbManager.Close()
+	if err := dbManager.Ping(ctx); err != nil {
+		t.Skipf("mysql is not available, start it with make db-restart: %v", err)
+	}
+	_, err = dbManager.Writer.Exec("DELETE FROM activity_log")
+	require.NoError(t, err)
+
+	store := NewUserEvent(dbManager, 2, log)
+	createdAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, store.Write(ctx, Event{
+		Type:        "matcher_created",
+		UserID:      7,
+		Message:     "matcher created",
+		RequestPath: "/matchers",
+		RequestVerb: "POST",
+		MatcherID:   3,
+		APIKeyID:    4,
+		CreatedAt:   createdAt,
+	}))
+	require.NoError(t, store.Write(ctx, Event{Type: TypeMessage, UserID: 7, Message: "export ready", IsPublic: true}))
+
+	rows, err := dbManager.Reader.QueryContext(ctx, `
+		SELECT type, user_id, message, request_path, request_verb, matcher_id, apikey_id, is_public, created_at
+		FROM activity_log ORDER BY id ASC
+	`)
+	require.NoError(t, err)
+	defer rows.Close()
+	var got []Event
+	for rows.Next() {
+		var event Event
+		var path, verb sql.NullString
+		require.NoError(t, rows.Scan(&event.Type, &event.UserID, &event.Message, &path, &verb, &event.MatcherID, &event.APIKeyID, &event.IsPublic, &event.CreatedAt))
+		event.RequestPath, event.RequestVerb = path.String, verb.String
+		got = append(got, event)
+	}
+	require.NoError(t, rows.Err())
+	require.Len(t, got, 2)
+
+	assert.Equal(t, "matcher_created", got[0].Type)
+	assert.Equal(t, "/matchers", got[0].RequestPath)
+	assert.Equal(t, "POST", got[0].RequestVerb)
+	assert.Equal(t, int64(3), got[0].MatcherID)
+	assert.Equal(t, int64(4), got[0].APIKeyID)
+	assert.False(t, got[0].IsPublic)
+	assert.WithinDuration(t, createdAt, got[0].CreatedAt, time.Second)
+
+	assert.Equal(t, "export ready", got[1].Message)
+	assert.Empty(t, got[1].RequestPath)
+	assert.True(t, got[1].IsPublic)
+	assert.WithinDuration(t, time.Now(), got[1].CreatedAt, time.Minute)
+}
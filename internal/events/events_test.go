@@ -0,0 +1,49 @@
+package events
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sethgrid/helloworld/logger"
+)
+
+func TestEventValidate(t *testing.T) {
+	valid := Event{Type: TypeMessage, UserID: 7, Message: "export ready", RequestVerb: "DELETE"}
+
+	tests := []struct {
+		name    string
+		change  func(e *Event)
+		wantErr bool
+	}{
+		{name: "valid", change: func(e *Event) {}},
+		{name: "longest message", change: func(e *Event) { e.Message = strings.Repeat("é", MaxMessageLength) }},
+		{name: "no type", change: func(e *Event) { e.Type = "" }, wantErr: true},
+		{name: "no user", change: func(e *Event) { e.UserID = 0 }, wantErr: true},
+		{name: "message too long", change: func(e *Event) { e.Message = strings.Repeat("a", MaxMessageLength+1) }, wantErr: true},
+		{name: "verb too long", change: func(e *Event) { e.RequestVerb = "OPTIONS" }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := valid
+			tt.change(&event)
+			err := event.Validate()
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidEvent)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestWriteInvalidEvent(t *testing.T) {
+	// invalid events are rejected before the database is touched
+	store := NewUserEvent(nil, 2, logger.New(io.Discard))
+	err := store.Write(context.Background(), Event{UserID: 7, Message: "no type"})
+	assert.ErrorIs(t, err, ErrInvalidEvent)
+}
@@ -0,0 +1,20 @@
+package scheduler
+
+import (
+	"time"
+
+	"github.com/sethgrid/helloworld/metrics"
+)
+
+const storeLabel = "scheduler"
+
+// timeDBOperation times a database operation and records it in Prometheus metrics
+func timeDBOperation(operation string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	duration := time.Since(start)
+
+	metrics.DBQueryDuration.WithLabelValues(storeLabel, operation).Observe(duration.Seconds())
+
+	return err
+}
@@ -0,0 +1,247 @@
+// Package scheduler enqueues recurring jobs as tasks on the task queue.
+// The scheduler only decides when a job is due; the work itself is done by the task handler
+// registered for the job's task type, so it gets the task queue's retries and dead lettering.
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sethgrid/kverr"
+
+	"github.com/sethgrid/helloworld/internal/taskqueue"
+)
+
+// Job enqueues a task every time its schedule fires.
+type Job struct {
+	// Name keys the job's last run in the Store and the dedup keys of its tasks, so it must be
+	// unique and stable across deploys.
+	Name string
+	// Spec is a cron expression, descriptor, or interval; see Parse.
+	Spec     string
+	TaskType string
+	Payload  string
+	// UserID owns the enqueued tasks. System jobs use 0.
+	UserID int
+}
+
+// JobStatus describes a registered job for the status page.
+type JobStatus struct {
+	Name     string     `json:"name"`
+	Spec     string     `json:"spec"`
+	TaskType string     `json:"task_type"`
+	LastRun  *time.Time `json:"last_run,omitempty"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+}
+
+type scheduledJob struct {
+	Job
+	schedule Schedule
+	// loaded is false until the last run has been read from the store
+	loaded  bool
+	lastRun time.Time
+	nextRun time.Time
+}
+
+type Scheduler struct {
+	tasker taskqueue.Tasker
+	store  Store
+	logger *slog.Logger
+	tick   time.Duration
+
+	mu   sync.Mutex
+	jobs []*scheduledJob
+	wg   sync.WaitGroup
+	// ctx is cancelled on Close
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// New creates a scheduler that checks for due jobs every tick.
+func New(tasker taskqueue.Tasker, store Store, logger *slog.Logger, tick time.Duration) *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{
+		tasker: tasker,
+		store:  store,
+		logger: logger.With("component", "scheduler"),
+		tick:   tick,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Register adds a recurring job. It should be called before Start.
+func (s *Scheduler) Register(job Job) error {
+	schedule, err := Parse(job.Spec)
+	if err != nil {
+		return kverr.New(err, "job", job.Name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.Name == job.Name {
+			return kverr.New(fmt.Errorf("job already registered"), "job", job.Name)
+		}
+	}
+	s.jobs = append(s.jobs, &scheduledJob{Job: job, schedule: schedule})
+	return nil
+}
+
+// Start runs due jobs until Close is called. It blocks, so call it in a goroutine.
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	if s.ctx.Err() != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	defer s.wg.Done()
+
+	t := time.NewTicker(s.tick)
+	defer t.Stop()
+
+	for {
+		s.runDue(time.Now())
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Close stops the scheduler and waits for a run in progress to finish.
+func (s *Scheduler) Close() error {
+	// cancel under the lock so Start can't begin once Wait starts
+	s.mu.Lock()
+	s.cancel()
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// Jobs reports the registered jobs ordered by name.
+func (s *Scheduler) Jobs() []JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		status := JobStatus{Name: j.Name, Spec: j.Spec, TaskType: j.TaskType}
+		if !j.lastRun.IsZero() {
+			lastRun := j.lastRun
+			status.LastRun = &lastRun
+		}
+		if j.loaded {
+			nextRun := j.nextRun
+			status.NextRun = &nextRun
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].Name < statuses[k].Name })
+	return statuses
+}
+
+// runDue enqueues every job whose next run is at or before now. A job that missed runs while
+// the service was down fires once to catch up rather than once per missed run.
+func (s *Scheduler) runDue(now time.Time) {
+	// the store keeps second precision, so claims must compare equal after a round trip
+	now = now.UTC().Truncate(time.Second)
+
+	s.mu.Lock()
+	jobs := slices.Clone(s.jobs)
+	s.mu.Unlock()
+
+	for _, job := range jobs {
+		// run a copy of the job so s.mu, which Jobs waits on, isn't held across the store calls
+		s.mu.Lock()
+		j := *job
+		s.mu.Unlock()
+
+		s.runJob(&j, now)
+
+		s.mu.Lock()
+		job.loaded, job.lastRun, job.nextRun = j.loaded, j.lastRun, j.nextRun
+		s.mu.Unlock()
+	}
+}
+
+// runJob enqueues the job if its next run is at or before now.
+func (s *Scheduler) runJob(j *scheduledJob, now time.Time) {
+	log := s.logger.With("job", j.Name, "task_type", j.TaskType)
+
+	if !j.loaded {
+		if err := s.load(j, now); err != nil {
+			log = log.With(kverr.Args(err)...)
+			log.Error("unable to load last run for scheduled job", "error", err.Error())
+			return
+		}
+	}
+	if now.Before(j.nextRun) {
+		return
+	}
+
+	// enqueue before claiming, so a failed enqueue or a crash leaves the run unclaimed and it
+	// is retried on the next tick. The dedup key makes the retry, and replicas racing for the
+	// same run, enqueue one task between them.
+	taskID, err := s.tasker.AddTask(s.ctx, j.UserID, j.TaskType, j.Payload, taskqueue.WithDedupKey(runKey(j.Name, j.nextRun), 0))
+	if err != nil {
+		log = log.With(kverr.Args(err)...)
+		log.Error("unable to enqueue scheduled job", "error", err.Error())
+		return
+	}
+
+	claimed, err := s.store.ClaimRun(s.ctx, j.Name, j.lastRun, now)
+	if err != nil {
+		log = log.With(kverr.Args(err)...)
+		log.Error("unable to claim scheduled job run", "error", err.Error(), "task_id", taskID)
+		return
+	}
+	if !claimed {
+		// another replica ran the job; pick up its last run and schedule from there
+		log.Debug("scheduled job run claimed elsewhere", "task_id", taskID)
+		j.loaded = false
+		if err := s.load(j, now); err != nil {
+			log = log.With(kverr.Args(err)...)
+			log.Error("unable to load last run for scheduled job", "error", err.Error())
+		}
+		return
+	}
+
+	j.lastRun = now
+	j.nextRun = j.schedule.Next(now)
+	log.Info("scheduled job enqueued", "task_id", taskID, "next_run", j.nextRun)
+}
+
+// runKey is the dedup key of a job's run scheduled at runAt. Every replica computes the same
+// runAt from the last run in the store, so they agree on the key.
+func runKey(name string, runAt time.Time) string {
+	return fmt.Sprintf("scheduler:%s:%s", name, runAt.UTC().Format(time.RFC3339))
+}
+
+// load reads the job's last run from the store and computes its next run.
+// A job that has never run first fires one schedule period after now.
+func (s *Scheduler) load(j *scheduledJob, now time.Time) error {
+	lastRun, err := s.store.LastRun(s.ctx, j.Name)
+	if err != nil {
+		return err
+	}
+
+	j.lastRun = lastRun.UTC()
+	if lastRun.IsZero() {
+		j.nextRun = j.schedule.Next(now)
+	} else {
+		j.nextRun = j.schedule.Next(j.lastRun)
+	}
+	j.loaded = true
+	return nil
+}
@@ -0,0 +1,259 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sethgrid/helloworld/internal/taskqueue"
+)
+
+func TestParse(t *testing.T) {
+	// a Wednesday
+	base := time.Date(2024, time.September, 18, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{spec: "* * * * *", want: time.Date(2024, 9, 18, 10, 8, 0, 0, time.UTC)},
+		{spec: "*/15 * * * *", want: time.Date(2024, 9, 18, 10, 15, 0, 0, time.UTC)},
+		{spec: "@hourly", want: time.Date(2024, 9, 18, 11, 0, 0, 0, time.UTC)},
+		{spec: "30 9 * * *", want: time.Date(2024, 9, 19, 9, 30, 0, 0, time.UTC)},
+		{spec: "0 9 * * 1-5", want: time.Date(2024, 9, 19, 9, 0, 0, 0, time.UTC)},
+		{spec: "0 0 * * 0", want: time.Date(2024, 9, 22, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 0 * * 7", want: time.Date(2024, 9, 22, 0, 0, 0, 0, time.UTC)},
+		{spec: "@monthly", want: time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 0 29 2 *", want: time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{spec: "5,10/20 8 * * *", want: time.Date(2024, 9, 19, 8, 5, 0, 0, time.UTC)},
+		// both day fields restricted: either may match
+		{spec: "0 0 1 * 5", want: time.Date(2024, 9, 20, 0, 0, 0, 0, time.UTC)},
+		{spec: "@every 90s", want: base.Add(90 * time.Second)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			schedule, err := Parse(tt.spec)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, schedule.Next(base))
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "@every -1m", "@every soon", "@fortnightly"} {
+		t.Run(spec, func(t *testing.T) {
+			_, err := Parse(spec)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func newTestScheduler(store Store, q taskqueue.Tasker) *Scheduler {
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	s := New(q, store, log, time.Hour)
+	_ = s.Register(Job{Name: "cleanup", Spec: "@hourly", TaskType: "cleanup"})
+	return s
+}
+
+func countOpenTasks(t *testing.T, q taskqueue.Tasker) int {
+	t.Helper()
+	count := 0
+	for {
+		task, err := q.FetchOpenTask(context.Background(), taskqueue.DefaultQueue)
+		require.NoError(t, err)
+		if task == nil {
+			return count
+		}
+		count++
+	}
+}
+
+func TestSchedulerCatchesUpOnce(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 9, 18, 10, 7, 0, 0, time.UTC)
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)
+
+	store := NewMemoryStore()
+	// last ran three hours ago, so three runs were missed while the service was down
+	_, err := store.ClaimRun(ctx, "cleanup", time.Time{}, now.Add(-3*time.Hour))
+	require.NoError(t, err)
+
+	s := newTestScheduler(store, q)
+	s.runDue(now)
+	s.runDue(now.Add(time.Minute))
+	assert.Equal(t, 1, countOpenTasks(t, q))
+
+	lastRun, err := store.LastRun(ctx, "cleanup")
+	require.NoError(t, err)
+	assert.Equal(t, now, lastRun)
+
+	jobs := s.Jobs()
+	require.Len(t, jobs, 1)
+	assert.Equal(t, time.Date(2024, 9, 18, 11, 0, 0, 0, time.UTC), *jobs[0].NextRun)
+}
+
+func TestSchedulerRestartDoesNotDoubleFire(t *testing.T) {
+	now := time.Date(2024, 9, 18, 11, 0, 0, 0, time.UTC)
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)
+	store := NewMemoryStore()
+
+	// a job that never ran waits for its first scheduled time
+	first := newTestScheduler(store, q)
+	first.runDue(now.Add(-30 * time.Minute))
+	first.runDue(now)
+	assert.Equal(t, 1, countOpenTasks(t, q))
+
+	// a restart within the same hour picks up the persisted last run
+	restarted := newTestScheduler(store, q)
+	restarted.runDue(now.Add(time.Minute))
+	assert.Equal(t, 0, countOpenTasks(t, q))
+
+	restarted.runDue(now.Add(time.Hour))
+	assert.Equal(t, 1, countOpenTasks(t, q))
+}
+
+func TestSchedulerReplicasFireOnce(t *testing.T) {
+	now := time.Date(2024, 9, 18, 11, 0, 0, 0, time.UTC)
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)
+	store := NewMemoryStore()
+
+	a := newTestScheduler(store, q)
+	b := newTestScheduler(store, q)
+	a.runDue(now.Add(-time.Minute))
+	b.runDue(now.Add(-time.Minute))
+
+	a.runDue(now)
+	b.runDue(now)
+	assert.Equal(t, 1, countOpenTasks(t, q))
+}
+
+func TestSchedulerRegisterInvalid(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	s := New(taskqueue.NewInMemoryTaskQueue(3, time.Minute, log), NewMemoryStore(), log, time.Hour)
+
+	assert.Error(t, s.Register(Job{Name: "bad", Spec: "not a spec"}))
+	assert.NoError(t, s.Register(Job{Name: "good", Spec: "@daily"}))
+	assert.Error(t, s.Register(Job{Name: "good", Spec: "@daily"}), "duplicate names are rejected")
+}
+
+// flakyTasker fails AddTask while fail is set.
+type flakyTasker struct {
+	taskqueue.Tasker
+	fail bool
+}
+
+func (f *flakyTasker) AddTask(ctx context.Context, userID int, taskType string, payload string, opts ...taskqueue.EnqueueOption) (int, error) {
+	if f.fail {
+		return 0, errors.New("queue unavailable")
+	}
+	return f.Tasker.AddTask(ctx, userID, taskType, payload, opts...)
+}
+
+// flakyStore fails ClaimRun while fail is set.
+type flakyStore struct {
+	Store
+	fail bool
+}
+
+func (f *flakyStore) ClaimRun(ctx context.Context, name string, prev, next time.Time) (bool, error) {
+	if f.fail {
+		return false, errors.New("store unavailable")
+	}
+	return f.Store.ClaimRun(ctx, name, prev, next)
+}
+
+func TestSchedulerRetriesFailedRun(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 9, 18, 11, 0, 0, 0, time.UTC)
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+	t.Run("enqueue fails", func(t *testing.T) {
+		q := &flakyTasker{Tasker: taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)}
+		store := NewMemoryStore()
+		s := newTestScheduler(store, q)
+		s.runDue(now.Add(-time.Minute))
+
+		q.fail = true
+		s.runDue(now)
+		lastRun, err := store.LastRun(ctx, "cleanup")
+		require.NoError(t, err)
+		assert.True(t, lastRun.IsZero(), "the run is not claimed when its task isn't enqueued")
+
+		q.fail = false
+		s.runDue(now.Add(time.Minute))
+		assert.Equal(t, 1, countOpenTasks(t, q))
+		lastRun, err = store.LastRun(ctx, "cleanup")
+		require.NoError(t, err)
+		assert.Equal(t, now.Add(time.Minute), lastRun)
+	})
+
+	t.Run("claim fails", func(t *testing.T) {
+		q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)
+		store := &flakyStore{Store: NewMemoryStore()}
+		s := newTestScheduler(store, q)
+		s.runDue(now.Add(-time.Minute))
+
+		store.fail = true
+		s.runDue(now)
+		store.fail = false
+		s.runDue(now.Add(time.Minute))
+		// the retried run finds the task enqueued by the first try
+		assert.Equal(t, 1, countOpenTasks(t, q))
+	})
+}
+
+// blockingStore holds ClaimRun until release is closed.
+type blockingStore struct {
+	Store
+	claiming chan struct{}
+	release  chan struct{}
+}
+
+func (b *blockingStore) ClaimRun(ctx context.Context, name string, prev, next time.Time) (bool, error) {
+	close(b.claiming)
+	<-b.release
+	return b.Store.ClaimRun(ctx, name, prev, next)
+}
+
+func TestSchedulerJobsDuringSlowStore(t *testing.T) {
+	now := time.Date(2024, 9, 18, 11, 0, 0, 0, time.UTC)
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)
+	store := &blockingStore{Store: NewMemoryStore(), claiming: make(chan struct{}), release: make(chan struct{})}
+	s := newTestScheduler(store, q)
+	s.runDue(now.Add(-time.Minute))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runDue(now)
+	}()
+	<-store.claiming
+
+	jobs := make(chan []JobStatus)
+	go func() { jobs <- s.Jobs() }()
+	select {
+	case got := <-jobs:
+		require.Len(t, got, 1)
+		assert.Equal(t, now, *got[0].NextRun, "the run in progress isn't reported until it is claimed")
+	case <-time.After(time.Second):
+		t.Fatal("Jobs waited on the store")
+	}
+
+	close(store.release)
+	<-done
+	got := s.Jobs()
+	require.Len(t, got, 1)
+	assert.Equal(t, now, *got[0].LastRun)
+	assert.Equal(t, now.Add(time.Hour), *got[0].NextRun)
+}
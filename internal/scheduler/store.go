@@ -0,0 +1,103 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sethgrid/kverr"
+
+	"github.com/sethgrid/helloworld/internal/db"
+)
+
+// Store persists when each job last ran so restarts neither skip nor repeat a run.
+type Store interface {
+	// LastRun returns when the job last ran, or the zero time if it never has.
+	LastRun(ctx context.Context, name string) (time.Time, error)
+	// ClaimRun records a run at next if the job's last run is still prev. It returns false when
+	// another process claimed the run first, which keeps replicas from firing the same run twice.
+	ClaimRun(ctx context.Context, name string, prev, next time.Time) (bool, error)
+}
+
+// MemoryStore keeps last run times in memory. It suits tests and single process development;
+// last runs are lost on restart.
+type MemoryStore struct {
+	mu       sync.Mutex
+	lastRuns map[string]time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{lastRuns: make(map[string]time.Time)}
+}
+
+func (m *MemoryStore) LastRun(ctx context.Context, name string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastRuns[name], nil
+}
+
+func (m *MemoryStore) ClaimRun(ctx context.Context, name string, prev, next time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.lastRuns[name].Equal(prev) {
+		return false, nil
+	}
+	m.lastRuns[name] = next
+	return true, nil
+}
+
+// MySQLStore keeps last run times in the scheduled_jobs table so they are shared across replicas.
+type MySQLStore struct {
+	DBManager *db.Manager
+}
+
+func NewMySQLStore(dbManager *db.Manager) *MySQLStore {
+	return &MySQLStore{DBManager: dbManager}
+}
+
+func (m *MySQLStore) LastRun(ctx context.Context, name string) (time.Time, error) {
+	var lastRun time.Time
+	err := timeDBOperation("last_run", func() error {
+		err := m.DBManager.Writer.QueryRowContext(ctx, `
+			SELECT last_run_at FROM scheduled_jobs WHERE name = ?
+		`, name).Scan(&lastRun)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return time.Time{}, kverr.New(err, "job", name)
+	}
+	return lastRun, nil
+}
+
+func (m *MySQLStore) ClaimRun(ctx context.Context, name string, prev, next time.Time) (bool, error) {
+	var res sql.Result
+	err := timeDBOperation("claim_run", func() error {
+		var err error
+		if prev.IsZero() {
+			// first run ever; the primary key lets only one replica insert
+			res, err = m.DBManager.Writer.ExecContext(ctx, `
+				INSERT IGNORE INTO scheduled_jobs (name, last_run_at) VALUES (?, ?)
+			`, name, next)
+			return err
+		}
+		res, err = m.DBManager.Writer.ExecContext(ctx, `
+			UPDATE scheduled_jobs SET last_run_at = ? WHERE name = ? AND last_run_at = ?
+		`, next, name, prev)
+		return err
+	})
+	if err != nil {
+		return false, kverr.New(err, "job", name)
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, kverr.New(err, "job", name)
+	}
+	return count == 1, nil
+}
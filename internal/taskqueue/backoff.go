@@ -0,0 +1,73 @@
+package taskqueue
+
+import (
+	"math/rand"
+	"time"
+)
+
+// BackoffPolicy decides how long a failed task waits before its next attempt.
+// attempt is the number of attempts made so far, starting at 1.
+type BackoffPolicy interface {
+	Next(attempt int) time.Duration
+}
+
+// FixedBackoff retries after the same delay every time.
+type FixedBackoff struct {
+	Delay time.Duration
+}
+
+func (b FixedBackoff) Next(attempt int) time.Duration {
+	return b.Delay
+}
+
+// ExponentialBackoff doubles the delay after every attempt, starting at Base and capped at Max,
+// or at maxBackoff when Max is zero.
+// Jitter is the fraction of the delay to randomize by (0.25 means ±25%) so tasks that failed
+// together don't all retry together; the jittered delay still stays within the cap.
+type ExponentialBackoff struct {
+	Base   time.Duration
+	Max    time.Duration
+	Jitter float64
+}
+
+// maxBackoff caps an ExponentialBackoff without a Max, so doubling can't overflow time.Duration.
+const maxBackoff = 24 * time.Hour
+
+func (b ExponentialBackoff) Next(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	limit := b.Max
+	if limit <= 0 {
+		limit = maxBackoff
+	}
+	delay := min(b.Base, limit)
+	for i := 1; i < attempt; i++ {
+		// compare before doubling; limit/2 also keeps the doubling within math.MaxInt64
+		if delay > limit/2 {
+			delay = limit
+			break
+		}
+		delay *= 2
+	}
+	return addJitter(delay, b.Jitter, limit)
+}
+
+// defaultBackoff is used for task types registered without WithBackoff.
+var defaultBackoff BackoffPolicy = ExponentialBackoff{Base: 5 * time.Second, Max: 10 * time.Minute, Jitter: 0.25}
+
+// addJitter adds random jitter to a delay to prevent thundering herd problems, keeping the
+// result between zero and limit.
+// Jitter is ±fraction of the delay duration; this mirrors the jitter the server uses for listener retries.
+func addJitter(delay time.Duration, fraction float64, limit time.Duration) time.Duration {
+	if fraction <= 0 {
+		return delay
+	}
+	// Use math/rand for simplicity (crypto/rand not needed for jitter)
+	jitter := time.Duration(float64(delay) * fraction * (2.0*rand.Float64() - 1.0))
+	// compare against the headroom so the sum can't overflow when limit is near math.MaxInt64
+	if jitter > limit-delay {
+		return limit
+	}
+	return max(delay+jitter, 0)
+}
@@ -0,0 +1,89 @@
+package taskqueue
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  ExponentialBackoff
+		attempt int
+		want    time.Duration
+	}{
+		{
+			name:    "first attempt uses base",
+			policy:  ExponentialBackoff{Base: time.Second, Max: time.Minute},
+			attempt: 1,
+			want:    time.Second,
+		},
+		{
+			name:    "doubles per attempt",
+			policy:  ExponentialBackoff{Base: time.Second, Max: time.Minute},
+			attempt: 4,
+			want:    8 * time.Second,
+		},
+		{
+			name:    "capped at max",
+			policy:  ExponentialBackoff{Base: time.Second, Max: time.Minute},
+			attempt: 30,
+			want:    time.Minute,
+		},
+		{
+			name:    "capped at a day without max",
+			policy:  ExponentialBackoff{Base: time.Second},
+			attempt: 200,
+			want:    maxBackoff,
+		},
+		{
+			name:    "large max doesn't overflow",
+			policy:  ExponentialBackoff{Base: time.Second, Max: math.MaxInt64},
+			attempt: 200,
+			want:    math.MaxInt64,
+		},
+		{
+			name:    "base above max capped at max",
+			policy:  ExponentialBackoff{Base: 2 * time.Minute, Max: time.Minute},
+			attempt: 1,
+			want:    time.Minute,
+		},
+		{
+			name:    "attempt below one treated as first",
+			policy:  ExponentialBackoff{Base: time.Second},
+			attempt: 0,
+			want:    time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.policy.Next(tt.attempt))
+		})
+	}
+}
+
+func TestExponentialBackoffJitter(t *testing.T) {
+	policy := ExponentialBackoff{Base: time.Second, Max: time.Minute, Jitter: 0.25}
+	for i := 0; i < 100; i++ {
+		got := policy.Next(3)
+		assert.GreaterOrEqual(t, got, 3*time.Second)
+		assert.LessOrEqual(t, got, 5*time.Second)
+	}
+
+	// jitter at the cap stays within it
+	capped := ExponentialBackoff{Base: time.Second, Max: time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		got := capped.Next(5)
+		assert.GreaterOrEqual(t, got, 500*time.Millisecond)
+		assert.LessOrEqual(t, got, time.Second)
+	}
+
+	unbounded := ExponentialBackoff{Base: time.Second, Max: math.MaxInt64, Jitter: 0.25}
+	for i := 0; i < 100; i++ {
+		assert.Greater(t, unbounded.Next(200), time.Duration(0), "jitter doesn't overflow")
+	}
+}
@@ -0,0 +1,45 @@
+package taskqueue_test
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sethgrid/helloworld/internal/taskqueue"
+	"github.com/sethgrid/helloworld/internal/taskqueue/taskqueuetest"
+	"github.com/sethgrid/helloworld/logger"
+)
+
+func TestInMemoryConformance(t *testing.T) {
+	taskqueuetest.Run(t, 50*time.Millisecond, func(t *testing.T, retryLimit int, expiration time.Duration) taskqueue.Tasker {
+		return taskqueue.NewInMemoryTaskQueue(retryLimit, expiration, logger.New(io.Discard))
+	})
+}
+
+func TestInMemoryFairness(t *testing.T) {
+	taskqueuetest.RunFairness(t, func(t *testing.T, fairness taskqueue.Fairness) taskqueue.Tasker {
+		q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, logger.New(io.Discard))
+		q.Fairness = fairness
+		return q
+	})
+}
+
+func TestFileConformance(t *testing.T) {
+	taskqueuetest.Run(t, 50*time.Millisecond, func(t *testing.T, retryLimit int, expiration time.Duration) taskqueue.Tasker {
+		q, err := taskqueue.NewFileTaskQueue(filepath.Join(t.TempDir(), "tasks.log"), retryLimit, expiration, logger.New(io.Discard))
+		require.NoError(t, err)
+		return q
+	})
+}
+
+func TestFileFairness(t *testing.T) {
+	taskqueuetest.RunFairness(t, func(t *testing.T, fairness taskqueue.Fairness) taskqueue.Tasker {
+		q, err := taskqueue.NewFileTaskQueue(filepath.Join(t.TempDir(), "tasks.log"), 3, time.Minute, logger.New(io.Discard))
+		require.NoError(t, err)
+		q.Fairness = fairness
+		return q
+	})
+}
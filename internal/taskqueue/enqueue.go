@@ -0,0 +1,84 @@
+package taskqueue
+
+import (
+	"context"
+	"time"
+
+	"github.com/sethgrid/helloworld/logger"
+)
+
+// EnqueueOption configures a task as it is added with AddTask.
+type EnqueueOption func(*enqueueConfig)
+
+type enqueueConfig struct {
+	runAt    time.Time
+	queue    string
+	priority int
+	// dedupKey and dedupWindow are set by WithDedupKey
+	dedupKey    string
+	dedupWindow time.Duration
+	// traceParent and requestID are captured from the AddTask context
+	traceParent string
+	requestID   string
+}
+
+// RunAt holds the task until t; it is not fetched before then. A time in the past runs the task right away.
+func RunAt(t time.Time) EnqueueOption {
+	return func(c *enqueueConfig) {
+		c.runAt = t
+	}
+}
+
+// RunAfter holds the task for d from the moment the option is created.
+func RunAfter(d time.Duration) EnqueueOption {
+	return RunAt(time.Now().Add(d))
+}
+
+// OnQueue places the task on a named queue. Each queue is fetched by its own pool of Runner workers,
+// so bulk work on one queue cannot starve another. Tasks go to DefaultQueue unless set.
+func OnQueue(name string) EnqueueOption {
+	return func(c *enqueueConfig) {
+		if name != "" {
+			c.queue = name
+		}
+	}
+}
+
+// WithPriority orders the task within its queue. Higher priorities are fetched first; tasks of
+// equal priority are fetched oldest first. The default priority is 0 and negative values are allowed.
+func WithPriority(priority int) EnqueueOption {
+	return func(c *enqueueConfig) {
+		c.priority = priority
+	}
+}
+
+// WithDedupKey makes the enqueue idempotent: while a task added with the same key is within its
+// window, AddTask returns that task's ID instead of adding another, so a retried request or a
+// double-fired schedule does not create duplicate work. Keys are global; include the user or
+// other scope in the key when needed. A window of zero holds the key for as long as the task exists.
+func WithDedupKey(key string, window time.Duration) EnqueueOption {
+	return func(c *enqueueConfig) {
+		c.dedupKey = key
+		c.dedupWindow = window
+	}
+}
+
+// dedupExpiresAt is when the dedup key stops matching, or the zero time if it never expires.
+func (c enqueueConfig) dedupExpiresAt(now time.Time) time.Time {
+	if c.dedupWindow <= 0 {
+		return time.Time{}
+	}
+	return now.Add(c.dedupWindow)
+}
+
+func newEnqueueConfig(ctx context.Context, opts []EnqueueOption) enqueueConfig {
+	c := enqueueConfig{
+		queue:       DefaultQueue,
+		traceParent: traceParentFromCtx(ctx),
+		requestID:   logger.RequestIDFromCtx(ctx),
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
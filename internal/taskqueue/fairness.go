@@ -0,0 +1,93 @@
+package taskqueue
+
+import (
+	"slices"
+	"strconv"
+
+	"github.com/sethgrid/helloworld/metrics"
+)
+
+// Fairness controls how a task store shares workers between users when checking out tasks. The
+// zero value checks out strictly by priority and age, so one user who enqueues thousands of tasks
+// can hold every worker until their backlog drains.
+type Fairness struct {
+	// RoundRobin takes due tasks from each user in turn, in user ID order, continuing from the user
+	// served last on the queue. Within a user's tasks, priority and age order still apply.
+	RoundRobin bool
+	// MaxPerUser caps how many of a user's tasks can be checked out at once, across all queues.
+	// Zero is no cap. MySQL replicas fetching at the same moment can each take a user's last
+	// free slot, so the cap can be briefly exceeded there.
+	MaxPerUser int
+}
+
+func (f Fairness) enabled() bool {
+	return f.RoundRobin || f.MaxPerUser > 0
+}
+
+// room returns how many more of the user's tasks can be checked out, at most n.
+func (f Fairness) room(userID int, inFlight map[int]int, n int) int {
+	if f.MaxPerUser <= 0 {
+		return n
+	}
+	return min(max(f.MaxPerUser-inFlight[userID], 0), n)
+}
+
+// userShare is how many due tasks to check out for one user.
+type userShare struct {
+	userID int
+	count  int
+}
+
+// planRoundRobin splits n checkouts between the users with due tasks, one per user per round,
+// starting after the user served last. due is the number of due tasks per user. It returns the
+// shares in the order they were served, and the user served last.
+func (f Fairness) planRoundRobin(due map[int]int, inFlight map[int]int, n int, last int) ([]userShare, int) {
+	users := make([]int, 0, len(due))
+	for userID := range due {
+		users = append(users, userID)
+	}
+	slices.Sort(users)
+	// rotate so the first user after the last one served goes first
+	start, _ := slices.BinarySearch(users, last+1)
+	users = append(users[start:], users[:start]...)
+
+	shares := make([]userShare, len(users))
+	for i, userID := range users {
+		shares[i].userID = userID
+	}
+	for n > 0 {
+		served := false
+		for i := range shares {
+			if n == 0 {
+				break
+			}
+			userID := shares[i].userID
+			if shares[i].count >= f.room(userID, inFlight, due[userID]) {
+				continue
+			}
+			shares[i].count++
+			n--
+			last = userID
+			served = true
+		}
+		if !served {
+			break
+		}
+	}
+	return slices.DeleteFunc(shares, func(s userShare) bool { return s.count == 0 }), last
+}
+
+// trackUser adjusts the runner's count of in-flight tasks for userID. Users are dropped from the
+// metric once they have nothing running so the label set stays bounded.
+func (tq *Runner) trackUser(userID int, delta int) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	tq.userInFlight[userID] += delta
+	label := strconv.Itoa(userID)
+	if tq.userInFlight[userID] <= 0 {
+		delete(tq.userInFlight, userID)
+		metrics.TaskUserInFlight.DeleteLabelValues(label)
+		return
+	}
+	metrics.TaskUserInFlight.WithLabelValues(label).Set(float64(tq.userInFlight[userID]))
+}
@@ -0,0 +1,593 @@
+package taskqueue
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sethgrid/kverr"
+)
+
+// defaultCompactAfter is how many records the log grows past its last compaction before it is
+// compacted again.
+const defaultCompactAfter = 10000
+
+// errTaskLogClosed is returned by calls made after Close.
+var errTaskLogClosed = errors.New("task log is closed")
+
+// walRecord is one line of the FileTaskQueue log. Exactly one field is set.
+type walRecord struct {
+	// Task is the full state of a task after it was added or changed.
+	Task *Task `json:"task,omitempty"`
+	// Deleted is the ID of a task that was purged or swept.
+	Deleted int `json:"deleted,omitempty"`
+	// Dedup is a dedup key pointing at a task.
+	Dedup *walDedup `json:"dedup,omitempty"`
+	// NextID is the next task ID. Compaction writes it first so the IDs of deleted tasks aren't reused.
+	NextID int64 `json:"next_id,omitempty"`
+}
+
+type walDedup struct {
+	Key       string    `json:"key"`
+	TaskID    int       `json:"task_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// FileTaskQueue is an InMemoryTaskQueue that survives restarts, for development and single node
+// deployments without MySQL. Every change is appended to a log file, one JSON record per line, and
+// synced to disk before the call returns. On open the log is replayed; checkouts left behind by the
+// previous process are fetched again once their lease expires, or marked dead by
+// CheckAndMarkDeadTasks if they were on their last attempt, like any other expired checkout. The
+// log is rewritten with just the current tasks once it has grown CompactAfter records past its
+// last compaction.
+//
+// Only one process may open a file at a time; nothing enforces this.
+type FileTaskQueue struct {
+	*InMemoryTaskQueue
+
+	// CompactAfter is how many records are appended between compactions; it defaults to 10000.
+	CompactAfter int
+
+	path string
+	// opMu is held for writing across each change and the sync that makes it durable, and for
+	// reading by lookups, so no caller sees a change that hasn't reached the disk
+	opMu  sync.RWMutex
+	walMu sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	// records is how many records the log holds and compacted is how many of those the last
+	// compaction wrote
+	records   int
+	compacted int
+	// err is the first write error, or errTaskLogClosed after Close. Once set, every call fails:
+	// the change that hit the error is in memory but may not be in the log, so memory can no
+	// longer be trusted. Reopening the log loads what was durable.
+	err error
+}
+
+// NewFileTaskQueue opens the task log at path, creating it if needed, and loads its tasks.
+func NewFileTaskQueue(path string, retryLimit int, itemExpiration time.Duration, logger *slog.Logger) (*FileTaskQueue, error) {
+	f := &FileTaskQueue{
+		InMemoryTaskQueue: NewInMemoryTaskQueue(retryLimit, itemExpiration, logger),
+		CompactAfter:      defaultCompactAfter,
+		path:              path,
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, kverr.New(fmt.Errorf("unable to open task log: %w", err), "path", path)
+	}
+	f.file = file
+	f.w = bufio.NewWriter(file)
+	f.persist = f.append
+	return f, nil
+}
+
+// load replays the log into memory. A partial record at the end, left by a crash in the middle
+// of a write, is dropped; a bad record anywhere else is an error.
+func (f *FileTaskQueue) load() error {
+	file, err := os.Open(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return kverr.New(fmt.Errorf("unable to open task log: %w", err), "path", f.path)
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) == 0 {
+				return nil
+			}
+			f.logger.Warn("dropping partial record at the end of the task log", "path", f.path, "offset", offset)
+			if err := os.Truncate(f.path, offset); err != nil {
+				return kverr.New(fmt.Errorf("unable to truncate task log: %w", err), "path", f.path)
+			}
+			return nil
+		}
+		if err != nil {
+			return kverr.New(fmt.Errorf("unable to read task log: %w", err), "path", f.path)
+		}
+
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return kverr.New(fmt.Errorf("corrupt task log: %w", err), "path", f.path, "offset", offset)
+		}
+		f.apply(rec)
+		f.records++
+		offset += int64(len(line))
+	}
+}
+
+// apply replays one record. It is only called while loading, before the queue is shared.
+func (f *FileTaskQueue) apply(rec walRecord) {
+	m := f.InMemoryTaskQueue
+	switch {
+	case rec.Task != nil:
+		m.tasks[rec.Task.ID] = rec.Task
+		m.nextID = max(m.nextID, int64(rec.Task.ID)+1)
+	case rec.Deleted != 0:
+		delete(m.tasks, rec.Deleted)
+		for key, entry := range m.dedup {
+			if entry.taskID == rec.Deleted {
+				delete(m.dedup, key)
+			}
+		}
+	case rec.Dedup != nil:
+		m.dedup[rec.Dedup.Key] = dedupEntry{taskID: rec.Dedup.TaskID, expiresAt: rec.Dedup.ExpiresAt}
+	case rec.NextID != 0:
+		m.nextID = max(m.nextID, rec.NextID)
+	}
+}
+
+// append writes rec to the log buffer. It is the InMemoryTaskQueue persist hook, so it is called
+// with f.mu held and records are written in the order the changes were made.
+func (f *FileTaskQueue) append(rec walRecord) {
+	f.walMu.Lock()
+	defer f.walMu.Unlock()
+	if f.err != nil {
+		return
+	}
+
+	line, err := json.Marshal(rec)
+	if err == nil {
+		_, err = f.w.Write(append(line, '\n'))
+	}
+	if err != nil {
+		f.err = kverr.New(fmt.Errorf("unable to write task log: %w", err), "path", f.path)
+		return
+	}
+	f.records++
+}
+
+// sync makes the changes appended so far durable, and compacts the log once it has grown enough.
+// f.opMu must be held for writing.
+func (f *FileTaskQueue) sync() error {
+	f.walMu.Lock()
+	err := f.flushLocked()
+	compactAfter := f.CompactAfter
+	if compactAfter <= 0 {
+		compactAfter = defaultCompactAfter
+	}
+	compact := err == nil && f.records-f.compacted >= compactAfter
+	f.walMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if compact {
+		return f.compact()
+	}
+	return nil
+}
+
+// flushLocked writes out the buffer and syncs the file. f.walMu must be held.
+func (f *FileTaskQueue) flushLocked() error {
+	if f.err != nil {
+		return f.err
+	}
+	if err := f.w.Flush(); err != nil {
+		f.err = kverr.New(fmt.Errorf("unable to write task log: %w", err), "path", f.path)
+		return f.err
+	}
+	if err := f.file.Sync(); err != nil {
+		f.err = kverr.New(fmt.Errorf("unable to sync task log: %w", err), "path", f.path)
+		return f.err
+	}
+	return nil
+}
+
+// Compact rewrites the log with one record per task and dedup key, dropping the history of how
+// they got there. The new log is written next to the old one and renamed over it, so a crash
+// leaves one or the other intact. It runs on its own as the log grows; see CompactAfter.
+func (f *FileTaskQueue) Compact() error {
+	if err := f.lockChange(); err != nil {
+		return err
+	}
+	defer f.opMu.Unlock()
+	return f.compact()
+}
+
+// compact is Compact for callers holding f.opMu.
+func (f *FileTaskQueue) compact() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.walMu.Lock()
+	defer f.walMu.Unlock()
+	if err := f.flushLocked(); err != nil {
+		return err
+	}
+
+	tmpPath := f.path + ".tmp"
+	records, err := f.writeSnapshot(tmpPath)
+	if err == nil {
+		err = os.Rename(tmpPath, f.path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(f.path))
+	}
+	if err != nil {
+		// the old log is still whole and still being appended to
+		os.Remove(tmpPath)
+		return kverr.New(fmt.Errorf("unable to compact task log: %w", err), "path", f.path)
+	}
+
+	// the open file is the log that was just replaced, so switch appends over to the new one
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		f.err = kverr.New(fmt.Errorf("unable to reopen task log: %w", err), "path", f.path)
+		return f.err
+	}
+	f.file.Close()
+	f.file = file
+	f.w.Reset(file)
+	f.logger.Info("compacted task log", "path", f.path, "records_before", f.records, "records_after", records)
+	f.records = records
+	f.compacted = records
+	return nil
+}
+
+// writeSnapshot writes the current tasks and dedup keys to a new log at path and returns how many
+// records it wrote. f.mu must be held.
+func (f *FileTaskQueue) writeSnapshot(path string) (int, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	records := []walRecord{{NextID: f.nextID}}
+
+	ids := make([]int, 0, len(f.tasks))
+	for id := range f.tasks {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		records = append(records, walRecord{Task: f.tasks[id]})
+	}
+
+	keys := make([]string, 0, len(f.dedup))
+	for key, entry := range f.dedup {
+		if _, ok := f.tasks[entry.taskID]; ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entry := f.dedup[key]
+		records = append(records, walRecord{Dedup: &walDedup{Key: key, TaskID: entry.taskID, ExpiresAt: entry.expiresAt}})
+	}
+
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return 0, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	return len(records), file.Close()
+}
+
+// syncDir syncs a directory so a rename in it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Close syncs and closes the log. Unlike InMemoryTaskQueue.Close, the tasks are kept; they are
+// loaded again by the next NewFileTaskQueue.
+func (f *FileTaskQueue) Close() error {
+	// wait for changes in progress to be synced
+	f.opMu.Lock()
+	defer f.opMu.Unlock()
+	f.walMu.Lock()
+	defer f.walMu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.flushLocked()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	f.file = nil
+	if f.err == nil {
+		f.err = errTaskLogClosed
+	}
+	return err
+}
+
+// logErr returns the error every call fails with once the log has failed or been closed.
+func (f *FileTaskQueue) logErr() error {
+	f.walMu.Lock()
+	defer f.walMu.Unlock()
+	return f.err
+}
+
+// lockChange locks f.opMu for a change. It returns the log's error instead, without the lock,
+// once the log has failed or been closed.
+func (f *FileTaskQueue) lockChange() error {
+	f.opMu.Lock()
+	if err := f.logErr(); err != nil {
+		f.opMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// lockLookup is lockChange for calls that only read tasks.
+func (f *FileTaskQueue) lockLookup() error {
+	f.opMu.RLock()
+	if err := f.logErr(); err != nil {
+		f.opMu.RUnlock()
+		return err
+	}
+	return nil
+}
+
+// The methods below change tasks through the InMemoryTaskQueue, which appends each change to
+// the log, and then sync the log before returning. They hold f.opMu throughout, so the change
+// is only seen once it is durable; if the sync fails, the store fails every call from then on.
+
+func (f *FileTaskQueue) AddTask(ctx context.Context, userID int, taskType string, payload string, opts ...EnqueueOption) (int, error) {
+	if err := f.lockChange(); err != nil {
+		return 0, err
+	}
+	defer f.opMu.Unlock()
+
+	id, err := f.InMemoryTaskQueue.AddTask(ctx, userID, taskType, payload, opts...)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.sync(); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// AddTaskTx is AddTask; like the in-memory queue, the file queue has no transactions to join, so
+// tx is ignored and may be nil.
+func (f *FileTaskQueue) AddTaskTx(ctx context.Context, tx *sql.Tx, userID int, taskType string, payload string, opts ...EnqueueOption) (int, error) {
+	return f.AddTask(ctx, userID, taskType, payload, opts...)
+}
+
+func (f *FileTaskQueue) FetchOpenTask(ctx context.Context, queue string) (*Task, error) {
+	tasks, err := f.FetchOpenTasks(ctx, queue, 1)
+	if err != nil || len(tasks) == 0 {
+		return nil, err
+	}
+	return tasks[0], nil
+}
+
+func (f *FileTaskQueue) FetchOpenTasks(ctx context.Context, queue string, n int) ([]*Task, error) {
+	return f.FetchOpenTasksExcept(ctx, queue, n, nil)
+}
+
+func (f *FileTaskQueue) FetchOpenTasksExcept(ctx context.Context, queue string, n int, skipTypes []string) ([]*Task, error) {
+	if err := f.lockChange(); err != nil {
+		return nil, err
+	}
+	defer f.opMu.Unlock()
+
+	tasks, err := f.InMemoryTaskQueue.FetchOpenTasksExcept(ctx, queue, n, skipTypes)
+	if err != nil || len(tasks) == 0 {
+		return nil, err
+	}
+	if err := f.sync(); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+func (f *FileTaskQueue) GetTask(ctx context.Context, taskID int) (*Task, error) {
+	if err := f.lockLookup(); err != nil {
+		return nil, err
+	}
+	defer f.opMu.RUnlock()
+	return f.InMemoryTaskQueue.GetTask(ctx, taskID)
+}
+
+func (f *FileTaskQueue) ExtendLease(ctx context.Context, taskID int, leaseToken string, d time.Duration) (time.Time, error) {
+	if err := f.lockChange(); err != nil {
+		return time.Time{}, err
+	}
+	defer f.opMu.Unlock()
+
+	expiresAt, err := f.InMemoryTaskQueue.ExtendLease(ctx, taskID, leaseToken, d)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := f.sync(); err != nil {
+		return time.Time{}, err
+	}
+	return expiresAt, nil
+}
+
+func (f *FileTaskQueue) MarkTaskComplete(ctx context.Context, taskID int, leaseToken string, result string) error {
+	if err := f.lockChange(); err != nil {
+		return err
+	}
+	defer f.opMu.Unlock()
+
+	if err := f.InMemoryTaskQueue.MarkTaskComplete(ctx, taskID, leaseToken, result); err != nil {
+		return err
+	}
+	return f.sync()
+}
+
+func (f *FileTaskQueue) MarkTaskDead(ctx context.Context, taskID int, leaseToken string, reason string) error {
+	if err := f.lockChange(); err != nil {
+		return err
+	}
+	defer f.opMu.Unlock()
+
+	if err := f.InMemoryTaskQueue.MarkTaskDead(ctx, taskID, leaseToken, reason); err != nil {
+		return err
+	}
+	return f.sync()
+}
+
+func (f *FileTaskQueue) FailTask(ctx context.Context, taskID int, leaseToken string, errMsg string, nextAttemptAt time.Time) error {
+	if err := f.lockChange(); err != nil {
+		return err
+	}
+	defer f.opMu.Unlock()
+
+	if err := f.InMemoryTaskQueue.FailTask(ctx, taskID, leaseToken, errMsg, nextAttemptAt); err != nil {
+		return err
+	}
+	return f.sync()
+}
+
+func (f *FileTaskQueue) ReleaseTask(ctx context.Context, taskID int, leaseToken string) error {
+	if err := f.lockChange(); err != nil {
+		return err
+	}
+	defer f.opMu.Unlock()
+
+	if err := f.InMemoryTaskQueue.ReleaseTask(ctx, taskID, leaseToken); err != nil {
+		return err
+	}
+	return f.sync()
+}
+
+func (f *FileTaskQueue) CancelTasks(ctx context.Context, filter TaskFilter) ([]int, error) {
+	if err := f.lockChange(); err != nil {
+		return nil, err
+	}
+	defer f.opMu.Unlock()
+
+	ids, err := f.InMemoryTaskQueue.CancelTasks(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.sync(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (f *FileTaskQueue) CheckAndMarkDeadTasks(ctx context.Context) error {
+	if err := f.lockChange(); err != nil {
+		return err
+	}
+	defer f.opMu.Unlock()
+
+	if err := f.InMemoryTaskQueue.CheckAndMarkDeadTasks(ctx); err != nil {
+		return err
+	}
+	return f.sync()
+}
+
+func (f *FileTaskQueue) ListDeadTasks(ctx context.Context, filter TaskFilter) ([]Task, error) {
+	if err := f.lockLookup(); err != nil {
+		return nil, err
+	}
+	defer f.opMu.RUnlock()
+	return f.InMemoryTaskQueue.ListDeadTasks(ctx, filter)
+}
+
+func (f *FileTaskQueue) RequeueDeadTasks(ctx context.Context, filter TaskFilter) (int, error) {
+	if err := f.lockChange(); err != nil {
+		return 0, err
+	}
+	defer f.opMu.Unlock()
+
+	count, err := f.InMemoryTaskQueue.RequeueDeadTasks(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.sync(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (f *FileTaskQueue) PurgeDeadTasks(ctx context.Context, filter TaskFilter) (int, error) {
+	if err := f.lockChange(); err != nil {
+		return 0, err
+	}
+	defer f.opMu.Unlock()
+
+	count, err := f.InMemoryTaskQueue.PurgeDeadTasks(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.sync(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// SweepTasks deletes tasks oldest first. The file queue has no archive.
+func (f *FileTaskQueue) SweepTasks(ctx context.Context, status string, finishedBefore time.Time, limit int) (int, error) {
+	if err := f.lockChange(); err != nil {
+		return 0, err
+	}
+	defer f.opMu.Unlock()
+
+	count, err := f.InMemoryTaskQueue.SweepTasks(ctx, status, finishedBefore, limit)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.sync(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (f *FileTaskQueue) CountTasks(ctx context.Context) ([]TaskCount, error) {
+	if err := f.lockLookup(); err != nil {
+		return nil, err
+	}
+	defer f.opMu.RUnlock()
+	return f.InMemoryTaskQueue.CountTasks(ctx)
+}
@@ -0,0 +1,257 @@
+package taskqueue
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sethgrid/helloworld/logger"
+)
+
+func TestFileTaskQueueRecovers(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	path := filepath.Join(t.TempDir(), "tasks.log")
+
+	q, err := NewFileTaskQueue(path, 3, 50*time.Millisecond, log)
+	require.NoError(t, err)
+	openID, err := q.AddTask(ctx, 1, "report", "{}", WithDedupKey("report-1", 0), WithPriority(2))
+	require.NoError(t, err)
+	doneID, err := q.AddTask(ctx, 1, "report", "{}")
+	require.NoError(t, err)
+	checkedOutID, err := q.AddTask(ctx, 2, "export", "{}")
+	require.NoError(t, err)
+	deletedID, err := q.AddTask(ctx, 2, "export", "{}")
+	require.NoError(t, err)
+
+	task, err := q.FetchOpenTask(ctx, DefaultQueue)
+	require.NoError(t, err)
+	require.Equal(t, openID, task.ID)
+	require.NoError(t, q.FailTask(ctx, openID, task.LeaseToken, "try again", time.Time{}))
+	tasks, err := q.FetchOpenTasks(ctx, DefaultQueue, 2)
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+	require.NoError(t, q.MarkTaskComplete(ctx, doneID, tasks[1].LeaseToken, `{"rows":3}`))
+	require.NoError(t, q.MarkTaskDead(ctx, deletedID, "", "gave up"))
+	_, err = q.PurgeDeadTasks(ctx, TaskFilter{})
+	require.NoError(t, err)
+	// the process "crashes" while tasks[0] is checked out; Close only releases the file
+	require.Equal(t, openID, tasks[0].ID)
+	require.NoError(t, q.Close())
+	time.Sleep(100 * time.Millisecond)
+
+	q, err = NewFileTaskQueue(path, 3, 50*time.Millisecond, log)
+	require.NoError(t, err)
+	defer q.Close()
+
+	got, err := q.GetTask(ctx, doneID)
+	require.NoError(t, err)
+	assert.Equal(t, "complete", got.Status)
+	assert.Equal(t, `{"rows":3}`, got.Result)
+
+	// the expired checkout keeps its attempts and last error, and is fetched again
+	got, err = q.GetTask(ctx, openID)
+	require.NoError(t, err)
+	assert.Equal(t, "checked_out", got.Status)
+	assert.Equal(t, 2, got.Attempts)
+	assert.Equal(t, "try again", got.LastError)
+	assert.Equal(t, 2, got.Priority)
+	refetched, err := q.FetchOpenTask(ctx, DefaultQueue)
+	require.NoError(t, err)
+	require.NotNil(t, refetched)
+	assert.Equal(t, openID, refetched.ID)
+	assert.Equal(t, 3, refetched.Attempts)
+	assert.NotEqual(t, tasks[0].LeaseToken, refetched.LeaseToken)
+
+	got, err = q.GetTask(ctx, checkedOutID)
+	require.NoError(t, err)
+	assert.Equal(t, "open", got.Status, "a task that was never fetched stays open")
+
+	_, err = q.GetTask(ctx, deletedID)
+	assert.ErrorIs(t, err, ErrTaskNotFound)
+
+	// dedup keys and IDs carry over
+	id, err := q.AddTask(ctx, 1, "report", "{}", WithDedupKey("report-1", 0))
+	require.NoError(t, err)
+	assert.Equal(t, openID, id)
+	id, err = q.AddTask(ctx, 1, "report", "{}")
+	require.NoError(t, err)
+	assert.Equal(t, deletedID+1, id)
+}
+
+func TestFileTaskQueueCompacts(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	path := filepath.Join(t.TempDir(), "tasks.log")
+
+	q, err := NewFileTaskQueue(path, 3, time.Minute, log)
+	require.NoError(t, err)
+	q.CompactAfter = 20
+
+	var lastID int
+	for i := 0; i < 10; i++ {
+		lastID, err = q.AddTask(ctx, 1, "report", "{}")
+		require.NoError(t, err)
+		task, err := q.FetchOpenTask(ctx, DefaultQueue)
+		require.NoError(t, err)
+		require.NoError(t, q.MarkTaskComplete(ctx, task.ID, task.LeaseToken, ""))
+	}
+	swept, err := q.SweepTasks(ctx, "complete", time.Now().Add(time.Second), 5)
+	require.NoError(t, err)
+	require.Equal(t, 5, swept)
+	require.NoError(t, q.Compact())
+	require.NoError(t, q.Close())
+
+	// one record for the next ID and one per remaining task
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 6, strings.Count(string(data), "\n"))
+
+	q, err = NewFileTaskQueue(path, 3, time.Minute, log)
+	require.NoError(t, err)
+	defer q.Close()
+	counts, err := q.CountTasks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []TaskCount{{Status: "complete", TaskType: "report", Count: 5}}, counts)
+	id, err := q.AddTask(ctx, 1, "report", "{}")
+	require.NoError(t, err)
+	assert.Equal(t, lastID+1, id)
+}
+
+func TestFileTaskQueueLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		tail    string
+		wantErr bool
+	}{
+		{name: "partial last record is dropped", tail: `{"task":{"ID":2,"Sta`},
+		{name: "corrupt record is an error", tail: "not json\n" + `{"deleted":1}` + "\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			log := logger.New(io.Discard)
+			path := filepath.Join(t.TempDir(), "tasks.log")
+
+			q, err := NewFileTaskQueue(path, 3, time.Minute, log)
+			require.NoError(t, err)
+			id, err := q.AddTask(ctx, 1, "report", "{}")
+			require.NoError(t, err)
+			require.NoError(t, q.Close())
+
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+			require.NoError(t, err)
+			_, err = file.WriteString(tt.tail)
+			require.NoError(t, err)
+			require.NoError(t, file.Close())
+
+			q, err = NewFileTaskQueue(path, 3, time.Minute, log)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer q.Close()
+			_, err = q.GetTask(ctx, id)
+			require.NoError(t, err)
+
+			// new records start on a line of their own
+			_, err = q.AddTask(ctx, 1, "report", "{}")
+			require.NoError(t, err)
+			require.NoError(t, q.Close())
+			q, err = NewFileTaskQueue(path, 3, time.Minute, log)
+			require.NoError(t, err)
+			counts, err := q.CountTasks(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []TaskCount{{Status: "open", TaskType: "report", Count: 2}}, counts)
+		})
+	}
+}
+
+func TestFileTaskQueueFailsClosed(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+
+	t.Run("after close", func(t *testing.T) {
+		q, err := NewFileTaskQueue(filepath.Join(t.TempDir(), "tasks.log"), 3, time.Minute, log)
+		require.NoError(t, err)
+		id, err := q.AddTask(ctx, 1, "report", "{}")
+		require.NoError(t, err)
+		require.NoError(t, q.Close())
+
+		_, err = q.AddTask(ctx, 1, "report", "{}")
+		assert.ErrorIs(t, err, errTaskLogClosed)
+		_, err = q.FetchOpenTasks(ctx, DefaultQueue, 1)
+		assert.ErrorIs(t, err, errTaskLogClosed)
+		_, err = q.FetchOpenTask(ctx, DefaultQueue)
+		assert.ErrorIs(t, err, errTaskLogClosed)
+		_, err = q.GetTask(ctx, id)
+		assert.ErrorIs(t, err, errTaskLogClosed)
+		assert.ErrorIs(t, q.Compact(), errTaskLogClosed)
+		require.NoError(t, q.Close())
+	})
+
+	t.Run("after write error", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "tasks.log")
+		q, err := NewFileTaskQueue(path, 3, time.Minute, log)
+		require.NoError(t, err)
+		openID, err := q.AddTask(ctx, 1, "report", "{}")
+		require.NoError(t, err)
+
+		// the disk goes away under the queue
+		require.NoError(t, q.file.Close())
+
+		_, err = q.AddTask(ctx, 1, "export", "{}", WithDedupKey("export-1", 0))
+		require.Error(t, err)
+		// a retry must not enqueue the task the failed call left in memory
+		_, err = q.AddTask(ctx, 1, "export", "{}", WithDedupKey("export-1", 0))
+		require.Error(t, err)
+		_, err = q.FetchOpenTasks(ctx, DefaultQueue, 1)
+		require.Error(t, err)
+		_, err = q.GetTask(ctx, openID)
+		require.Error(t, err)
+		q.Close()
+
+		q, err = NewFileTaskQueue(path, 3, time.Minute, log)
+		require.NoError(t, err)
+		defer q.Close()
+		counts, err := q.CountTasks(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []TaskCount{{Status: "open", TaskType: "report", Count: 1}}, counts)
+		task, err := q.FetchOpenTask(ctx, DefaultQueue)
+		require.NoError(t, err)
+		require.NotNil(t, task)
+		assert.Equal(t, openID, task.ID)
+		assert.Equal(t, 1, task.Attempts)
+	})
+
+	t.Run("fetch after write error", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "tasks.log")
+		q, err := NewFileTaskQueue(path, 3, time.Minute, log)
+		require.NoError(t, err)
+		id, err := q.AddTask(ctx, 1, "report", "{}")
+		require.NoError(t, err)
+
+		require.NoError(t, q.file.Close())
+		_, err = q.FetchOpenTasks(ctx, DefaultQueue, 1)
+		require.Error(t, err)
+		q.Close()
+
+		// the failed fetch never reached the log, so the task is open without an attempt used
+		q, err = NewFileTaskQueue(path, 3, time.Minute, log)
+		require.NoError(t, err)
+		defer q.Close()
+		got, err := q.GetTask(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, "open", got.Status)
+		assert.Equal(t, 0, got.Attempts)
+	})
+}
@@ -0,0 +1,94 @@
+package taskqueue
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// TaskFilter selects tasks for inspection and bulk operations. Zero valued fields are ignored,
+// so an empty filter matches every task the operation applies to.
+type TaskFilter struct {
+	IDs      []int
+	UserID   int
+	TaskType string
+	// Statuses matches tasks in any of the given statuses, e.g. "open" or "checked_out".
+	Statuses []string
+	// UpdatedBefore matches tasks last changed before the given time. A dead task isn't changed
+	// after it dies, so this selects tasks that have been dead for over an hour, say, however
+	// long ago they were created.
+	UpdatedBefore time.Time
+	// Limit caps how many tasks are returned or changed. Zero means no limit.
+	Limit int
+}
+
+// IsEmpty reports whether the filter has no conditions.
+func (f TaskFilter) IsEmpty() bool {
+	return len(f.IDs) == 0 && f.UserID == 0 && f.TaskType == "" && len(f.Statuses) == 0 && f.UpdatedBefore.IsZero()
+}
+
+// matches is used by the in-memory queue. It ignores Limit; callers apply it.
+func (f TaskFilter) matches(task *Task) bool {
+	if len(f.IDs) > 0 {
+		found := false
+		for _, id := range f.IDs {
+			if id == task.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.UserID != 0 && task.UserID != f.UserID {
+		return false
+	}
+	if f.TaskType != "" && task.TaskType != f.TaskType {
+		return false
+	}
+	if len(f.Statuses) > 0 && !slices.Contains(f.Statuses, task.Status) {
+		return false
+	}
+	if !f.UpdatedBefore.IsZero() && !task.UpdatedAt.Before(f.UpdatedBefore) {
+		return false
+	}
+	return true
+}
+
+// where is used by the MySQL queue. It returns conditions to append to an existing WHERE clause,
+// each prefixed with AND, along with their args. It ignores Limit; callers apply it.
+func (f TaskFilter) where() (string, []any) {
+	var clauses []string
+	var args []any
+
+	if len(f.IDs) > 0 {
+		clauses = append(clauses, "id IN ("+strings.TrimSuffix(strings.Repeat("?,", len(f.IDs)), ",")+")")
+		for _, id := range f.IDs {
+			args = append(args, id)
+		}
+	}
+	if f.UserID != 0 {
+		clauses = append(clauses, "user_id = ?")
+		args = append(args, f.UserID)
+	}
+	if f.TaskType != "" {
+		clauses = append(clauses, "task_type = ?")
+		args = append(args, f.TaskType)
+	}
+	if len(f.Statuses) > 0 {
+		clauses = append(clauses, "status IN ("+strings.TrimSuffix(strings.Repeat("?,", len(f.Statuses)), ",")+")")
+		for _, status := range f.Statuses {
+			args = append(args, status)
+		}
+	}
+	if !f.UpdatedBefore.IsZero() {
+		clauses = append(clauses, "updated_at < ?")
+		args = append(args, f.UpdatedBefore)
+	}
+
+	if len(clauses) == 0 {
+		return "", nil
+	}
+	return " AND " + strings.Join(clauses, " AND "), args
+}
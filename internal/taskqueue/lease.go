@@ -0,0 +1,66 @@
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sethgrid/kverr"
+)
+
+// ErrLeaseLost is returned, possibly wrapped, when a worker reports on or extends a task it no
+// longer holds: its lease expired and the task was checked out again, or the task already moved
+// on to another status. The worker should stop; its outcome is discarded.
+var ErrLeaseLost = errors.New("task lease lost")
+
+// leaseKey is the context key for the lease of the task being processed.
+type leaseKey struct{}
+
+type lease struct {
+	store  Tasker
+	taskID int
+	token  string
+}
+
+// withLease makes the task's lease available to Heartbeat from the handler's context.
+func withLease(ctx context.Context, store Tasker, task Task) context.Context {
+	return context.WithValue(ctx, leaseKey{}, lease{store: store, taskID: task.ID, token: task.LeaseToken})
+}
+
+// Heartbeat extends the lease on the task being processed by the store's checkout expiration.
+// Handlers that can run longer than the expiration should call it periodically so the task is not
+// checked out again by another worker while it is still running. When it returns ErrLeaseLost
+// another worker owns the task and the handler should return.
+func Heartbeat(ctx context.Context) error {
+	return ExtendLease(ctx, 0)
+}
+
+// ExtendLease is Heartbeat with an explicit extension, for a handler about to start a step it
+// knows will take longer than the store's checkout expiration. d <= 0 uses the store's expiration.
+func ExtendLease(ctx context.Context, d time.Duration) error {
+	l, ok := ctx.Value(leaseKey{}).(lease)
+	if !ok {
+		return errors.New("heartbeat called outside of a task handler")
+	}
+	if _, err := l.store.ExtendLease(context.WithoutCancel(ctx), l.taskID, l.token, d); err != nil {
+		return kverr.New(err, "task_id", l.taskID)
+	}
+	return nil
+}
+
+// checkLease is used by the in-memory queue to validate a lease token against the task it reports on.
+func checkLease(task *Task, leaseToken string) error {
+	if leaseToken == "" {
+		return nil
+	}
+	if task.Status != "checked_out" || task.LeaseToken != leaseToken {
+		return kverr.New(ErrLeaseLost, "task_id", task.ID, "status", task.Status)
+	}
+	return nil
+}
+
+// releaseLease clears the lease once the task leaves checked_out.
+func (t *Task) releaseLease() {
+	t.LeaseToken = ""
+	t.LeaseExpiresAt = time.Time{}
+}
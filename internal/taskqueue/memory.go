@@ -1,115 +1,546 @@
 package taskqueue
 
 import (
-	"fmt"
+	"context"
+	"database/sql"
 	"log/slog"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/sethgrid/kverr"
 )
 
 type InMemoryTaskQueue struct {
+	enqueueListeners
+
 	tasks          map[int]*Task
+	dedup          map[string]dedupEntry
 	mu             sync.Mutex
 	nextID         int64
 	RetryLimit     int
 	ItemExpiration time.Duration
-	logger         *slog.Logger
+	// Fairness controls how FetchOpenTasks shares workers between users.
+	Fairness Fairness
+	// lastServed is the user served last on each queue, where round-robin fetches continue from
+	lastServed map[string]int
+	// maxAttempts overrides RetryLimit per task type; see SetMaxAttempts
+	maxAttempts map[string]int
+	logger      *slog.Logger
+	// persist, when set, is called with mu held for every change to tasks, dedup, or nextID, so
+	// FileTaskQueue can log the change in the order it was made.
+	persist func(rec walRecord)
 }
 
 func NewInMemoryTaskQueue(retryLimit int, itemExpiration time.Duration, logger *slog.Logger) *InMemoryTaskQueue {
 	return &InMemoryTaskQueue{
 		tasks:          make(map[int]*Task, 3), // should set to the number of workers + 1
+		dedup:          make(map[string]dedupEntry),
 		nextID:         1,
 		RetryLimit:     retryLimit,
 		ItemExpiration: itemExpiration,
+		lastServed:     make(map[string]int),
+		maxAttempts:    make(map[string]int),
 		logger:         logger,
 	}
 }
 
-func (m *InMemoryTaskQueue) AddTask(userID int, taskType string, payload string) (int, error) {
+// dedupEntry is the task a dedup key points at and when the key stops matching (zero for never).
+type dedupEntry struct {
+	taskID    int
+	expiresAt time.Time
+}
+
+func (m *InMemoryTaskQueue) AddTask(ctx context.Context, userID int, taskType string, payload string, opts ...EnqueueOption) (int, error) {
+	cfg := newEnqueueConfig(ctx, opts)
+	id := m.addTask(userID, taskType, payload, cfg)
+	m.notifyEnqueue(cfg.queue, cfg.runAt)
+	return id, nil
+}
+
+// addTask stores the task, or returns the ID of the task holding its dedup key.
+func (m *InMemoryTaskQueue) addTask(userID int, taskType string, payload string, cfg enqueueConfig) int {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	now := time.Now()
+	if cfg.dedupKey != "" {
+		entry, ok := m.dedup[cfg.dedupKey]
+		_, taskExists := m.tasks[entry.taskID]
+		if ok && taskExists && (entry.expiresAt.IsZero() || entry.expiresAt.After(now)) {
+			m.logger.Info("duplicate task", "user_id", userID, "task_type", taskType, "task_id", entry.taskID, "dedup_key", cfg.dedupKey)
+			return entry.taskID
+		}
+	}
+
 	task := &Task{
-		ID:        int(m.nextID),
-		UserID:    userID,
-		Status:    "open",
-		TaskType:  taskType,
-		Payload:   payload,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-	}
-	m.logger.Info("add task", "user_id", userID, "task_type", taskType, "task_id", task.ID)
+		ID:            int(m.nextID),
+		UserID:        userID,
+		Status:        "open",
+		TaskType:      taskType,
+		Payload:       payload,
+		Queue:         cfg.queue,
+		Priority:      cfg.priority,
+		NextAttemptAt: cfg.runAt,
+		TraceParent:   cfg.traceParent,
+		RequestID:     cfg.requestID,
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}
+	log := m.logger.With("user_id", userID, "task_type", taskType, "task_id", task.ID, "queue", task.Queue, "priority", task.Priority)
+	if !cfg.runAt.IsZero() {
+		log = log.With("run_at", cfg.runAt)
+	}
+	log.Info("add task")
 	m.tasks[task.ID] = task
+	m.saved(task)
+	if cfg.dedupKey != "" {
+		entry := dedupEntry{taskID: task.ID, expiresAt: cfg.dedupExpiresAt(now)}
+		m.dedup[cfg.dedupKey] = entry
+		if m.persist != nil {
+			m.persist(walRecord{Dedup: &walDedup{Key: cfg.dedupKey, TaskID: entry.taskID, ExpiresAt: entry.expiresAt}})
+		}
+	}
 	m.nextID++
-	return task.ID, nil
+	return task.ID
+}
+
+// saved passes a copy of the changed task to persist. m.mu must be held.
+func (m *InMemoryTaskQueue) saved(task *Task) {
+	if m.persist != nil {
+		cpy := *task
+		m.persist(walRecord{Task: &cpy})
+	}
+}
+
+// deleted tells persist the task was deleted. m.mu must be held.
+func (m *InMemoryTaskQueue) deleted(taskID int) {
+	if m.persist != nil {
+		m.persist(walRecord{Deleted: taskID})
+	}
+}
+
+// AddTaskTx is AddTask for tests of code that enqueues inside a transaction. The in-memory queue
+// has no transactions to join, so tx is ignored and may be nil; the task is added right away.
+func (m *InMemoryTaskQueue) AddTaskTx(ctx context.Context, tx *sql.Tx, userID int, taskType string, payload string, opts ...EnqueueOption) (int, error) {
+	return m.AddTask(ctx, userID, taskType, payload, opts...)
+}
+
+func (m *InMemoryTaskQueue) FetchOpenTask(ctx context.Context, queue string) (*Task, error) {
+	tasks, err := m.FetchOpenTasks(ctx, queue, 1)
+	if err != nil || len(tasks) == 0 {
+		return nil, err
+	}
+	return tasks[0], nil
+}
+
+func (m *InMemoryTaskQueue) FetchOpenTasks(ctx context.Context, queue string, n int) ([]*Task, error) {
+	return m.FetchOpenTasksExcept(ctx, queue, n, nil)
 }
 
-func (m *InMemoryTaskQueue) FetchOpenTask() (*Task, error) {
+func (m *InMemoryTaskQueue) FetchOpenTasksExcept(ctx context.Context, queue string, n int, skipTypes []string) ([]*Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	var due []*Task
 	for _, task := range m.tasks {
 		m.logger.Debug("ranging task, task pulled")
-		if task.Status == "open" || (task.Status == "checked_out" && time.Since(task.UpdatedAt) > m.ItemExpiration) {
-			m.logger.Debug("check out", "task_id", task.ID, "user_id", task.UserID, "attempt", task.Attempts)
-			task.mu.Lock()
-			task.Status = "checked_out"
-			task.Attempts++
-			task.UpdatedAt = time.Now()
-			task.mu.Unlock()
-			return task, nil
+		if task.Queue != queue || slices.Contains(skipTypes, task.TaskType) {
+			continue
+		}
+		if task.Status == "open" && task.NextAttemptAt.After(time.Now()) {
+			// not due yet: scheduled for later or a failed attempt that is still backing off
+			continue
+		}
+		// an expired checkout on its last attempt is dead, not due; fetching it would run it again
+		if task.Status == "open" || (task.Status == "checked_out" && task.LeaseExpiresAt.Before(time.Now()) && task.Attempts < m.attemptLimit(task.TaskType)) {
+			due = append(due, task)
+		}
+	}
+
+	// same order as the MySQL queue: highest priority, then oldest
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].Priority != due[j].Priority {
+			return due[i].Priority > due[j].Priority
+		}
+		return due[i].ID < due[j].ID
+	})
+	if m.Fairness.enabled() {
+		due = m.fairShare(queue, due, n)
+	} else if len(due) > n {
+		due = due[:n]
+	}
+
+	tasks := make([]*Task, 0, len(due))
+	for _, task := range due {
+		m.logger.Debug("check out", "task_id", task.ID, "user_id", task.UserID, "attempt", task.Attempts)
+		task.Status = "checked_out"
+		task.Attempts++
+		task.LeaseToken = uuid.NewString()
+		task.LeaseExpiresAt = time.Now().Add(m.ItemExpiration)
+		task.UpdatedAt = time.Now()
+		m.saved(task)
+		// hand out a copy so workers never race with the queue mutating its own records
+		cpy := *task
+		tasks = append(tasks, &cpy)
+	}
+	return tasks, nil
+}
+
+// fairShare picks up to n of the sorted due tasks following m.Fairness. m.mu must be held.
+func (m *InMemoryTaskQueue) fairShare(queue string, due []*Task, n int) []*Task {
+	now := time.Now()
+	inFlight := make(map[int]int)
+	for _, task := range m.tasks {
+		if task.Status == "checked_out" && !task.LeaseExpiresAt.Before(now) {
+			inFlight[task.UserID]++
+		}
+	}
+
+	if !m.Fairness.RoundRobin {
+		picked := make([]*Task, 0, n)
+		for _, task := range due {
+			if len(picked) == n {
+				break
+			}
+			if m.Fairness.room(task.UserID, inFlight, 1) > 0 {
+				picked = append(picked, task)
+				inFlight[task.UserID]++
+			}
 		}
+		return picked
+	}
+
+	byUser := make(map[int][]*Task)
+	dueCount := make(map[int]int)
+	for _, task := range due {
+		byUser[task.UserID] = append(byUser[task.UserID], task)
+		dueCount[task.UserID]++
+	}
+	shares, last := m.Fairness.planRoundRobin(dueCount, inFlight, n, m.lastServed[queue])
+	if len(shares) > 0 {
+		m.lastServed[queue] = last
+	}
+	picked := make([]*Task, 0, n)
+	for _, share := range shares {
+		picked = append(picked, byUser[share.userID][:share.count]...)
+	}
+	return picked
+}
+
+func (m *InMemoryTaskQueue) GetTask(ctx context.Context, taskID int) (*Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	task, exists := m.tasks[taskID]
+	if !exists {
+		return nil, kverr.New(ErrTaskNotFound, "task_id", taskID)
+	}
+	cpy := *task
+	return &cpy, nil
+}
+
+func (m *InMemoryTaskQueue) ExtendLease(ctx context.Context, taskID int, leaseToken string, d time.Duration) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	task, exists := m.tasks[taskID]
+	if !exists {
+		return time.Time{}, kverr.New(ErrTaskNotFound, "task_id", taskID)
+	}
+	if task.Status != "checked_out" || task.LeaseToken != leaseToken {
+		return time.Time{}, kverr.New(ErrLeaseLost, "task_id", taskID, "status", task.Status)
 	}
 
-	return nil, nil
+	if d <= 0 {
+		d = m.ItemExpiration
+	}
+	task.LeaseExpiresAt = time.Now().Add(d)
+	m.saved(task)
+	m.logger.Debug("task lease extended", "task_id", task.ID, "lease_expires_at", task.LeaseExpiresAt)
+	return task.LeaseExpiresAt, nil
 }
 
-func (m *InMemoryTaskQueue) MarkTaskComplete(taskID int) error {
+func (m *InMemoryTaskQueue) MarkTaskComplete(ctx context.Context, taskID int, leaseToken string, result string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	task, exists := m.tasks[taskID]
 	if !exists {
-		return kverr.New(fmt.Errorf("task not found"), "task_id", task.ID)
+		return kverr.New(ErrTaskNotFound, "task_id", taskID)
+	}
+	if err := checkLease(task, leaseToken); err != nil {
+		return err
 	}
-	task.mu.Lock()
-	defer task.mu.Unlock()
 
 	m.logger.Info("task complete", "task_id", task.ID, "user_id", task.UserID, "attempt", task.Attempts, "task_type", task.TaskType)
 	task.Status = "complete"
+	task.Result = result
+	task.releaseLease()
+	task.UpdatedAt = time.Now()
+	m.saved(task)
 	return nil
 }
 
-func (m *InMemoryTaskQueue) CancelWhere(postWhereStatement string, args ...any) (int, error) {
-	// to be implemented?
-	return 0, nil
+func (m *InMemoryTaskQueue) MarkTaskDead(ctx context.Context, taskID int, leaseToken string, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	task, exists := m.tasks[taskID]
+	if !exists {
+		return kverr.New(ErrTaskNotFound, "task_id", taskID)
+	}
+	if err := checkLease(task, leaseToken); err != nil {
+		return err
+	}
+
+	m.logger.Error("dead task", "task_id", task.ID, "user_id", task.UserID, "attempt", task.Attempts, "task_type", task.TaskType, "reason", reason)
+	task.Status = "dead"
+	task.LastError = reason
+	task.releaseLease()
+	task.UpdatedAt = time.Now()
+	m.saved(task)
+	return nil
 }
 
-func (m *InMemoryTaskQueue) CheckAndMarkDeadTasks() error {
+func (m *InMemoryTaskQueue) FailTask(ctx context.Context, taskID int, leaseToken string, errMsg string, nextAttemptAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	task, exists := m.tasks[taskID]
+	if !exists {
+		return kverr.New(ErrTaskNotFound, "task_id", taskID)
+	}
+	if err := checkLease(task, leaseToken); err != nil {
+		return err
+	}
+
+	m.logger.Info("task attempt failed", "task_id", task.ID, "user_id", task.UserID, "attempt", task.Attempts, "task_type", task.TaskType, "next_attempt_at", nextAttemptAt)
+	task.Status = "open"
+	task.LastError = errMsg
+	task.NextAttemptAt = nextAttemptAt
+	task.releaseLease()
+	task.UpdatedAt = time.Now()
+	m.saved(task)
+	return nil
+}
+
+// ReleaseTask implements Releaser.
+func (m *InMemoryTaskQueue) ReleaseTask(ctx context.Context, taskID int, leaseToken string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	task, exists := m.tasks[taskID]
+	if !exists {
+		return kverr.New(ErrTaskNotFound, "task_id", taskID)
+	}
+	if err := checkLease(task, leaseToken); err != nil {
+		return err
+	}
+
+	m.logger.Info("task released", "task_id", task.ID, "user_id", task.UserID, "attempt", task.Attempts, "task_type", task.TaskType)
+	task.Status = "open"
+	task.Attempts = max(task.Attempts-1, 0)
+	task.NextAttemptAt = time.Time{}
+	task.releaseLease()
+	task.UpdatedAt = time.Now()
+	m.saved(task)
+	return nil
+}
+
+func (m *InMemoryTaskQueue) CancelTasks(ctx context.Context, filter TaskFilter) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var tasks []*Task
+	for _, task := range m.tasks {
+		if slices.Contains(cancellableStatuses, task.Status) && filter.matches(task) {
+			tasks = append(tasks, task)
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+	if filter.Limit > 0 && len(tasks) > filter.Limit {
+		tasks = tasks[:filter.Limit]
+	}
+
+	ids := make([]int, 0, len(tasks))
+	for _, task := range tasks {
+		m.logger.Info("cancel task", "task_id", task.ID, "user_id", task.UserID, "attempt", task.Attempts, "task_type", task.TaskType, "status", task.Status)
+		task.Status = "cancelled"
+		task.releaseLease()
+		task.UpdatedAt = time.Now()
+		m.saved(task)
+		ids = append(ids, task.ID)
+	}
+	return ids, nil
+}
+
+// SetMaxAttempts implements AttemptLimiter.
+func (m *InMemoryTaskQueue) SetMaxAttempts(taskType string, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxAttempts[taskType] = n
+}
+
+// attemptLimit returns how many attempts tasks of the type get. m.mu must be held.
+func (m *InMemoryTaskQueue) attemptLimit(taskType string) int {
+	if limit, ok := m.maxAttempts[taskType]; ok {
+		return limit
+	}
+	return m.RetryLimit
+}
+
+func (m *InMemoryTaskQueue) CheckAndMarkDeadTasks(ctx context.Context) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	m.logger.Debug("ranging tasks to find expired items")
 	for _, task := range m.tasks {
-		task.mu.Lock()
-		if task.Status == "checked_out" && task.Attempts >= m.RetryLimit {
+		// only tasks whose checkout expired are dead; a final attempt may still be running
+		if task.Status == "checked_out" && task.Attempts >= m.attemptLimit(task.TaskType) && task.LeaseExpiresAt.Before(time.Now()) {
 			task.Status = "dead"
+			task.releaseLease()
+			task.LastError = "checkout expired after retry limit"
+			task.UpdatedAt = time.Now()
+			m.saved(task)
 			m.logger.Error("dead task", "task_id", task.ID, "user_id", task.UserID, "attempt", task.Attempts, "task_type", task.TaskType)
 		}
-		task.mu.Unlock()
 	}
 	return nil
 }
 
+func (m *InMemoryTaskQueue) CountTasks(ctx context.Context) ([]TaskCount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	index := make(map[TaskCount]int)
+	var counts []TaskCount
+	for _, task := range m.tasks {
+		key := TaskCount{Status: task.Status, TaskType: task.TaskType}
+		i, ok := index[key]
+		if !ok {
+			i = len(counts)
+			index[key] = i
+			counts = append(counts, key)
+		}
+		counts[i].Count++
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Status != counts[j].Status {
+			return counts[i].Status < counts[j].Status
+		}
+		return counts[i].TaskType < counts[j].TaskType
+	})
+	return counts, nil
+}
+
+func (m *InMemoryTaskQueue) ListDeadTasks(ctx context.Context, filter TaskFilter) ([]Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var tasks []Task
+	for _, task := range m.deadTasks(filter) {
+		tasks = append(tasks, *task)
+	}
+	return tasks, nil
+}
+
+func (m *InMemoryTaskQueue) RequeueDeadTasks(ctx context.Context, filter TaskFilter) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tasks := m.deadTasks(filter)
+	for _, task := range tasks {
+		m.logger.Info("requeue dead task", "task_id", task.ID, "user_id", task.UserID, "attempt", task.Attempts, "task_type", task.TaskType)
+		task.Status = "open"
+		task.Attempts = 0
+		task.NextAttemptAt = time.Time{}
+		task.UpdatedAt = time.Now()
+		m.saved(task)
+	}
+	return len(tasks), nil
+}
+
+func (m *InMemoryTaskQueue) PurgeDeadTasks(ctx context.Context, filter TaskFilter) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tasks := m.deadTasks(filter)
+	for _, task := range tasks {
+		m.logger.Info("purge dead task", "task_id", task.ID, "user_id", task.UserID, "attempt", task.Attempts, "task_type", task.TaskType)
+		delete(m.tasks, task.ID)
+		m.deleted(task.ID)
+	}
+	return len(tasks), nil
+}
+
+// SweepTasks deletes tasks oldest first. The in-memory queue has no archive.
+func (m *InMemoryTaskQueue) SweepTasks(ctx context.Context, status string, finishedBefore time.Time, limit int) (int, error) {
+	if err := checkSweepStatus(status); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var swept []*Task
+	for _, task := range m.tasks {
+		if task.Status == status && task.UpdatedAt.Before(finishedBefore) {
+			swept = append(swept, task)
+		}
+	}
+	sort.Slice(swept, func(i, j int) bool { return swept[i].ID < swept[j].ID })
+	if limit > 0 && len(swept) > limit {
+		swept = swept[:limit]
+	}
+
+	for _, task := range swept {
+		delete(m.tasks, task.ID)
+		m.deleted(task.ID)
+	}
+	// dedup keys of swept tasks no longer match anything
+	for key, entry := range m.dedup {
+		if _, ok := m.tasks[entry.taskID]; !ok {
+			delete(m.dedup, key)
+		}
+	}
+	return len(swept), nil
+}
+
+// deadTasks returns the dead tasks matching the filter ordered by ID. Callers must hold m.mu.
+func (m *InMemoryTaskQueue) deadTasks(filter TaskFilter) []*Task {
+	var tasks []*Task
+	for _, task := range m.tasks {
+		if task.Status == "dead" && filter.matches(task) {
+			tasks = append(tasks, task)
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+
+	if filter.Limit > 0 && len(tasks) > filter.Limit {
+		tasks = tasks[:filter.Limit]
+	}
+	return tasks
+}
+
 func (m *InMemoryTaskQueue) Close() error {
 	m.mu.Lock()
 
 	for k := range m.tasks {
 		delete(m.tasks, k)
 	}
+	for k := range m.dedup {
+		delete(m.dedup, k)
+	}
 
 	m.mu.Unlock()
 	return nil
@@ -3,6 +3,10 @@ package taskqueue
 import (
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/sethgrid/helloworld/metrics"
 )
 
@@ -13,8 +17,85 @@ func timeDBOperation(operation string, fn func() error) error {
 	start := time.Now()
 	err := fn()
 	duration := time.Since(start)
-	
+
 	metrics.DBQueryDuration.WithLabelValues(storeLabel, operation).Observe(duration.Seconds())
-	
+
+	return err
+}
+
+// timeQueueOperation times an operation scoped to a single queue. It is recorded like
+// timeDBOperation and additionally labeled by queue, so a slow or backed up queue stands out.
+func timeQueueOperation(queue string, operation string, fn func() error) error {
+	start := time.Now()
+	err := timeDBOperation(operation, fn)
+	metrics.TaskQueueOperationDuration.WithLabelValues(queue, operation).Observe(time.Since(start).Seconds())
 	return err
 }
+
+// Outcomes of a single attempt, recorded by the Runner on the attempt's span and in metrics.TaskOutcomes.
+const (
+	outcomeComplete  = "complete"
+	outcomeRetry     = "retry"
+	outcomeDead      = "dead"
+	outcomeCancelled = "cancelled"
+	outcomeLeaseLost = "lease_lost"
+	// outcomeReleased attempts were interrupted by Runner.Close and don't count as attempts
+	outcomeReleased = "released"
+)
+
+// recordOutcome records how an attempt ended on its span and in the task metrics. err is the
+// handler's error, if any.
+func recordOutcome(span trace.Span, task Task, outcome string, err error) {
+	span.SetAttributes(attribute.String("task.outcome", outcome))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	metrics.TaskOutcomes.WithLabelValues(task.Queue, task.TaskType, outcome).Inc()
+	if outcome == outcomeComplete || outcome == outcomeDead {
+		metrics.TaskAttempts.WithLabelValues(task.TaskType, outcome).Observe(float64(task.Attempts))
+	}
+}
+
+// observeStartDelay records how long a task waited for its first attempt, measured from when it could
+// first run: its enqueue time, or its run-at time if it was delayed. Retries are not counted, since
+// their wait is set by the backoff policy.
+func observeStartDelay(task Task) {
+	if task.Attempts != 1 {
+		return
+	}
+	runnableAt := task.CreatedAt
+	if task.NextAttemptAt.After(runnableAt) {
+		runnableAt = task.NextAttemptAt
+	}
+	metrics.TaskStartDelay.WithLabelValues(task.Queue, task.TaskType).Observe(max(time.Since(runnableAt), 0).Seconds())
+}
+
+func observeHandlerDuration(task Task, d time.Duration) {
+	metrics.TaskHandlerDuration.WithLabelValues(task.Queue, task.TaskType).Observe(d.Seconds())
+}
+
+// reportTaskCounts sets the task count gauge from the task store. Pairs that no longer have any
+// tasks are set to zero rather than left at their last count.
+func (tq *Runner) reportTaskCounts() {
+	counts, err := tq.TaskStore.CountTasks(tq.ctx)
+	if err != nil {
+		if tq.ctx.Err() == nil {
+			tq.logger.Error("unable to count tasks", "error", err.Error())
+		}
+		return
+	}
+
+	seen := make(map[TaskCount]bool, len(counts))
+	for _, count := range counts {
+		metrics.TaskCount.WithLabelValues(count.Status, count.TaskType).Set(float64(count.Count))
+		seen[TaskCount{Status: count.Status, TaskType: count.TaskType}] = true
+	}
+	for key := range tq.reported {
+		if !seen[key] {
+			metrics.TaskCount.WithLabelValues(key.Status, key.TaskType).Set(0)
+		}
+	}
+	tq.reported = seen
+}
@@ -1,20 +1,69 @@
 package taskqueue
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log/slog"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/sethgrid/helloworld/internal/db"
 	"github.com/sethgrid/kverr"
 )
 
 type MySQLTaskQueue struct {
+	enqueueListeners
+
 	Logger          *slog.Logger
 	DBManager       *db.Manager
 	RetryLimit      int
 	ReCheckoutAfter time.Duration
+	// Archive copies tasks into tasks_archive before SweepTasks deletes them.
+	Archive bool
+	// Fairness controls how FetchOpenTasks shares workers between users.
+	Fairness Fairness
+
+	// lastServed is the user served last on each queue by this process, where round-robin
+	// fetches continue from
+	lastServedMu sync.Mutex
+	lastServed   map[string]int
+
+	// maxAttempts overrides RetryLimit per task type; see SetMaxAttempts
+	maxAttemptsMu sync.Mutex
+	maxAttempts   map[string]int
+}
+
+// dueTasks matches the tasks FetchOpenTasks can check out: open tasks that are due (not scheduled
+// for later or backing off), and checked_out tasks whose lease expired. It takes the current time twice.
+// FetchOpenTasksExcept further leaves out expired checkouts with no attempts left, which
+// CheckAndMarkDeadTasks marks dead.
+const dueTasks = "((status = 'open' AND (next_attempt_at IS NULL OR next_attempt_at <= ?)) OR (status = 'checked_out' AND lease_expires_at < ?))"
+
+// taskColumns are the columns scanTask expects, in order.
+const taskColumns = "id, user_id, status, task_type, payload, queue, priority, attempts, next_attempt_at, last_error, result, lease_token, lease_expires_at, trace_parent, request_id, created_at, updated_at"
+
+// scanTask reads a row selected with taskColumns.
+func scanTask(row interface{ Scan(dest ...any) error }) (*Task, error) {
+	var task Task
+	var nextAttemptAt sql.NullTime
+	var lastError, result, leaseToken, traceParent, requestID sql.NullString
+	var leaseExpiresAt sql.NullTime
+	err := row.Scan(&task.ID, &task.UserID, &task.Status, &task.TaskType, &task.Payload, &task.Queue, &task.Priority, &task.Attempts, &nextAttemptAt, &lastError, &result, &leaseToken, &leaseExpiresAt, &traceParent, &requestID, &task.CreatedAt, &task.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	task.NextAttemptAt = nextAttemptAt.Time
+	task.LastError = lastError.String
+	task.Result = result.String
+	task.LeaseToken = leaseToken.String
+	task.LeaseExpiresAt = leaseExpiresAt.Time
+	task.TraceParent = traceParent.String
+	task.RequestID = requestID.String
+	return &task, nil
 }
 
 func NewMySQLTaskQueue(dbManager *db.Manager, logger *slog.Logger, retryLimit int, itemExpiration time.Duration) *MySQLTaskQueue {
@@ -26,17 +75,159 @@ func NewMySQLTaskQueue(dbManager *db.Manager, logger *slog.Logger, retryLimit in
 	}
 }
 
-func (m *MySQLTaskQueue) AddTask(userID int, taskType string, payload string) (int, error) {
-	var result sql.Result
+func (m *MySQLTaskQueue) AddTask(ctx context.Context, userID int, taskType string, payload string, opts ...EnqueueOption) (int, error) {
+	var id int
 	var err error
 
-	err = timeDBOperation("add_task", func() error {
-		result, err = m.DBManager.Writer.Exec(`
-			INSERT INTO tasks (user_id, task_type, payload, status, created_at, updated_at)
-			VALUES (?, ?, ?, 'open', NOW(), NOW())
-		`, userID, taskType, payload)
+	cfg := newEnqueueConfig(ctx, opts)
+
+	err = timeQueueOperation(cfg.queue, "add_task", func() error {
+		if cfg.dedupKey == "" {
+			id, err = insertTask(ctx, m.DBManager.Writer, userID, taskType, payload, cfg)
+			return err
+		}
+
+		id, err = m.addDedupTask(ctx, userID, taskType, payload, cfg)
+		return err
+	})
+	if err != nil {
+		return 0, kverr.New(err, "user_id", userID, "task_type", taskType)
+	}
+	m.notifyEnqueue(cfg.queue, cfg.runAt)
+	return id, nil
+}
+
+// AddTaskTx inserts the task with the caller's transaction, which must come from the same database
+// as the task store's writer. Nothing is visible to workers until the caller commits, and a rollback
+// drops the task along with the rest of the caller's writes. Since the commit happens later, no
+// Runner is woken; the task is found by the next poll.
+//
+// With a dedup key, the task's row stays locked until the caller's transaction ends, so a
+// concurrent enqueue with the same key waits for it and then returns the committed task. Like any
+// locking statement, it can fail with a deadlock or lock wait timeout, and MySQL rolls back the
+// caller's whole transaction on a deadlock; the caller should retry the transaction.
+func (m *MySQLTaskQueue) AddTaskTx(ctx context.Context, tx *sql.Tx, userID int, taskType string, payload string, opts ...EnqueueOption) (int, error) {
+	var id int
+	var err error
+
+	cfg := newEnqueueConfig(ctx, opts)
+
+	err = timeQueueOperation(cfg.queue, "add_task_tx", func() error {
+		if cfg.dedupKey == "" {
+			id, err = insertTask(ctx, tx, userID, taskType, payload, cfg)
+			return err
+		}
+
+		id, err = m.insertDedupTask(ctx, tx, userID, taskType, payload, cfg)
 		return err
 	})
+	if err != nil {
+		return 0, kverr.New(err, "user_id", userID, "task_type", taskType)
+	}
+	return id, nil
+}
+
+// addDedupTask runs insertDedupTask in its own transaction.
+func (m *MySQLTaskQueue) addDedupTask(ctx context.Context, userID int, taskType string, payload string, cfg enqueueConfig) (int, error) {
+	tx, err := m.DBManager.Writer.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	id, err := m.insertDedupTask(ctx, tx, userID, taskType, payload, cfg)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return id, nil
+}
+
+// insertDedupTask returns the task still holding the dedup key, or inserts a new task that takes the key over.
+// The insert and the lookup are one upsert on the unique dedup_key index, so a missing key is never
+// locked on its own: a locking read of a missing key takes a gap lock, and two callers holding the
+// gap and then inserting into it deadlock.
+func (m *MySQLTaskQueue) insertDedupTask(ctx context.Context, tx *sql.Tx, userID int, taskType string, payload string, cfg enqueueConfig) (int, error) {
+	id, inserted, err := upsertTask(ctx, tx, userID, taskType, payload, cfg)
+	if err != nil {
+		return 0, err
+	}
+	if inserted {
+		return id, nil
+	}
+
+	// the upsert locked the key's row, so it can't expire or be released under us
+	now := time.Now()
+	result, err := tx.ExecContext(ctx, `
+		UPDATE tasks SET dedup_key = NULL, dedup_expires_at = NULL
+		WHERE id = ? AND dedup_expires_at IS NOT NULL AND dedup_expires_at <= ?
+	`, id, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to release dedup key: %w", err)
+	}
+	released, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to release dedup key: %w", err)
+	}
+	if released == 0 {
+		m.Logger.Info("duplicate task", "user_id", userID, "task_type", taskType, "task_id", id, "dedup_key", cfg.dedupKey)
+		return id, nil
+	}
+
+	// the window passed and the key is released, so the new task can take it
+	return insertTask(ctx, tx, userID, taskType, payload, cfg)
+}
+
+// upsertTask inserts the task unless its dedup key is taken, in which case it returns the ID of
+// the task holding the key. LAST_INSERT_ID(id) makes the driver report that task's ID.
+func upsertTask(ctx context.Context, tx *sql.Tx, userID int, taskType string, payload string, cfg enqueueConfig) (int, bool, error) {
+	now := time.Now()
+	runAt := sql.NullTime{Time: cfg.runAt, Valid: !cfg.runAt.IsZero()}
+	dedupExpiresAt := cfg.dedupExpiresAt(now)
+	dedupExpires := sql.NullTime{Time: dedupExpiresAt, Valid: !dedupExpiresAt.IsZero()}
+	traceParent := sql.NullString{String: cfg.traceParent, Valid: cfg.traceParent != ""}
+	requestID := sql.NullString{String: cfg.requestID, Valid: cfg.requestID != ""}
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO tasks (user_id, task_type, payload, queue, priority, status, next_attempt_at, dedup_key, dedup_expires_at, trace_parent, request_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, 'open', ?, ?, ?, ?, ?, NOW(), NOW())
+		ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)
+	`, userID, taskType, payload, cfg.queue, cfg.priority, runAt, cfg.dedupKey, dedupExpires, traceParent, requestID)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to insert task: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, false, err
+	}
+	// one row affected is an insert; an existing row left as it was is zero, as long as the DSN
+	// doesn't set clientFoundRows
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, false, err
+	}
+	return int(id), affected == 1, nil
+}
+
+// insertTask adds a task row using either the writer or a transaction.
+func insertTask(ctx context.Context, exec interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}, userID int, taskType string, payload string, cfg enqueueConfig) (int, error) {
+	now := time.Now()
+	runAt := sql.NullTime{Time: cfg.runAt, Valid: !cfg.runAt.IsZero()}
+	dedupKey := sql.NullString{String: cfg.dedupKey, Valid: cfg.dedupKey != ""}
+	dedupExpiresAt := cfg.dedupExpiresAt(now)
+	dedupExpires := sql.NullTime{Time: dedupExpiresAt, Valid: dedupKey.Valid && !dedupExpiresAt.IsZero()}
+	traceParent := sql.NullString{String: cfg.traceParent, Valid: cfg.traceParent != ""}
+	requestID := sql.NullString{String: cfg.requestID, Valid: cfg.requestID != ""}
+
+	result, err := exec.ExecContext(ctx, `
+		INSERT INTO tasks (user_id, task_type, payload, queue, priority, status, next_attempt_at, dedup_key, dedup_expires_at, trace_parent, request_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, 'open', ?, ?, ?, ?, ?, NOW(), NOW())
+	`, userID, taskType, payload, cfg.queue, cfg.priority, runAt, dedupKey, dedupExpires, traceParent, requestID)
 	if err != nil {
 		return 0, err
 	}
@@ -46,48 +237,69 @@ func (m *MySQLTaskQueue) AddTask(userID int, taskType string, payload string) (i
 	return int(r), err
 }
 
-func (m *MySQLTaskQueue) FetchOpenTask() (*Task, error) {
-	var task *Task
+func (m *MySQLTaskQueue) FetchOpenTask(ctx context.Context, queue string) (*Task, error) {
+	tasks, err := m.FetchOpenTasks(ctx, queue, 1)
+	if err != nil || len(tasks) == 0 {
+		return nil, err
+	}
+	return tasks[0], nil
+}
+
+// FetchOpenTasks checks out a batch in one transaction. SKIP LOCKED (MySQL 8+) lets replicas
+// polling at the same time each lock a different set of rows instead of queueing up behind the
+// same one.
+func (m *MySQLTaskQueue) FetchOpenTasks(ctx context.Context, queue string, n int) ([]*Task, error) {
+	return m.FetchOpenTasksExcept(ctx, queue, n, nil)
+}
+
+func (m *MySQLTaskQueue) FetchOpenTasksExcept(ctx context.Context, queue string, n int, skipTypes []string) ([]*Task, error) {
+	var tasks []*Task
 	var err error
 
-	err = timeDBOperation("fetch_open_task", func() error {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	err = timeQueueOperation(queue, "fetch_open_tasks", func() error {
 		// Begin a transaction on writer (we're updating task status)
-		tx, err := m.DBManager.Writer.Begin()
+		tx, err := m.DBManager.Writer.BeginTx(ctx, nil)
 		if err != nil {
 			return fmt.Errorf("failed to start transaction: %w", err)
 		}
 		defer tx.Rollback() // Ensure rollback in case of failure
 
-		// Find an open task or an expired checked_out task
-		expirationTime := time.Now().Add(-m.ReCheckoutAfter)
-		task = &Task{}
-
-		// Select a task in the transaction
-		row := tx.QueryRow(`
-			SELECT id, user_id, status, task_type, payload, created_at, updated_at, attempts 
-			FROM tasks 
-			WHERE (status = 'open' OR (status = 'checked_out' AND updated_at < ?))
-			ORDER BY created_at ASC 
-			LIMIT 1 FOR UPDATE
-		`, expirationTime)
-
-		err = row.Scan(&task.ID, &task.UserID, &task.Status, &task.TaskType, &task.Payload, &task.CreatedAt, &task.UpdatedAt, &task.Attempts)
+		now := time.Now()
+		skip, skipArgs := skipTypesWhere(skipTypes)
+		// an expired checkout on its last attempt is dead, not due; fetching it would run it again
+		limit, limitArgs := m.attemptLimit()
+		where := skip + " AND (status = 'open' OR attempts < " + limit + ")"
+		whereArgs := slices.Concat(skipArgs, limitArgs)
+		if m.Fairness.enabled() {
+			tasks, err = m.selectFairTasks(ctx, tx, queue, where, whereArgs, n, now)
+		} else {
+			tasks, err = selectDueTasks(ctx, tx, queue, where, whereArgs, n, now)
+		}
 		if err != nil {
-			if err == sql.ErrNoRows {
-				task = nil // No tasks available
-				return nil
-			}
-			return fmt.Errorf("failed to fetch task: %w", err)
+			return err
+		}
+		if len(tasks) == 0 {
+			return nil
 		}
 
-		// Update task status and attempts in the same transaction
-		_, err = tx.Exec(`
-			UPDATE tasks 
-			SET status = 'checked_out', updated_at = NOW(), attempts = attempts + 1
-			WHERE id = ?
-		`, task.ID)
-		if err != nil {
-			return fmt.Errorf("failed to update task status: %w", err)
+		// Update task status, attempts, and lease in the same transaction. Each task gets its own
+		// lease token so a stale worker can only ever report on the checkout it was handed.
+		leaseExpiresAt := now.Add(m.ReCheckoutAfter)
+		for _, task := range tasks {
+			task.LeaseToken = uuid.NewString()
+			task.LeaseExpiresAt = leaseExpiresAt
+			_, err = tx.ExecContext(ctx, `
+				UPDATE tasks 
+				SET status = 'checked_out', updated_at = NOW(), attempts = attempts + 1, lease_token = ?, lease_expires_at = ?
+				WHERE id = ?
+			`, task.LeaseToken, task.LeaseExpiresAt, task.ID)
+			if err != nil {
+				return fmt.Errorf("failed to update task status: %w", err)
+			}
 		}
 
 		// Commit the transaction
@@ -96,43 +308,292 @@ func (m *MySQLTaskQueue) FetchOpenTask() (*Task, error) {
 			return fmt.Errorf("failed to commit transaction: %w", err)
 		}
 
-		// Return the task that was checked out
-		task.Attempts++ // Reflect the incremented attempts
-		task.Status = "checked_out"
+		// Return the tasks that were checked out
+		for _, task := range tasks {
+			task.Attempts++ // Reflect the incremented attempts
+			task.Status = "checked_out"
+		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return task, err
+	return tasks, nil
 }
 
-func (m *MySQLTaskQueue) CancelWhere(postWhereStatement string, args ...any) (int, error) {
-	var res sql.Result
-	var err error
+// selectDueTasks locks up to n due tasks on the queue in priority order, skipping rows another
+// poller has locked. where further filters the tasks, with args as its placeholders.
+func selectDueTasks(ctx context.Context, tx *sql.Tx, queue string, where string, args []any, n int, now time.Time) ([]*Task, error) {
+	queryArgs := append([]any{queue, now, now}, args...)
+	queryArgs = append(queryArgs, n)
+	rows, err := tx.QueryContext(ctx, `
+		SELECT `+taskColumns+`
+		FROM tasks 
+		WHERE queue = ? AND `+dueTasks+where+`
+		ORDER BY priority DESC, created_at ASC, id ASC
+		LIMIT ? FOR UPDATE SKIP LOCKED
+	`, queryArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch tasks: %w", err)
+	}
+	defer rows.Close()
 
-	err = timeDBOperation("cancel_where", func() error {
-		res, err = m.DBManager.Writer.Exec("delete from tasks where "+postWhereStatement, args...)
+	var tasks []*Task
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan task: %w", err)
+		}
+		tasks = append(tasks, task)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to fetch tasks: %w", err)
+	}
+	return tasks, nil
+}
+
+// skipTypesWhere returns a selectDueTasks filter leaving out tasks of the given types.
+func skipTypesWhere(skipTypes []string) (string, []any) {
+	if len(skipTypes) == 0 {
+		return "", nil
+	}
+	args := make([]any, 0, len(skipTypes))
+	for _, taskType := range skipTypes {
+		args = append(args, taskType)
+	}
+	return " AND task_type NOT IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(skipTypes)), ", ") + ")", args
+}
+
+// selectFairTasks locks up to n due tasks on the queue following m.Fairness, filtered by where
+// and args as in selectDueTasks. The per-user counts it plans from are read without locks; the
+// tasks themselves are locked as in selectDueTasks.
+func (m *MySQLTaskQueue) selectFairTasks(ctx context.Context, tx *sql.Tx, queue string, where string, args []any, n int, now time.Time) ([]*Task, error) {
+	inFlight := make(map[int]int)
+	if m.Fairness.MaxPerUser > 0 {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT user_id, COUNT(*) FROM tasks
+			WHERE status = 'checked_out' AND lease_expires_at >= ?
+			GROUP BY user_id
+		`, now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count in-flight tasks: %w", err)
+		}
+		if err := scanUserCounts(rows, inFlight); err != nil {
+			return nil, fmt.Errorf("failed to count in-flight tasks: %w", err)
+		}
+	}
+
+	if !m.Fairness.RoundRobin {
+		// skip users at their cap, then trim users the batch would take past it
+		var capped string
+		var cappedArgs []any
+		for userID := range inFlight {
+			if m.Fairness.room(userID, inFlight, 1) == 0 {
+				capped += "?, "
+				cappedArgs = append(cappedArgs, userID)
+			}
+		}
+		if capped != "" {
+			capped = " AND user_id NOT IN (" + strings.TrimSuffix(capped, ", ") + ")"
+		}
+		tasks, err := selectDueTasks(ctx, tx, queue, where+capped, slices.Concat(args, cappedArgs), n, now)
+		if err != nil {
+			return nil, err
+		}
+		// rows left out stay untouched and are unlocked when the transaction ends
+		return slices.DeleteFunc(tasks, func(task *Task) bool {
+			if m.Fairness.room(task.UserID, inFlight, 1) == 0 {
+				return true
+			}
+			inFlight[task.UserID]++
+			return false
+		}), nil
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT user_id, COUNT(*) FROM tasks
+		WHERE queue = ? AND `+dueTasks+where+`
+		GROUP BY user_id
+	`, slices.Concat([]any{queue, now, now}, args)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count due tasks: %w", err)
+	}
+	due := make(map[int]int)
+	if err := scanUserCounts(rows, due); err != nil {
+		return nil, fmt.Errorf("failed to count due tasks: %w", err)
+	}
+
+	m.lastServedMu.Lock()
+	shares, last := m.Fairness.planRoundRobin(due, inFlight, n, m.lastServed[queue])
+	if len(shares) > 0 {
+		if m.lastServed == nil {
+			m.lastServed = make(map[string]int)
+		}
+		m.lastServed[queue] = last
+	}
+	m.lastServedMu.Unlock()
+
+	var tasks []*Task
+	for _, share := range shares {
+		userTasks, err := selectDueTasks(ctx, tx, queue, where+" AND user_id = ?", slices.Concat(args, []any{share.userID}), share.count, now)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, userTasks...)
+	}
+	return tasks, nil
+}
+
+// scanUserCounts reads user_id, count rows into counts and closes rows.
+func scanUserCounts(rows *sql.Rows, counts map[int]int) error {
+	defer rows.Close()
+	for rows.Next() {
+		var userID, count int
+		if err := rows.Scan(&userID, &count); err != nil {
+			return err
+		}
+		counts[userID] = count
+	}
+	return rows.Err()
+}
+
+func (m *MySQLTaskQueue) CancelTasks(ctx context.Context, filter TaskFilter) ([]int, error) {
+	var ids []int
+
+	err := timeDBOperation("cancel_tasks", func() error {
+		tx, err := m.DBManager.Writer.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to start transaction: %w", err)
+		}
+		defer tx.Rollback()
+
+		// lock the matching rows first so the IDs returned are exactly the ones cancelled
+		where, args := filter.where()
+		query := "SELECT id FROM tasks WHERE status IN ('open', 'checked_out')" + where + " ORDER BY id ASC"
+		if filter.Limit > 0 {
+			query += " LIMIT ?"
+			args = append(args, filter.Limit)
+		}
+		rows, err := tx.QueryContext(ctx, query+" FOR UPDATE", args...)
+		if err != nil {
+			return fmt.Errorf("unable to select tasks to cancel: %w", err)
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return fmt.Errorf("unable to scan task to cancel: %w", err)
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("unable to select tasks to cancel: %w", err)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		idArgs := make([]any, 0, len(ids))
+		for _, id := range ids {
+			idArgs = append(idArgs, id)
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE tasks
+			SET status = 'cancelled', lease_token = NULL, lease_expires_at = NULL, updated_at = NOW()
+			WHERE id IN (`+strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")+`)
+		`, idArgs...)
 		if err != nil {
 			return fmt.Errorf("unable to cancel tasks: %w", err)
 		}
+
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m.Logger.Info("tasks cancelled", "count", len(ids), "task_ids", ids)
+	return ids, nil
+}
+
+func (m *MySQLTaskQueue) GetTask(ctx context.Context, taskID int) (*Task, error) {
+	var task *Task
+	var err error
+
+	err = timeDBOperation("get_task", func() error {
+		row := m.DBManager.Reader.QueryRowContext(ctx, "SELECT "+taskColumns+" FROM tasks WHERE id = ?", taskID)
+		task, err = scanTask(row)
+		if err == sql.ErrNoRows {
+			return ErrTaskNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return nil, kverr.New(err, "task_id", taskID)
+	}
+	return task, nil
+}
+
+func (m *MySQLTaskQueue) ExtendLease(ctx context.Context, taskID int, leaseToken string, d time.Duration) (time.Time, error) {
+	if d <= 0 {
+		d = m.ReCheckoutAfter
+	}
+	leaseExpiresAt := time.Now().Add(d)
+
+	err := timeDBOperation("extend_lease", func() error {
+		res, err := m.DBManager.Writer.ExecContext(ctx, `
+			UPDATE tasks
+			SET lease_expires_at = ?
+			WHERE id = ? AND status = 'checked_out' AND lease_token = ?
+		`, leaseExpiresAt, taskID, leaseToken)
+		if err != nil {
+			return err
+		}
+		count, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return m.leaseError(ctx, taskID)
+		}
 		return nil
 	})
 	if err != nil {
-		return 0, err
+		return time.Time{}, kverr.New(err, "task_id", taskID)
 	}
+	return leaseExpiresAt, nil
+}
 
-	count, err := res.RowsAffected()
+// leaseError explains why an update guarded by a lease token matched no rows.
+func (m *MySQLTaskQueue) leaseError(ctx context.Context, taskID int) error {
+	var status string
+	err := m.DBManager.Writer.QueryRowContext(ctx, "SELECT status FROM tasks WHERE id = ?", taskID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return ErrTaskNotFound
+	}
 	if err != nil {
-		return 0, fmt.Errorf("unable to get row count when cancelling tasks")
+		return err
 	}
+	return kverr.New(ErrLeaseLost, "status", status)
+}
 
-	// shouldn't be an issue on 64bit machines
-	return int(count), nil
+// checkLeaseRow validates a lease token against a task row selected FOR UPDATE.
+func checkLeaseRow(status string, currentToken sql.NullString, leaseToken string) error {
+	if leaseToken == "" {
+		return nil
+	}
+	if status != "checked_out" || currentToken.String != leaseToken {
+		return kverr.New(ErrLeaseLost, "status", status)
+	}
+	return nil
 }
 
-func (m *MySQLTaskQueue) MarkTaskComplete(taskID int) error {
+func (m *MySQLTaskQueue) MarkTaskComplete(ctx context.Context, taskID int, leaseToken string, result string) error {
 	return timeDBOperation("mark_task_complete", func() error {
 		// Start a transaction on writer
-		tx, err := m.DBManager.Writer.Begin()
+		tx, err := m.DBManager.Writer.BeginTx(ctx, nil)
 		if err != nil {
 			return err
 		}
@@ -147,25 +608,81 @@ func (m *MySQLTaskQueue) MarkTaskComplete(taskID int) error {
 
 		// Step 1: Retrieve the task details before marking it complete
 		var task Task // Assuming Task is a struct with the necessary fields
-		err = tx.QueryRow(`
-			SELECT id, user_id, status, task_type, attempts
+		var currentToken sql.NullString
+		err = tx.QueryRowContext(ctx, `
+			SELECT id, user_id, status, task_type, attempts, lease_token
 			FROM tasks
 			WHERE id = ?
 			FOR UPDATE
-		`, taskID).Scan(&task.ID, &task.UserID, &task.Status, &task.TaskType, &task.Attempts)
+		`, taskID).Scan(&task.ID, &task.UserID, &task.Status, &task.TaskType, &task.Attempts, &currentToken)
+		if err == sql.ErrNoRows {
+			err = ErrTaskNotFound
+		}
 		if err != nil {
 			return kverr.New(err, "task_id", taskID)
 		}
+		if err = checkLeaseRow(task.Status, currentToken, leaseToken); err != nil {
+			return kverr.New(err, "task_id", taskID)
+		}
 
 		// Step 2: Log the task details
 		m.Logger.Info("task complete", "task_id", task.ID, "user_id", task.UserID, "attempts", task.Attempts, "task_type", task.TaskType)
 
 		// Step 3: Mark the task as complete
-		_, err = tx.Exec(`
+		_, err = tx.ExecContext(ctx, `
+			UPDATE tasks
+			SET status = 'complete', result = ?, lease_token = NULL, lease_expires_at = NULL, updated_at = NOW()
+			WHERE id = ?
+		`, result, taskID)
+		if err != nil {
+			return kverr.New(err, "task_id", taskID, "user_id", task.UserID)
+		}
+
+		return nil
+	})
+}
+
+func (m *MySQLTaskQueue) MarkTaskDead(ctx context.Context, taskID int, leaseToken string, reason string) error {
+	return timeDBOperation("mark_task_dead", func() error {
+		// Start a transaction on writer
+		tx, err := m.DBManager.Writer.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			if err != nil {
+				tx.Rollback()
+			} else {
+				tx.Commit()
+			}
+		}()
+
+		var task Task
+		var currentToken sql.NullString
+		err = tx.QueryRowContext(ctx, `
+			SELECT id, user_id, status, task_type, attempts, lease_token
+			FROM tasks
+			WHERE id = ?
+			FOR UPDATE
+		`, taskID).Scan(&task.ID, &task.UserID, &task.Status, &task.TaskType, &task.Attempts, &currentToken)
+		if err == sql.ErrNoRows {
+			err = ErrTaskNotFound
+		}
+		if err != nil {
+			return kverr.New(err, "task_id", taskID)
+		}
+		if err = checkLeaseRow(task.Status, currentToken, leaseToken); err != nil {
+			return kverr.New(err, "task_id", taskID)
+		}
+
+		m.Logger.Error("dead task", "task_id", task.ID, "user_id", task.UserID, "attempt", task.Attempts, "task_type", task.TaskType, "reason", reason)
+
+		_, err = tx.ExecContext(ctx, `
 			UPDATE tasks
-			SET status = 'complete', updated_at = NOW()
+			SET status = 'dead', last_error = ?, lease_token = NULL, lease_expires_at = NULL, updated_at = NOW()
 			WHERE id = ?
-		`, taskID)
+		`, reason, taskID)
 		if err != nil {
 			return kverr.New(err, "task_id", taskID, "user_id", task.UserID)
 		}
@@ -174,10 +691,94 @@ func (m *MySQLTaskQueue) MarkTaskComplete(taskID int) error {
 	})
 }
 
-func (m *MySQLTaskQueue) CheckAndMarkDeadTasks() error {
+func (m *MySQLTaskQueue) FailTask(ctx context.Context, taskID int, leaseToken string, errMsg string, nextAttemptAt time.Time) error {
+	return timeDBOperation("fail_task", func() error {
+		res, err := m.DBManager.Writer.ExecContext(ctx, `
+			UPDATE tasks
+			SET status = 'open', last_error = ?, next_attempt_at = ?, lease_token = NULL, lease_expires_at = NULL, updated_at = NOW()
+			WHERE id = ? AND (? = '' OR (status = 'checked_out' AND lease_token = ?))
+		`, errMsg, nextAttemptAt, taskID, leaseToken, leaseToken)
+		if err != nil {
+			return kverr.New(err, "task_id", taskID)
+		}
+
+		count, err := res.RowsAffected()
+		if err != nil {
+			return kverr.New(err, "task_id", taskID)
+		}
+		if count == 0 {
+			return kverr.New(m.leaseError(ctx, taskID), "task_id", taskID)
+		}
+
+		m.Logger.Info("task attempt failed", "task_id", taskID, "next_attempt_at", nextAttemptAt)
+		return nil
+	})
+}
+
+// ReleaseTask implements Releaser.
+func (m *MySQLTaskQueue) ReleaseTask(ctx context.Context, taskID int, leaseToken string) error {
+	return timeDBOperation("release_task", func() error {
+		res, err := m.DBManager.Writer.ExecContext(ctx, `
+			UPDATE tasks
+			SET status = 'open', attempts = GREATEST(attempts - 1, 0), next_attempt_at = NULL, lease_token = NULL, lease_expires_at = NULL, updated_at = NOW()
+			WHERE id = ? AND (? = '' OR (status = 'checked_out' AND lease_token = ?))
+		`, taskID, leaseToken, leaseToken)
+		if err != nil {
+			return kverr.New(err, "task_id", taskID)
+		}
+
+		count, err := res.RowsAffected()
+		if err != nil {
+			return kverr.New(err, "task_id", taskID)
+		}
+		if count == 0 {
+			return kverr.New(m.leaseError(ctx, taskID), "task_id", taskID)
+		}
+
+		m.Logger.Info("task released", "task_id", taskID)
+		return nil
+	})
+}
+
+// SetMaxAttempts implements AttemptLimiter.
+func (m *MySQLTaskQueue) SetMaxAttempts(taskType string, n int) {
+	m.maxAttemptsMu.Lock()
+	defer m.maxAttemptsMu.Unlock()
+	if m.maxAttempts == nil {
+		m.maxAttempts = make(map[string]int)
+	}
+	m.maxAttempts[taskType] = n
+}
+
+// attemptLimit returns an expression for the attempt limit of each task's type, and its args.
+func (m *MySQLTaskQueue) attemptLimit() (string, []any) {
+	m.maxAttemptsMu.Lock()
+	defer m.maxAttemptsMu.Unlock()
+
+	if len(m.maxAttempts) == 0 {
+		return "?", []any{m.RetryLimit}
+	}
+	taskTypes := make([]string, 0, len(m.maxAttempts))
+	for taskType := range m.maxAttempts {
+		taskTypes = append(taskTypes, taskType)
+	}
+	slices.Sort(taskTypes)
+
+	var b strings.Builder
+	args := make([]any, 0, 2*len(taskTypes)+1)
+	b.WriteString("CASE task_type")
+	for _, taskType := range taskTypes {
+		b.WriteString(" WHEN ? THEN ?")
+		args = append(args, taskType, m.maxAttempts[taskType])
+	}
+	b.WriteString(" ELSE ? END")
+	return b.String(), append(args, m.RetryLimit)
+}
+
+func (m *MySQLTaskQueue) CheckAndMarkDeadTasks(ctx context.Context) error {
 	return timeDBOperation("check_and_mark_dead_tasks", func() error {
 		// Start a transaction on writer
-		tx, err := m.DBManager.Writer.Begin()
+		tx, err := m.DBManager.Writer.BeginTx(ctx, nil)
 		if err != nil {
 			return err
 		}
@@ -190,13 +791,15 @@ func (m *MySQLTaskQueue) CheckAndMarkDeadTasks() error {
 			}
 		}()
 
-		// Step 1: Select tasks that meet the criteria
-		rows, err := tx.Query(`
+		// Step 1: Select tasks that meet the criteria. Only tasks whose checkout expired are dead;
+		// a final attempt may still be running.
+		limit, args := m.attemptLimit()
+		rows, err := tx.QueryContext(ctx, `
 			SELECT id, user_id, attempts, task_type
 			FROM tasks
-			WHERE status = 'checked_out' AND attempts >= ?
+			WHERE status = 'checked_out' AND attempts >= `+limit+` AND lease_expires_at < ?
 			FOR UPDATE
-		`, m.RetryLimit)
+		`, append(args, time.Now())...)
 		if err != nil {
 			return err
 		}
@@ -219,9 +822,9 @@ func (m *MySQLTaskQueue) CheckAndMarkDeadTasks() error {
 
 		// Step 4: Update all selected tasks to 'dead'
 		for _, task := range tasks {
-			_, err := tx.Exec(`
+			_, err := tx.ExecContext(ctx, `
 				UPDATE tasks
-				SET status = 'dead', updated_at = NOW()
+				SET status = 'dead', last_error = 'checkout expired after retry limit', lease_token = NULL, lease_expires_at = NULL, updated_at = NOW()
 				WHERE id = ?
 			`, task.ID)
 			if err != nil {
@@ -233,6 +836,178 @@ func (m *MySQLTaskQueue) CheckAndMarkDeadTasks() error {
 	})
 }
 
+func (m *MySQLTaskQueue) ListDeadTasks(ctx context.Context, filter TaskFilter) ([]Task, error) {
+	var tasks []Task
+
+	err := timeDBOperation("list_dead_tasks", func() error {
+		where, args := filter.where()
+		query := "SELECT " + taskColumns + " FROM tasks WHERE status = 'dead'" + where + " ORDER BY id ASC"
+		if filter.Limit > 0 {
+			query += " LIMIT ?"
+			args = append(args, filter.Limit)
+		}
+
+		rows, err := m.DBManager.Reader.QueryContext(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("unable to list dead tasks: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			task, err := scanTask(rows)
+			if err != nil {
+				return fmt.Errorf("unable to scan dead task: %w", err)
+			}
+			tasks = append(tasks, *task)
+		}
+		return rows.Err()
+	})
+
+	return tasks, err
+}
+
+func (m *MySQLTaskQueue) RequeueDeadTasks(ctx context.Context, filter TaskFilter) (int, error) {
+	where, args := filter.where()
+	query := "UPDATE tasks SET status = 'open', attempts = 0, next_attempt_at = NULL, updated_at = NOW() WHERE status = 'dead'" + where + " ORDER BY id ASC"
+	return m.execDeadTasks(ctx, "requeue_dead_tasks", query, args, filter.Limit)
+}
+
+func (m *MySQLTaskQueue) PurgeDeadTasks(ctx context.Context, filter TaskFilter) (int, error) {
+	where, args := filter.where()
+	query := "DELETE FROM tasks WHERE status = 'dead'" + where + " ORDER BY id ASC"
+	return m.execDeadTasks(ctx, "purge_dead_tasks", query, args, filter.Limit)
+}
+
+// execDeadTasks runs a bulk update or delete against dead tasks and returns the affected row count.
+func (m *MySQLTaskQueue) execDeadTasks(ctx context.Context, operation string, query string, args []any, limit int) (int, error) {
+	var res sql.Result
+	var err error
+
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	err = timeDBOperation(operation, func() error {
+		res, err = m.DBManager.Writer.ExecContext(ctx, query, args...)
+		return err
+	})
+	if err != nil {
+		return 0, kverr.New(err, "operation", operation)
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, kverr.New(err, "operation", operation)
+	}
+
+	m.Logger.Info("dead tasks updated", "operation", operation, "count", count)
+	// shouldn't be an issue on 64bit machines
+	return int(count), nil
+}
+
+// archiveColumns are the columns SweepTasks copies into tasks_archive.
+const archiveColumns = "id, user_id, status, task_type, payload, queue, priority, attempts, last_error, result, trace_parent, request_id, created_at, updated_at"
+
+func (m *MySQLTaskQueue) SweepTasks(ctx context.Context, status string, finishedBefore time.Time, limit int) (int, error) {
+	if err := checkSweepStatus(status); err != nil {
+		return 0, err
+	}
+	var ids []int
+
+	err := timeDBOperation("sweep_tasks", func() error {
+		tx, err := m.DBManager.Writer.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to start transaction: %w", err)
+		}
+		defer tx.Rollback()
+
+		// SKIP LOCKED lets replicas sweep at the same time without copying the same rows twice
+		query := "SELECT id FROM tasks WHERE status = ? AND updated_at < ? ORDER BY id ASC"
+		args := []any{status, finishedBefore}
+		if limit > 0 {
+			query += " LIMIT ?"
+			args = append(args, limit)
+		}
+		rows, err := tx.QueryContext(ctx, query+" FOR UPDATE SKIP LOCKED", args...)
+		if err != nil {
+			return fmt.Errorf("unable to select tasks to sweep: %w", err)
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return fmt.Errorf("unable to scan task to sweep: %w", err)
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("unable to select tasks to sweep: %w", err)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		idArgs := make([]any, 0, len(ids))
+		for _, id := range ids {
+			idArgs = append(idArgs, id)
+		}
+		inIDs := "(" + strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",") + ")"
+		if m.Archive {
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO tasks_archive (`+archiveColumns+`)
+				SELECT `+archiveColumns+` FROM tasks WHERE id IN `+inIDs, idArgs...)
+			if err != nil {
+				return fmt.Errorf("unable to archive tasks: %w", err)
+			}
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM tasks WHERE id IN "+inIDs, idArgs...)
+		if err != nil {
+			return fmt.Errorf("unable to delete swept tasks: %w", err)
+		}
+
+		return tx.Commit()
+	})
+	if err != nil {
+		return 0, kverr.New(err, "status", status)
+	}
+
+	if len(ids) > 0 {
+		m.Logger.Debug("tasks swept", "status", status, "count", len(ids), "archived", m.Archive)
+	}
+	return len(ids), nil
+}
+
+func (m *MySQLTaskQueue) CountTasks(ctx context.Context) ([]TaskCount, error) {
+	var counts []TaskCount
+	err := timeDBOperation("count_tasks", func() error {
+		rows, err := m.DBManager.Reader.QueryContext(ctx, `
+			SELECT status, task_type, COUNT(*)
+			FROM tasks
+			GROUP BY status, task_type
+			ORDER BY status, task_type
+		`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var count TaskCount
+			if err := rows.Scan(&count.Status, &count.TaskType, &count.Count); err != nil {
+				return err
+			}
+			counts = append(counts, count)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to count tasks: %w", err)
+	}
+	return counts, nil
+}
+
 func (m *MySQLTaskQueue) Close() error {
 	return nil
 }
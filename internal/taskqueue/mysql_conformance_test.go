@@ -0,0 +1,175 @@
+//go:build unitintegration
+
+// the build tag keeps the MySQL conformance run out of go test ./...; run it against a local
+// database (make db-restart) with go test ./... -tags=unitintegration
+package taskqueue_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sethgrid/helloworld/internal/db"
+	"github.com/sethgrid/helloworld/internal/taskqueue"
+	"github.com/sethgrid/helloworld/internal/taskqueue/taskqueuetest"
+	"github.com/sethgrid/helloworld/logger"
+)
+
+// testDSN defaults to the docker compose database and can be overridden with HELLOWORLD_TEST_DSN.
+func testDSN() string {
+	if dsn := os.Getenv("HELLOWORLD_TEST_DSN"); dsn != "" {
+		return dsn
+	}
+	return "testuser:testuser@tcp(127.0.0.1:3306)/helloworld?parseTime=true"
+}
+
+func TestMySQLConformance(t *testing.T) {
+	log := logger.New(io.Discard)
+	dbManager, err := db.NewManager("", testDSN(), "", log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbManager.Close()
+	if err := dbManager.Ping(context.Background()); err != nil {
+		t.Skipf("mysql is not available, start it with make db-restart: %v", err)
+	}
+
+	// DATETIME columns keep whole seconds, so checkouts need at least a second to expire reliably
+	taskqueuetest.Run(t, time.Second, func(t *testing.T, retryLimit int, expiration time.Duration) taskqueue.Tasker {
+		if _, err := dbManager.Writer.Exec("DELETE FROM tasks"); err != nil {
+			t.Fatal(err)
+		}
+		return taskqueue.NewMySQLTaskQueue(dbManager, log, retryLimit, expiration)
+	})
+}
+
+func TestMySQLFairness(t *testing.T) {
+	log := logger.New(io.Discard)
+	dbManager, err := db.NewManager("", testDSN(), "", log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbManager.Close()
+	if err := dbManager.Ping(context.Background()); err != nil {
+		t.Skipf("mysql is not available, start it with make db-restart: %v", err)
+	}
+
+	taskqueuetest.RunFairness(t, func(t *testing.T, fairness taskqueue.Fairness) taskqueue.Tasker {
+		if _, err := dbManager.Writer.Exec("DELETE FROM tasks"); err != nil {
+			t.Fatal(err)
+		}
+		q := taskqueue.NewMySQLTaskQueue(dbManager, log, 3, time.Minute)
+		q.Fairness = fairness
+		return q
+	})
+}
+
+func TestMySQLAddTaskTx(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	dbManager, err := db.NewManager("", testDSN(), "", log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbManager.Close()
+	if err := dbManager.Ping(ctx); err != nil {
+		t.Skipf("mysql is not available, start it with make db-restart: %v", err)
+	}
+	if _, err := dbManager.Writer.Exec("DELETE FROM tasks"); err != nil {
+		t.Fatal(err)
+	}
+	q := taskqueue.NewMySQLTaskQueue(dbManager, log, 3, time.Minute)
+
+	// a rolled back task is never seen
+	tx, err := dbManager.Writer.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	rolledBack, err := q.AddTaskTx(ctx, tx, 1, "welcome", "{}")
+	require.NoError(t, err)
+	task, err := q.FetchOpenTask(ctx, taskqueue.DefaultQueue)
+	require.NoError(t, err)
+	assert.Nil(t, task, "an uncommitted task can't be fetched")
+	require.NoError(t, tx.Rollback())
+	_, err = q.GetTask(ctx, rolledBack)
+	assert.ErrorIs(t, err, taskqueue.ErrTaskNotFound)
+
+	// a committed task is fetched like any other, and a dedup key is honored inside the transaction
+	tx, err = dbManager.Writer.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	committed, err := q.AddTaskTx(ctx, tx, 1, "welcome", "{}", taskqueue.WithDedupKey("welcome-1", 0))
+	require.NoError(t, err)
+	again, err := q.AddTaskTx(ctx, tx, 1, "welcome", "{}", taskqueue.WithDedupKey("welcome-1", 0))
+	require.NoError(t, err)
+	assert.Equal(t, committed, again)
+	require.NoError(t, tx.Commit())
+
+	task, err = q.FetchOpenTask(ctx, taskqueue.DefaultQueue)
+	require.NoError(t, err)
+	require.NotNil(t, task)
+	assert.Equal(t, committed, task.ID)
+}
+
+func TestMySQLAddTaskTxConcurrentDedup(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	dbManager, err := db.NewManager("", testDSN(), "", log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbManager.Close()
+	if err := dbManager.Ping(ctx); err != nil {
+		t.Skipf("mysql is not available, start it with make db-restart: %v", err)
+	}
+	if _, err := dbManager.Writer.Exec("DELETE FROM tasks"); err != nil {
+		t.Fatal(err)
+	}
+	q := taskqueue.NewMySQLTaskQueue(dbManager, log, 3, time.Minute)
+
+	// callers racing to enqueue a key nobody holds yet, each inside its own transaction with a
+	// write of its own, all commit and get the same task
+	const callers = 8
+	ids := make([]int, callers)
+	errs := make([]error, callers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			ids[i], errs[i] = func() (int, error) {
+				tx, err := dbManager.Writer.BeginTx(ctx, nil)
+				if err != nil {
+					return 0, err
+				}
+				defer tx.Rollback()
+				if _, err := q.AddTaskTx(ctx, tx, i, "audit", "{}"); err != nil {
+					return 0, err
+				}
+				id, err := q.AddTaskTx(ctx, tx, 1, "welcome", "{}", taskqueue.WithDedupKey("welcome-race", 0))
+				if err != nil {
+					return 0, err
+				}
+				return id, tx.Commit()
+			}()
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	for i := range callers {
+		require.NoError(t, errs[i], "caller %d", i)
+		assert.Equal(t, ids[0], ids[i], "caller %d", i)
+	}
+	var welcomes, audits int
+	require.NoError(t, dbManager.Writer.QueryRow("SELECT COUNT(*) FROM tasks WHERE task_type = 'welcome'").Scan(&welcomes))
+	require.NoError(t, dbManager.Writer.QueryRow("SELECT COUNT(*) FROM tasks WHERE task_type = 'audit'").Scan(&audits))
+	assert.Equal(t, 1, welcomes)
+	assert.Equal(t, callers, audits, "every caller's own write is committed")
+}
@@ -0,0 +1,210 @@
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/sethgrid/kverr"
+)
+
+// Runner statuses reported by State.
+const (
+	RunnerRunning = "running"
+	// RunnerPaused runners fetch nothing until Resume; tasks already fetched are still processed.
+	RunnerPaused = "paused"
+	// RunnerDraining runners fetch nothing and are waiting for the tasks they fetched to finish.
+	RunnerDraining = "draining"
+	// RunnerDrained runners fetch nothing and have finished every task they fetched.
+	RunnerDrained = "drained"
+)
+
+// drainCheckInterval is how often Drain checks whether the runner's workers are done.
+const drainCheckInterval = 50 * time.Millisecond
+
+var (
+	// ErrPauseTypeUnsupported is returned by PauseTaskType when the task store can't fetch around a
+	// task type; see TypeSkipper.
+	ErrPauseTypeUnsupported = errors.New("task store can't pause task types")
+	// ErrDrainInterrupted is returned by Drain when Resume is called before draining finishes.
+	ErrDrainInterrupted = errors.New("drain interrupted by resume")
+)
+
+// TypeSkipper is implemented by Taskers that can leave task types out of a fetch, which
+// Runner.PauseTaskType needs. Every task store in this package implements it.
+type TypeSkipper interface {
+	// FetchOpenTasksExcept is FetchOpenTasks leaving out tasks of the skipped types. They stay
+	// open, without using up an attempt, until a fetch that doesn't skip them.
+	FetchOpenTasksExcept(ctx context.Context, queue string, n int, skipTypes []string) ([]*Task, error)
+}
+
+// RunnerState is what a Runner is doing, for status pages.
+type RunnerState struct {
+	// Status is RunnerRunning, RunnerPaused, RunnerDraining, or RunnerDrained.
+	Status string `json:"status"`
+	// PausedTaskTypes are the task types paused with PauseTaskType, sorted.
+	PausedTaskTypes []string `json:"paused_task_types,omitempty"`
+	// InFlight is the number of tasks fetched by the runner that haven't finished processing.
+	InFlight int `json:"in_flight"`
+}
+
+// Pause stops the runner from fetching tasks until Resume. Tasks already fetched keep running;
+// see Drain to wait for them. Pausing only affects this runner, so other replicas keep fetching.
+func (tq *Runner) Pause() {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	if tq.status == RunnerRunning {
+		tq.status = RunnerPaused
+		tq.resumed = make(chan struct{})
+		tq.logger.Info("task runner paused")
+	}
+}
+
+// Resume starts fetching again after Pause or Drain. Task types paused with PauseTaskType stay
+// paused.
+func (tq *Runner) Resume() {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	if tq.status == RunnerRunning {
+		return
+	}
+	tq.logger.Info("task runner resumed", "previous_status", tq.status)
+	tq.status = RunnerRunning
+	close(tq.resumed)
+	tq.resumed = nil
+}
+
+// Drain stops fetching tasks like Pause and waits for the tasks already fetched to finish, leaving
+// the runner drained: idle but not closed, so the task store stays usable and Resume starts
+// fetching again. Drain returns ctx's error if ctx is done first, in which case the runner keeps
+// draining and State reports it drained once its workers are done; ErrClosed if the runner is
+// closed; and ErrDrainInterrupted if Resume is called before it finishes.
+func (tq *Runner) Drain(ctx context.Context) error {
+	tq.mu.Lock()
+	switch tq.status {
+	case RunnerRunning:
+		tq.resumed = make(chan struct{})
+		fallthrough
+	case RunnerPaused:
+		tq.status = RunnerDraining
+		tq.logger.Info("task runner draining", "in_flight", tq.inFlightCount())
+	}
+	tq.mu.Unlock()
+
+	t := time.NewTicker(drainCheckInterval)
+	defer t.Stop()
+	for {
+		tq.mu.Lock()
+		tq.checkDrained()
+		status := tq.status
+		tq.mu.Unlock()
+
+		switch status {
+		case RunnerDrained:
+			return nil
+		case RunnerRunning, RunnerPaused:
+			return ErrDrainInterrupted
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tq.ctx.Done():
+			return ErrClosed
+		case <-t.C:
+		}
+	}
+}
+
+// PauseTaskType stops the runner from fetching tasks of the type until ResumeTaskType. The tasks
+// stay open in the task store, so other replicas can still fetch them. It returns
+// ErrPauseTypeUnsupported if the task store doesn't implement TypeSkipper.
+func (tq *Runner) PauseTaskType(taskType string) error {
+	if _, ok := tq.TaskStore.(TypeSkipper); !ok {
+		return kverr.New(ErrPauseTypeUnsupported, "task_type", taskType)
+	}
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	if !tq.pausedTypes[taskType] {
+		tq.pausedTypes[taskType] = true
+		tq.logger.Info("task type paused", "task_type", taskType)
+	}
+	return nil
+}
+
+// ResumeTaskType starts fetching tasks of a type paused with PauseTaskType again.
+func (tq *Runner) ResumeTaskType(taskType string) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	if !tq.pausedTypes[taskType] {
+		return
+	}
+	delete(tq.pausedTypes, taskType)
+	tq.logger.Info("task type resumed", "task_type", taskType)
+	// the type's tasks may have been waiting all along; don't leave them until the next poll
+	for _, pool := range tq.pools {
+		pool.wake()
+	}
+}
+
+// State returns what the runner is doing.
+func (tq *Runner) State() RunnerState {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	tq.checkDrained()
+	state := RunnerState{Status: tq.status, InFlight: tq.inFlightCount()}
+	for taskType := range tq.pausedTypes {
+		state.PausedTaskTypes = append(state.PausedTaskTypes, taskType)
+	}
+	slices.Sort(state.PausedTaskTypes)
+	return state
+}
+
+// beginFetch starts a fetch and returns the task types to leave out of it. While the runner isn't
+// running it returns a channel closed on Resume instead, and the caller must not fetch. Every
+// fetch begun must be ended with endFetch.
+func (tq *Runner) beginFetch() ([]string, <-chan struct{}) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	if tq.resumed != nil {
+		return nil, tq.resumed
+	}
+	tq.fetching++
+	var skipTypes []string
+	for taskType := range tq.pausedTypes {
+		skipTypes = append(skipTypes, taskType)
+	}
+	slices.Sort(skipTypes)
+	return skipTypes, nil
+}
+
+func (tq *Runner) endFetch() {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	tq.fetching--
+}
+
+// checkDrained moves a draining runner to drained once nothing is in flight. tq.mu must be held.
+func (tq *Runner) checkDrained() {
+	if tq.status == RunnerDraining && tq.inFlightCount() == 0 {
+		tq.status = RunnerDrained
+		tq.logger.Info("task runner drained")
+	}
+}
+
+// inFlightCount returns the number of tasks fetched and not yet processed, counting fetches that
+// haven't handed their tasks to a worker yet. tq.mu must be held.
+func (tq *Runner) inFlightCount() int {
+	count := tq.fetching
+	for _, pool := range tq.pools {
+		count += int(pool.busy.Load())
+	}
+	return count
+}
@@ -0,0 +1,169 @@
+package taskqueue
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sethgrid/helloworld/logger"
+)
+
+func TestRunnerPauseAndResume(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	q := NewInMemoryTaskQueue(3, time.Minute, log)
+
+	runner := NewRunner(q, 1, log, 10*time.Millisecond)
+	runner.Register("greet", func(ctx context.Context, task Task) (string, error) {
+		return "", nil
+	})
+	runner.Pause()
+	go runner.Start()
+	defer runner.Close()
+
+	id, err := q.AddTask(ctx, 1, "greet", "")
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	task, err := q.GetTask(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "open", task.Status, "a paused runner fetches nothing")
+	assert.Equal(t, RunnerState{Status: RunnerPaused}, runner.State())
+
+	runner.Resume()
+	waitForStatus(t, q, id, "complete", time.Second)
+	assert.Equal(t, RunnerState{Status: RunnerRunning}, runner.State())
+}
+
+func TestRunnerPauseTaskType(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	q := NewInMemoryTaskQueue(3, time.Minute, log)
+
+	runner := NewRunner(q, 1, log, 10*time.Millisecond)
+	for _, taskType := range []string{"greet", "export"} {
+		runner.Register(taskType, func(ctx context.Context, task Task) (string, error) {
+			return "", nil
+		})
+	}
+	require.NoError(t, runner.PauseTaskType("export"))
+	go runner.Start()
+	defer runner.Close()
+
+	export, err := q.AddTask(ctx, 1, "export", "", WithPriority(10))
+	require.NoError(t, err)
+	greet, err := q.AddTask(ctx, 1, "greet", "")
+	require.NoError(t, err)
+	waitForStatus(t, q, greet, "complete", time.Second)
+
+	task, err := q.GetTask(ctx, export)
+	require.NoError(t, err)
+	assert.Equal(t, "open", task.Status)
+	assert.Equal(t, 0, task.Attempts, "a paused task type is not checked out")
+	assert.Equal(t, RunnerState{Status: RunnerRunning, PausedTaskTypes: []string{"export"}}, runner.State())
+
+	runner.ResumeTaskType("export")
+	waitForStatus(t, q, export, "complete", time.Second)
+
+	// a store without FetchOpenTasksExcept can't skip types
+	hidden := NewRunner(struct{ Tasker }{q}, 1, log, time.Second)
+	assert.ErrorIs(t, hidden.PauseTaskType("export"), ErrPauseTypeUnsupported)
+}
+
+func TestRunnerDrain(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	q := NewInMemoryTaskQueue(3, time.Minute, log)
+
+	runner := NewRunner(q, 2, log, 10*time.Millisecond)
+	started := make(chan int, 2)
+	release := make(chan struct{})
+	runner.Register("export", func(ctx context.Context, task Task) (string, error) {
+		started <- task.ID
+		<-release
+		return "", nil
+	})
+	go runner.Start()
+	defer runner.Close()
+
+	var ids []int
+	for range 2 {
+		id, err := q.AddTask(ctx, 1, "export", "")
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	for range 2 {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("tasks were not started")
+		}
+	}
+
+	drained := make(chan error, 1)
+	go func() { drained <- runner.Drain(ctx) }()
+	require.Eventually(t, func() bool { return runner.State().Status == RunnerDraining }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 2, runner.State().InFlight)
+
+	late, err := q.AddTask(ctx, 1, "export", "")
+	require.NoError(t, err)
+	close(release)
+
+	select {
+	case err := <-drained:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("drain did not finish")
+	}
+	for _, id := range ids {
+		waitForStatus(t, q, id, "complete", time.Second)
+	}
+	assert.Equal(t, RunnerState{Status: RunnerDrained}, runner.State())
+	task, err := q.GetTask(ctx, late)
+	require.NoError(t, err)
+	assert.Equal(t, "open", task.Status, "a draining runner fetches nothing new")
+
+	runner.Resume()
+	waitForStatus(t, q, late, "complete", time.Second)
+}
+
+func TestRunnerDrainInterrupted(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	q := NewInMemoryTaskQueue(3, time.Minute, log)
+
+	runner := NewRunner(q, 1, log, 10*time.Millisecond)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	runner.Register("export", func(ctx context.Context, task Task) (string, error) {
+		started <- struct{}{}
+		<-release
+		return "", nil
+	})
+	go runner.Start()
+	defer runner.Close()
+	defer close(release)
+
+	_, err := q.AddTask(ctx, 1, "export", "")
+	require.NoError(t, err)
+	<-started
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 30*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, runner.Drain(timeoutCtx), context.DeadlineExceeded)
+	assert.Equal(t, RunnerState{Status: RunnerDraining, InFlight: 1}, runner.State(), "the runner keeps draining after Drain gives up")
+
+	drained := make(chan error, 1)
+	go func() { drained <- runner.Drain(ctx) }()
+	time.Sleep(20 * time.Millisecond)
+	runner.Resume()
+	select {
+	case err := <-drained:
+		assert.ErrorIs(t, err, ErrDrainInterrupted)
+	case <-time.After(time.Second):
+		t.Fatal("drain did not return after resume")
+	}
+}
@@ -0,0 +1,176 @@
+package taskqueue
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/sethgrid/kverr"
+)
+
+// ErrInvalidPayload is returned for payloads that can't be encoded, decoded, or validated. A
+// handler error wrapping it marks the task dead right away, since retrying can't fix the payload.
+var ErrInvalidPayload = errors.New("invalid task payload")
+
+// PayloadValidator is implemented by payload types that check their own fields. Validate is
+// called before a payload is enqueued and after it is decoded for a handler.
+type PayloadValidator interface {
+	Validate() error
+}
+
+// UpgradeFunc converts the JSON of a payload from one version to the next.
+type UpgradeFunc func(data json.RawMessage) (json.RawMessage, error)
+
+// PayloadOption configures a PayloadType.
+type PayloadOption func(*payloadConfig)
+
+type payloadConfig struct {
+	upgrades map[int]UpgradeFunc
+}
+
+// WithUpgrade lets handlers decode payloads enqueued at version from, before the payload's shape
+// changed, by converting them to version from+1. Upgrades are chained, so a task enqueued at
+// version 1 is run through the upgrades from 1 and from 2 to reach version 3. Payloads enqueued
+// before the task type used a PayloadType are version 0.
+func WithUpgrade(from int, fn UpgradeFunc) PayloadOption {
+	return func(c *payloadConfig) {
+		c.upgrades[from] = fn
+	}
+}
+
+// payloadEnvelope is how a PayloadType stores its payloads in Task.Payload.
+//
+//	{"v":2,"data":{"message":"hello"}}
+type payloadEnvelope struct {
+	Version int             `json:"v"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// PayloadType is a task type whose payloads are T encoded as JSON along with a schema version, so
+// handlers get a decoded T instead of parsing Task.Payload themselves. Bump the version and add
+// an upgrade with WithUpgrade whenever T changes in a way older payloads can't be decoded into.
+//
+//	var sendEmail = taskqueue.NewPayloadType[emailPayload]("send_email", 2,
+//		taskqueue.WithUpgrade(1, upgradeEmailV1))
+//
+//	sendEmail.Register(runner, func(ctx context.Context, task taskqueue.Task, p emailPayload) (string, error) { ... })
+//	id, err := sendEmail.Enqueue(ctx, taskq, userID, emailPayload{To: "a@example.com"})
+type PayloadType[T any] struct {
+	taskType string
+	version  int
+	upgrades map[int]UpgradeFunc
+}
+
+// NewPayloadType declares taskType with payloads of type T at version, which starts at 1.
+func NewPayloadType[T any](taskType string, version int, opts ...PayloadOption) *PayloadType[T] {
+	cfg := payloadConfig{upgrades: make(map[int]UpgradeFunc)}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &PayloadType[T]{taskType: taskType, version: max(version, 1), upgrades: cfg.upgrades}
+}
+
+// TaskType returns the task type the payloads are enqueued under.
+func (p *PayloadType[T]) TaskType() string {
+	return p.taskType
+}
+
+// Encode validates payload and returns it as a Task.Payload, for places that take a raw payload
+// such as scheduler.Job.
+func (p *PayloadType[T]) Encode(payload T) (string, error) {
+	if err := validatePayload(&payload); err != nil {
+		return "", kverr.New(err, "task_type", p.taskType)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", kverr.New(fmt.Errorf("%w: %w", ErrInvalidPayload, err), "task_type", p.taskType)
+	}
+	envelope, err := json.Marshal(payloadEnvelope{Version: p.version, Data: data})
+	if err != nil {
+		return "", kverr.New(fmt.Errorf("%w: %w", ErrInvalidPayload, err), "task_type", p.taskType)
+	}
+	return string(envelope), nil
+}
+
+// Decode returns the payload of a task of this type, upgraded to the current version. The error
+// wraps ErrInvalidPayload if the payload can't be decoded, upgraded, or validated.
+func (p *PayloadType[T]) Decode(raw string) (T, error) {
+	var payload T
+	version, data := 0, json.RawMessage(raw)
+	var envelope payloadEnvelope
+	if err := json.Unmarshal([]byte(raw), &envelope); err == nil && envelope.Version > 0 && envelope.Data != nil {
+		version, data = envelope.Version, envelope.Data
+	}
+
+	if version > p.version {
+		return payload, kverr.New(fmt.Errorf("%w: version %d is newer than %d", ErrInvalidPayload, version, p.version), "task_type", p.taskType, "payload_version", version)
+	}
+	for v := version; v < p.version; v++ {
+		upgrade, ok := p.upgrades[v]
+		if !ok {
+			return payload, kverr.New(fmt.Errorf("%w: no upgrade from version %d", ErrInvalidPayload, v), "task_type", p.taskType, "payload_version", version)
+		}
+		var err error
+		if data, err = upgrade(data); err != nil {
+			return payload, kverr.New(fmt.Errorf("%w: upgrade from version %d: %w", ErrInvalidPayload, v, err), "task_type", p.taskType, "payload_version", version)
+		}
+	}
+
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return payload, kverr.New(fmt.Errorf("%w: %w", ErrInvalidPayload, err), "task_type", p.taskType, "payload_version", version)
+	}
+	if err := validatePayload(&payload); err != nil {
+		return payload, kverr.New(err, "task_type", p.taskType, "payload_version", version)
+	}
+	return payload, nil
+}
+
+// Enqueue validates and encodes payload and adds it as a task of this type.
+func (p *PayloadType[T]) Enqueue(ctx context.Context, tasker Tasker, userID int, payload T, opts ...EnqueueOption) (int, error) {
+	raw, err := p.Encode(payload)
+	if err != nil {
+		return 0, err
+	}
+	return tasker.AddTask(ctx, userID, p.taskType, raw, opts...)
+}
+
+// EnqueueTx is Enqueue as part of the caller's transaction; see TxTasker.
+func (p *PayloadType[T]) EnqueueTx(ctx context.Context, tasker TxTasker, tx *sql.Tx, userID int, payload T, opts ...EnqueueOption) (int, error) {
+	raw, err := p.Encode(payload)
+	if err != nil {
+		return 0, err
+	}
+	return tasker.AddTaskTx(ctx, tx, userID, p.taskType, raw, opts...)
+}
+
+// Handler adapts fn to a HandlerFunc that decodes each task's payload before calling it. Tasks
+// whose payload can't be decoded fail with ErrInvalidPayload, so they are marked dead without
+// being retried and without fn being called.
+func (p *PayloadType[T]) Handler(fn func(ctx context.Context, task Task, payload T) (string, error)) HandlerFunc {
+	return func(ctx context.Context, task Task) (string, error) {
+		payload, err := p.Decode(task.Payload)
+		if err != nil {
+			return "", kverr.New(err, "task_id", task.ID)
+		}
+		return fn(ctx, task, payload)
+	}
+}
+
+// Register registers Handler(fn) with the runner for this task type.
+func (p *PayloadType[T]) Register(runner *Runner, fn func(ctx context.Context, task Task, payload T) (string, error), opts ...HandlerOption) {
+	runner.Register(p.taskType, p.Handler(fn), opts...)
+}
+
+// validatePayload calls Validate if the payload has one, on a value or pointer receiver.
+func validatePayload[T any](payload *T) error {
+	v, ok := any(payload).(PayloadValidator)
+	if !ok {
+		return nil
+	}
+	if err := v.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPayload, err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package taskqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sethgrid/helloworld/logger"
+)
+
+// emailPayload is version 2 of a payload whose version 1 had a single "to" string.
+type emailPayload struct {
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+}
+
+func (p *emailPayload) Validate() error {
+	if len(p.To) == 0 {
+		return errors.New("at least one recipient is required")
+	}
+	return nil
+}
+
+func upgradeEmailV1(data json.RawMessage) (json.RawMessage, error) {
+	var v1 struct {
+		To      string `json:"to"`
+		Subject string `json:"subject"`
+	}
+	if err := json.Unmarshal(data, &v1); err != nil {
+		return nil, err
+	}
+	return json.Marshal(emailPayload{To: []string{v1.To}, Subject: v1.Subject})
+}
+
+func TestPayloadDecode(t *testing.T) {
+	emails := NewPayloadType[emailPayload]("send_email", 2, WithUpgrade(1, upgradeEmailV1))
+
+	tests := []struct {
+		name    string
+		raw     string
+		want    emailPayload
+		wantErr string
+	}{
+		{name: "current version", raw: `{"v":2,"data":{"to":["a@example.com"],"subject":"hi"}}`, want: emailPayload{To: []string{"a@example.com"}, Subject: "hi"}},
+		{name: "upgraded", raw: `{"v":1,"data":{"to":"a@example.com","subject":"hi"}}`, want: emailPayload{To: []string{"a@example.com"}, Subject: "hi"}},
+		{name: "newer version", raw: `{"v":3,"data":{}}`, wantErr: "version 3 is newer than 2"},
+		{name: "unversioned without upgrade", raw: `{"to":["a@example.com"]}`, wantErr: "no upgrade from version 0"},
+		{name: "upgrade fails", raw: `{"v":1,"data":{"to":["a@example.com"]}}`, wantErr: "upgrade from version 1"},
+		{name: "wrong shape", raw: `{"v":2,"data":{"to":"a@example.com"}}`, wantErr: "cannot unmarshal"},
+		{name: "not json", raw: `to=a@example.com`, wantErr: "no upgrade from version 0"},
+		{name: "fails validation", raw: `{"v":2,"data":{"to":[]}}`, wantErr: "at least one recipient is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := emails.Decode(tt.raw)
+			if tt.wantErr != "" {
+				require.ErrorIs(t, err, ErrInvalidPayload)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPayloadEnqueue(t *testing.T) {
+	ctx := context.Background()
+	q := NewInMemoryTaskQueue(3, time.Minute, logger.New(io.Discard))
+	emails := NewPayloadType[emailPayload]("send_email", 2)
+
+	_, err := emails.Enqueue(ctx, q, 1, emailPayload{Subject: "nobody"})
+	require.ErrorIs(t, err, ErrInvalidPayload)
+	counts, err := q.CountTasks(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, counts, "invalid payloads are not enqueued")
+
+	id, err := emails.Enqueue(ctx, q, 1, emailPayload{To: []string{"a@example.com"}, Subject: "hi"}, WithPriority(5))
+	require.NoError(t, err)
+	task, err := q.GetTask(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "send_email", task.TaskType)
+	assert.Equal(t, 5, task.Priority)
+	assert.JSONEq(t, `{"v":2,"data":{"to":["a@example.com"],"subject":"hi"}}`, task.Payload)
+}
+
+func TestRunnerTypedPayloads(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	q := NewInMemoryTaskQueue(3, time.Minute, log)
+	emails := NewPayloadType[emailPayload]("send_email", 2, WithUpgrade(1, upgradeEmailV1))
+
+	runner := NewRunner(q, 1, log, 10*time.Millisecond)
+	sent := make(chan emailPayload, 2)
+	emails.Register(runner, func(ctx context.Context, task Task, payload emailPayload) (string, error) {
+		sent <- payload
+		return "", nil
+	}, WithMaxAttempts(5))
+	go runner.Start()
+	defer runner.Close()
+
+	okID, err := emails.Enqueue(ctx, q, 1, emailPayload{To: []string{"a@example.com"}})
+	require.NoError(t, err)
+	oldID, err := q.AddTask(ctx, 1, "send_email", `{"v":1,"data":{"to":"b@example.com"}}`)
+	require.NoError(t, err)
+	badID, err := q.AddTask(ctx, 1, "send_email", `{"v":2,"data":{"to":"c@example.com"}}`)
+	require.NoError(t, err)
+
+	waitForStatus(t, q, okID, "complete", time.Second)
+	waitForStatus(t, q, oldID, "complete", time.Second)
+	assert.ElementsMatch(t, []emailPayload{{To: []string{"a@example.com"}}, {To: []string{"b@example.com"}}}, []emailPayload{<-sent, <-sent})
+
+	// undecodable payloads go straight to dead instead of using up their attempts
+	waitForStatus(t, q, badID, "dead", time.Second)
+	task, err := q.GetTask(ctx, badID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, task.Attempts)
+	assert.Contains(t, task.LastError, "invalid task payload")
+}
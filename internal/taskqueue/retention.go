@@ -0,0 +1,110 @@
+package taskqueue
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/sethgrid/helloworld/metrics"
+)
+
+// finalStatuses are the statuses a task never leaves on its own; only they can be swept.
+var finalStatuses = []string{"complete", "dead", "cancelled"}
+
+// defaultSweepInterval is how often the Runner sweeps when the policy doesn't say.
+const defaultSweepInterval = 10 * time.Minute
+
+// sweepBatchSize bounds each SweepTasks call so a large backlog is removed in short transactions.
+const sweepBatchSize = 1000
+
+// RetentionPolicy controls how long finished tasks are kept before the Runner sweeps them from
+// the task store, e.g. complete tasks for 7 days and dead tasks for 30 days:
+//
+//	runner.SetRetention(taskqueue.RetentionPolicy{Keep: map[string]time.Duration{
+//		"complete": 7 * 24 * time.Hour,
+//		"dead":     30 * 24 * time.Hour,
+//	}})
+//
+// Age is measured from when the task was last updated, which for a finished task is when it finished.
+type RetentionPolicy struct {
+	// Keep maps a final status (complete, dead, or cancelled) to how long tasks in it are kept.
+	// Statuses that are missing or set to zero are kept forever.
+	Keep map[string]time.Duration
+	// Interval is how often the sweeper runs; it defaults to 10 minutes.
+	Interval time.Duration
+}
+
+// checkSweepStatus returns an error unless status is final. Sweeping any other status would drop
+// work that hasn't run yet.
+func checkSweepStatus(status string) error {
+	if !slices.Contains(finalStatuses, status) {
+		return fmt.Errorf("cannot sweep tasks with status %q, only %v", status, finalStatuses)
+	}
+	return nil
+}
+
+// SetRetention turns on the sweeper, which removes finished tasks once they are older than the
+// policy allows. SetRetention should be called before Start.
+func (tq *Runner) SetRetention(policy RetentionPolicy) {
+	if policy.Interval <= 0 {
+		policy.Interval = defaultSweepInterval
+	}
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	tq.retention = policy
+}
+
+// runSweeper sweeps on the retention interval until the runner is closed.
+func (tq *Runner) runSweeper(policy RetentionPolicy) {
+	for {
+		select {
+		case <-tq.ctx.Done():
+			return
+		default:
+		}
+		if !tq.track() {
+			return
+		}
+		tq.sweep(policy)
+		tq.wg.Done()
+		tq.sleep(policy.Interval)
+	}
+}
+
+// sweep removes, batch by batch, the tasks in each status that are past their retention.
+func (tq *Runner) sweep(policy RetentionPolicy) {
+	statuses := make([]string, 0, len(policy.Keep))
+	for status := range policy.Keep {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	for _, status := range statuses {
+		keep := policy.Keep[status]
+		if keep <= 0 {
+			continue
+		}
+		before := time.Now().Add(-keep)
+
+		total := 0
+		for {
+			count, err := tq.TaskStore.SweepTasks(tq.ctx, status, before, sweepBatchSize)
+			total += count
+			metrics.TasksSwept.WithLabelValues(status).Add(float64(count))
+			if err != nil {
+				if tq.ctx.Err() == nil {
+					tq.logger.Error("unable to sweep tasks", "status", status, "error", err.Error())
+				}
+				break
+			}
+			if count < sweepBatchSize {
+				break
+			}
+		}
+		if total > 0 {
+			tq.logger.Info("swept tasks", "status", status, "count", total, "finished_before", before)
+		}
+	}
+}
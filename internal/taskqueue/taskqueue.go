@@ -1,122 +1,547 @@
 package taskqueue
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sethgrid/kverr"
+
+	"github.com/sethgrid/helloworld/metrics"
 )
 
 type Task struct {
-	ID        int
-	UserID    int
-	Status    string
-	TaskType  string
-	Payload   string
-	Attempts  int
-	CreatedAt time.Time
-	UpdatedAt time.Time
-
-	mu sync.Mutex
+	ID       int
+	UserID   int
+	Status   string
+	TaskType string
+	Payload  string
+	// Queue is the named queue the task was enqueued on; see OnQueue.
+	Queue string
+	// Priority orders tasks within a queue, highest first; see WithPriority.
+	Priority int
+	Attempts int
+	// NextAttemptAt is when the task becomes eligible for its next attempt, either because it
+	// was enqueued with a run-at time or because a failed attempt is backing off.
+	// The zero value means the task can be fetched right away.
+	NextAttemptAt time.Time
+	// LastError is the error recorded by the most recent failed attempt or the reason the task died.
+	LastError string
+	// Result is the output the handler returned when the task completed.
+	Result string
+	// LeaseToken identifies the current checkout. It is set by FetchOpenTask and must be passed
+	// back when reporting on the task, so a worker whose lease expired cannot overwrite the outcome
+	// of the worker that checked the task out after it.
+	LeaseToken string
+	// LeaseExpiresAt is when the checkout expires and the task can be checked out again.
+	// Handlers push it back with Heartbeat.
+	LeaseExpiresAt time.Time
+	// TraceParent is the W3C traceparent of the span that enqueued the task and RequestID is the
+	// rid of the request that enqueued it. Both are captured from the context passed to AddTask
+	// so the Runner can link each attempt back to where the task came from.
+	TraceParent string
+	RequestID   string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
 }
 
 // Tasker defines the interface for task queue operations.
+// Every operation takes a context so callers can cancel in-flight queries and so database
+// spans are parented to the caller's trace.
 type Tasker interface {
-	AddTask(userID int, taskType string, payload string) (int, error)
-	FetchOpenTask() (*Task, error)
-	MarkTaskComplete(taskID int) error
-	CheckAndMarkDeadTasks() error
-	CancelWhere(postWhereStatement string, args ...any) (int, error)
+	// AddTask enqueues a task. By default it runs as soon as possible; see EnqueueOption for delays.
+	AddTask(ctx context.Context, userID int, taskType string, payload string, opts ...EnqueueOption) (int, error)
+	// FetchOpenTask checks out the next due task on the queue: highest priority first, then oldest first.
+	FetchOpenTask(ctx context.Context, queue string) (*Task, error)
+	// FetchOpenTasks checks out up to n due tasks on the queue in the same order as FetchOpenTask.
+	// Concurrent callers, including other replicas, never receive the same task.
+	FetchOpenTasks(ctx context.Context, queue string, n int) ([]*Task, error)
+	// GetTask returns the task with the given ID, or ErrTaskNotFound.
+	GetTask(ctx context.Context, taskID int) (*Task, error)
+	// ExtendLease pushes back the lease expiration of a checked out task by d, or by the store's
+	// checkout expiration when d <= 0, and returns the new expiration.
+	ExtendLease(ctx context.Context, taskID int, leaseToken string, d time.Duration) (time.Time, error)
+
+	// MarkTaskComplete, FailTask, and MarkTaskDead report the outcome of an attempt. They return
+	// ErrLeaseLost unless leaseToken matches the task's current checkout. An empty leaseToken skips
+	// the check, for administrative changes made outside of a worker.
+
+	// MarkTaskComplete records a successful attempt along with the handler's result.
+	MarkTaskComplete(ctx context.Context, taskID int, leaseToken string, result string) error
+	// FailTask records a failed attempt and reopens the task once nextAttemptAt has passed.
+	FailTask(ctx context.Context, taskID int, leaseToken string, errMsg string, nextAttemptAt time.Time) error
+	MarkTaskDead(ctx context.Context, taskID int, leaseToken string, reason string) error
+	// CheckAndMarkDeadTasks marks dead the tasks whose checkout expired on their last attempt, by
+	// the store's retry limit or the task type's limit set through AttemptLimiter.
+	CheckAndMarkDeadTasks(ctx context.Context) error
+	// CancelTasks marks the open and checked out tasks matching the filter as cancelled and returns
+	// their IDs. Finished tasks are never changed. A cancelled task is not fetched again, and the
+	// worker holding a cancelled checkout loses its lease; see Runner.CancelTasks to also stop the
+	// handler right away.
+	CancelTasks(ctx context.Context, filter TaskFilter) ([]int, error)
+
+	// ListDeadTasks, RequeueDeadTasks, and PurgeDeadTasks operate on the dead letter queue:
+	// tasks that used up their attempts or could not be handled.
+	// Requeued tasks are reopened with their attempts reset; purged tasks are deleted.
+	ListDeadTasks(ctx context.Context, filter TaskFilter) ([]Task, error)
+	RequeueDeadTasks(ctx context.Context, filter TaskFilter) (int, error)
+	PurgeDeadTasks(ctx context.Context, filter TaskFilter) (int, error)
+
+	// SweepTasks deletes up to limit tasks in a final status (complete, dead, or cancelled) that
+	// were last updated before finishedBefore, and returns how many it deleted. Stores with an
+	// archive copy the tasks there first. See RetentionPolicy.
+	SweepTasks(ctx context.Context, status string, finishedBefore time.Time, limit int) (int, error)
+
+	// CountTasks returns the number of tasks in each status per task type. Combinations with no
+	// tasks are left out.
+	CountTasks(ctx context.Context) ([]TaskCount, error)
+
 	Close() error
 }
 
+// TxTasker is a Tasker that can also enqueue as part of a caller's transaction, a transactional
+// outbox: code that writes its own rows and enqueues follow-up work commits both or neither.
+//
+//	tx, err := dbManager.Writer.BeginTx(ctx, nil)
+//	// ... insert the user ...
+//	_, err = taskq.AddTaskTx(ctx, tx, userID, "send_welcome_email", payload)
+//	// ...
+//	err = tx.Commit()
+type TxTasker interface {
+	Tasker
+	// AddTaskTx is AddTask within tx. The task can't be fetched until tx commits.
+	AddTaskTx(ctx context.Context, tx *sql.Tx, userID int, taskType string, payload string, opts ...EnqueueOption) (int, error)
+}
+
+// AttemptLimiter is implemented by Taskers that can give task types their own attempt limit, which
+// Runner.Register passes on from WithMaxAttempts so CheckAndMarkDeadTasks gives up on a task after
+// the same number of attempts as the Runner. Every task store in this package implements it.
+type AttemptLimiter interface {
+	// SetMaxAttempts makes CheckAndMarkDeadTasks use n instead of the store's retry limit for tasks
+	// of the type.
+	SetMaxAttempts(taskType string, n int)
+}
+
+// Releaser is implemented by Taskers that can hand a checkout back without using up its attempt,
+// which Runner.Close needs so shutting down doesn't count against the tasks it interrupts. Every
+// task store in this package implements it.
+type Releaser interface {
+	// ReleaseTask reopens a checked out task right away and gives back the attempt its checkout
+	// used. It returns ErrLeaseLost unless leaseToken matches the task's current checkout.
+	ReleaseTask(ctx context.Context, taskID int, leaseToken string) error
+}
+
+// TaskCount is the number of tasks of one type in one status.
+type TaskCount struct {
+	Status   string
+	TaskType string
+	Count    int
+}
+
+// ErrTaskNotFound is returned, possibly wrapped, by Tasker methods given an ID that does not exist.
+var ErrTaskNotFound = errors.New("task not found")
+
+// ErrTaskCancelled is the cause of a handler's context being cancelled because the task was cancelled.
+var ErrTaskCancelled = errors.New("task cancelled")
+
+// ErrTaskTimeout is recorded as the failed attempt's error when a handler runs past its timeout.
+var ErrTaskTimeout = errors.New("task timed out")
+
+// cancellableStatuses are the statuses CancelTasks applies to; every other status is final.
+var cancellableStatuses = []string{"open", "checked_out"}
+
+// DefaultQueue is the queue tasks are added to and fetched from unless another is named.
+const DefaultQueue = "default"
+
+// HandlerFunc processes a single task. On success the returned result is stored on the task
+// for callers polling it with GetTask; it may be empty. A returned error counts as a failed attempt; the task
+// is retried on the type's backoff policy until the max attempts for its type are used up, then it is marked dead.
+// Errors wrapping ErrInvalidPayload mark the task dead right away.
+// The context carries a task scoped logger (see logger.FromCtx) and the task's lease (see Heartbeat),
+// and is cancelled when the attempt times out, the task is cancelled (context.Cause is ErrTaskCancelled),
+// or the Runner is closed.
+type HandlerFunc func(ctx context.Context, task Task) (string, error)
+
+// defaultMaxAttempts matches the retry limit the server configures on its task stores.
+const defaultMaxAttempts = 3
+
+// registration is a handler plus the per task type options it was registered with.
+type registration struct {
+	handler HandlerFunc
+	timeout time.Duration
+	// hasTimeout is set by WithTimeout; without it the Runner's default timeout applies
+	hasTimeout  bool
+	maxAttempts int
+	backoff     BackoffPolicy
+}
+
+// HandlerOption configures how the Runner executes a registered task type.
+type HandlerOption func(*registration)
+
+// WithTimeout bounds a single attempt of the task type, overriding the Runner's default timeout.
+// Once the timeout elapses the handler's context is cancelled and the attempt fails with
+// ErrTaskTimeout, whether or not the handler has returned. Zero means no deadline.
+func WithTimeout(d time.Duration) HandlerOption {
+	return func(r *registration) {
+		r.timeout = d
+		r.hasTimeout = true
+	}
+}
+
+// WithMaxAttempts sets how many attempts a task type gets before it is marked dead.
+func WithMaxAttempts(n int) HandlerOption {
+	return func(r *registration) {
+		if n > 0 {
+			r.maxAttempts = n
+		}
+	}
+}
+
+// WithBackoff sets how long a failed task of this type waits before it is retried.
+func WithBackoff(policy BackoffPolicy) HandlerOption {
+	return func(r *registration) {
+		if policy != nil {
+			r.backoff = policy
+		}
+	}
+}
+
+func newRegistration(handler HandlerFunc, opts []HandlerOption) registration {
+	reg := registration{handler: handler, maxAttempts: defaultMaxAttempts, backoff: defaultBackoff}
+	for _, opt := range opts {
+		opt(&reg)
+	}
+	return reg
+}
+
 type Runner struct {
 	// could add other dependencies, like the user store
 	TaskStore Tasker
 
-	workers      int
-	taskCh       chan *Task
-	logger       *slog.Logger
-	pollInterval time.Duration
+	// queues maps each queue name to the number of workers fetching from it
+	queues          map[string]int
+	logger          *slog.Logger
+	pollInterval    time.Duration
+	minPollInterval time.Duration
+	defaultTimeout  time.Duration
+
+	handlers  map[string]registration
+	unhandled *registration
+	// inFlight holds the cancel func of each task being processed, keyed by task ID
+	inFlight map[int]context.CancelCauseFunc
+	// userInFlight counts the tasks being processed per user, for metrics.TaskUserInFlight
+	userInFlight map[int]int
+	// reported holds the status and task type pairs last set on the task count gauge
+	reported map[TaskCount]bool
+	// retention is set by SetRetention; the sweeper only runs when it keeps some status
+	retention RetentionPolicy
 
-	mu      sync.Mutex
-	wg      sync.WaitGroup
-	closeCh chan struct{}
+	// pools are the queue pools started by Start, kept so Drain can count their busy workers
+	pools map[string]*queuePool
+	// status is RunnerRunning, RunnerPaused, RunnerDraining, or RunnerDrained
+	status string
+	// resumed is closed by Resume; pollers wait on it while the runner isn't running
+	resumed chan struct{}
+	// pausedTypes are the task types paused with PauseTaskType
+	pausedTypes map[string]bool
+	// fetching counts pollers between deciding to fetch and handing the fetched tasks to workers
+	fetching int
+
+	mu sync.Mutex
+	wg sync.WaitGroup
+	// ctx is the parent of every task context; cancel fires on Close
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-// NewRunner initializes the task queue with any implementation of Tasker
+// NewRunner initializes the task queue with any implementation of Tasker.
+// workers is the size of the DefaultQueue pool; see SetQueueWorkers for other queues.
 func NewRunner(taskStore Tasker, workers int, logger *slog.Logger, pollInterval time.Duration) *Runner {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Runner{
-		TaskStore:    taskStore,
-		workers:      workers,
-		taskCh:       make(chan *Task),
-		pollInterval: pollInterval,
-		logger:       logger,
-		mu:           sync.Mutex{},
-		wg:           sync.WaitGroup{},
-		closeCh:      make(chan struct{}),
+		TaskStore:       taskStore,
+		queues:          map[string]int{DefaultQueue: workers},
+		pollInterval:    pollInterval,
+		minPollInterval: pollInterval,
+		logger:          logger,
+		handlers:        make(map[string]registration),
+		inFlight:        make(map[int]context.CancelCauseFunc),
+		userInFlight:    make(map[int]int),
+		reported:        make(map[TaskCount]bool),
+		status:          RunnerRunning,
+		pausedTypes:     make(map[string]bool),
+		mu:              sync.Mutex{},
+		wg:              sync.WaitGroup{},
+		ctx:             ctx,
+		cancel:          cancel,
 	}
 }
 
+// SetQueueWorkers sets how many workers process the named queue, e.g. 4 on DefaultQueue and 1 on "bulk".
+// Each queue is polled separately, so a backlog on one queue does not hold up another.
+// A queue with zero workers is not fetched from. SetQueueWorkers should be called before Start.
+func (tq *Runner) SetQueueWorkers(queue string, workers int) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	if workers <= 0 {
+		delete(tq.queues, queue)
+		return
+	}
+	tq.queues[queue] = workers
+}
+
+// SetDefaultTimeout bounds each attempt of task types registered without WithTimeout.
+// Zero, the default, means no deadline. SetDefaultTimeout should be called before Start.
+// Keep it below the task store's checkout expiration, or a long attempt loses its lease to
+// another worker before it times out.
+func (tq *Runner) SetDefaultTimeout(d time.Duration) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	tq.defaultTimeout = d
+}
+
+// Register wires a handler for a task type, much like routes are wired on the router.
+// Register should be called before Start; registering a type twice replaces the earlier handler.
+func (tq *Runner) Register(taskType string, handler HandlerFunc, opts ...HandlerOption) {
+	reg := newRegistration(handler, opts)
+	if limiter, ok := tq.TaskStore.(AttemptLimiter); ok {
+		limiter.SetMaxAttempts(taskType, reg.maxAttempts)
+	}
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	tq.handlers[taskType] = reg
+}
+
+// HandleUnregistered sets the handler used for tasks whose type has no registered handler.
+// Without one, such tasks are logged and marked dead so they can be inspected rather than
+// sitting checked out until they expire.
+func (tq *Runner) HandleUnregistered(handler HandlerFunc, opts ...HandlerOption) {
+	reg := newRegistration(handler, opts)
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	tq.unhandled = &reg
+}
+
+// registrationFor returns the registration for the task type, falling back to the unhandled
+// registration. ok is false when neither exists.
+func (tq *Runner) registrationFor(taskType string) (registration, bool) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	if reg, ok := tq.handlers[taskType]; ok {
+		return tq.withDefaults(reg), true
+	}
+	if tq.unhandled != nil {
+		return tq.withDefaults(*tq.unhandled), true
+	}
+	return registration{}, false
+}
+
+// withDefaults fills in the runner wide defaults the registration did not override. tq.mu must be held.
+func (tq *Runner) withDefaults(reg registration) registration {
+	if !reg.hasTimeout {
+		reg.timeout = tq.defaultTimeout
+	}
+	return reg
+}
+
 func (tq *Runner) Start() {
-	for i := 0; i < tq.workers; i++ {
-		go tq.worker(i)
+	tq.mu.Lock()
+	queues := make(map[string]int, len(tq.queues))
+	for queue, workers := range tq.queues {
+		queues[queue] = workers
+	}
+	retention := tq.retention
+	tq.mu.Unlock()
+
+	pools := make(map[string]*queuePool, len(queues))
+	for queue, workers := range queues {
+		if workers <= 0 {
+			continue
+		}
+		pools[queue] = &queuePool{queue: queue, size: workers, taskCh: make(chan *Task), freed: make(chan struct{}, 1), woken: make(chan struct{}, 1)}
+	}
+	tq.mu.Lock()
+	tq.pools = pools
+	tq.mu.Unlock()
+	// tasks added in this process wake their queue's poller rather than waiting for the next poll
+	if notifier, ok := tq.TaskStore.(EnqueueNotifier); ok {
+		notifier.OnEnqueue(func(queue string) {
+			if pool, ok := pools[queue]; ok {
+				pool.wake()
+			}
+		})
+	}
+	for _, pool := range pools {
+		for i := 0; i < pool.size; i++ {
+			go tq.worker(pool, i)
+		}
+		go tq.pollTasks(pool)
+	}
+	if len(retention.Keep) > 0 {
+		go tq.runSweeper(retention)
 	}
 	go func() {
 		for {
 			select {
-			case <-tq.closeCh:
+			case <-tq.ctx.Done():
 				return
 			default:
 			}
-			tq.wg.Add(1)
-			err := tq.TaskStore.CheckAndMarkDeadTasks()
-			if err != nil {
+			if !tq.track() {
+				return
+			}
+			err := tq.TaskStore.CheckAndMarkDeadTasks(tq.ctx)
+			if err != nil && tq.ctx.Err() == nil {
 				tq.logger.Error("unable to check for dead tasks", "error", err.Error())
 			}
+			tq.stopCancelledTasks()
+			tq.reportTaskCounts()
 			tq.wg.Done()
-			time.Sleep(tq.pollInterval)
+			tq.sleep(tq.pollInterval)
 		}
 	}()
-	go tq.pollTasks()
 
-	<-tq.closeCh // block until closed
+	<-tq.ctx.Done() // block until closed
 }
 
+// Close cancels the context of every in-flight task, waits for the workers to return, and
+// closes the task store. Tasks whose handlers fail once their context is cancelled are released
+// back to the store without using up an attempt (see Releaser), so a deploy neither retries them
+// late nor sends them to the dead letter queue.
 func (tq *Runner) Close() error {
-	close(tq.closeCh)
+	// cancel under the lock so no new work can be tracked once Wait starts
+	tq.mu.Lock()
+	tq.cancel()
+	tq.mu.Unlock()
+
 	tq.wg.Wait()
 	return tq.TaskStore.Close()
 }
 
-func (tq *Runner) worker(id int) {
-	tq.logger.Debug(fmt.Sprintf("Worker %d started", id))
-	for task := range tq.taskCh {
-		tq.logger.Debug(fmt.Sprintf("Worker %d processing task %d", id, task.ID))
-		// can we just copy *task or will wg mess us up?
-		task.mu.Lock()
-		cpy := Task{
-			ID:       task.ID,
-			UserID:   task.UserID,
-			Status:   task.Status,
-			TaskType: task.TaskType,
-			Payload:  task.Payload,
-			Attempts: task.Attempts,
+// CancelTasks cancels the matching tasks in the task store and stops the ones this runner is
+// processing by cancelling their handler's context with ErrTaskCancelled as the cause.
+// Tasks cancelled through the store directly, or by another replica, are stopped the next time
+// the runner checks its in-flight tasks, once per poll interval.
+func (tq *Runner) CancelTasks(ctx context.Context, filter TaskFilter) ([]int, error) {
+	ids, err := tq.TaskStore.CancelTasks(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	for _, id := range ids {
+		if cancel, ok := tq.inFlight[id]; ok {
+			cancel(ErrTaskCancelled)
+		}
+	}
+	return ids, nil
+}
+
+// stopCancelledTasks looks up each in-flight task and stops the handlers of those that were cancelled.
+func (tq *Runner) stopCancelledTasks() {
+	tq.mu.Lock()
+	ids := make([]int, 0, len(tq.inFlight))
+	for id := range tq.inFlight {
+		ids = append(ids, id)
+	}
+	tq.mu.Unlock()
+
+	for _, id := range ids {
+		task, err := tq.TaskStore.GetTask(tq.ctx, id)
+		if err != nil {
+			if tq.ctx.Err() == nil {
+				tq.logger.Error("unable to check in-flight task", "task_id", id, "error", err.Error())
+			}
+			continue
+		}
+		if task.Status != "cancelled" {
+			continue
+		}
+
+		tq.mu.Lock()
+		if cancel, ok := tq.inFlight[id]; ok {
+			cancel(ErrTaskCancelled)
 		}
-		task.mu.Unlock()
+		tq.mu.Unlock()
+	}
+}
+
+// track adds a unit of in-flight work to the wait group. It returns false once the runner is
+// closing, in which case the caller must not start the work.
+func (tq *Runner) track() bool {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	if tq.ctx.Err() != nil {
+		return false
+	}
+	tq.wg.Add(1)
+	return true
+}
 
-		tq.wg.Add(1)
-		tq.processTask(cpy)
-		tq.wg.Done()
+// sleep waits for d or until the runner is closed, whichever comes first.
+func (tq *Runner) sleep(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-tq.ctx.Done():
+	case <-t.C:
+	}
+}
+
+// queuePool is the set of workers processing one queue, fed by a single poller.
+type queuePool struct {
+	queue  string
+	size   int
+	taskCh chan *Task
+	// busy counts workers that have been handed a task. The poller increments it before handing
+	// a task over and the worker decrements it when done, so the poller never fetches more tasks
+	// than there are idle workers to take them.
+	busy atomic.Int32
+	// freed is signalled when a worker finishes so a poller waiting on a full pool can fetch again
+	freed chan struct{}
+	// woken is signalled when a task is added to the queue in this process; see EnqueueNotifier
+	woken chan struct{}
+}
+
+func (p *queuePool) idle() int {
+	return p.size - int(p.busy.Load())
+}
 
+func (tq *Runner) worker(pool *queuePool, id int) {
+	tq.logger.Debug(fmt.Sprintf("Worker %d started", id), "queue", pool.queue)
+	for task := range pool.taskCh {
+		tq.logger.Debug(fmt.Sprintf("Worker %d processing task %d", id, task.ID), "queue", pool.queue)
+
+		if tq.track() {
+			metrics.TaskWorkersBusy.WithLabelValues(pool.queue).Inc()
+			tq.processTask(*task)
+			metrics.TaskWorkersBusy.WithLabelValues(pool.queue).Dec()
+			tq.wg.Done()
+		}
+		// when the runner is closing the task is skipped; it stays checked out and is picked up
+		// again once its checkout expires
+
+		pool.busy.Add(-1)
+		select {
+		case pool.freed <- struct{}{}:
+		default:
+		}
 	}
 }
 
 var ErrClosed = fmt.Errorf("runner closed")
 
-func (tq *Runner) pollTasks() {
+func (tq *Runner) pollTasks(pool *queuePool) {
 	defer func() {
 		// between checking for the closed channel and pushing a task, we could have closed the task channel.
 		// this should only have a chance to happen in testing during / server shutdown
@@ -126,75 +551,267 @@ func (tq *Runner) pollTasks() {
 				"panic_value", fmt.Sprintf("%v", r),
 				"component", "taskqueue",
 				"function", "pollTasks",
+				"queue", pool.queue,
 			)
 			// Panic recovery is appropriate here to prevent the entire runner from crashing
 			// The poller will continue to the next iteration
 		}
 	}()
 
+	tq.mu.Lock()
+	minDelay := min(tq.minPollInterval, tq.pollInterval)
+	tq.mu.Unlock()
+	delay := minDelay
+
 	for {
 		select {
-		case <-tq.closeCh:
+		case <-tq.ctx.Done():
 			return
 		default:
 
 		}
-		task, err := tq.TaskStore.FetchOpenTask()
+
+		idle := pool.idle()
+		if idle <= 0 {
+			// every worker is busy; wait for one to finish rather than checking out tasks nobody can take
+			select {
+			case <-pool.freed:
+			case <-tq.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		skipTypes, resumed := tq.beginFetch()
+		if resumed != nil {
+			// paused or draining; nothing is fetched until Resume
+			select {
+			case <-resumed:
+			case <-tq.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		found, err := tq.fetchTasks(pool, idle, skipTypes)
 		if err != nil {
-			if err == ErrClosed {
-				tq.logger.Info("runner closed, exit poller")
+			if err == ErrClosed || tq.ctx.Err() != nil {
+				tq.logger.Info("runner closed, exit poller", "queue", pool.queue)
 				return
 			}
-			tq.logger.Error("error fetching task", "error", err.Error())
-			time.Sleep(tq.pollInterval)
+			tq.logger.Error("error fetching task", "queue", pool.queue, "error", err.Error())
+			tq.sleep(tq.pollInterval)
 			continue
 		}
 
-		if task != nil {
-			tq.taskCh <- task
-		} else {
-			time.Sleep(tq.pollInterval)
+		if found == 0 {
+			if tq.waitForTasks(pool, delay) {
+				delay = minDelay
+			} else {
+				// back off while the queue stays empty
+				delay = min(delay*2, tq.pollInterval)
+			}
+			continue
+		}
+		delay = minDelay
+	}
+}
+
+// fetchTasks checks out up to n tasks on the pool's queue, leaving out skipTypes, and hands them
+// to the pool's workers. It ends the fetch started by beginFetch once every task is handed over.
+func (tq *Runner) fetchTasks(pool *queuePool, n int, skipTypes []string) (int, error) {
+	defer tq.endFetch()
+
+	var tasks []*Task
+	var err error
+	if skipper, ok := tq.TaskStore.(TypeSkipper); ok && len(skipTypes) > 0 {
+		tasks, err = skipper.FetchOpenTasksExcept(tq.ctx, pool.queue, n, skipTypes)
+	} else {
+		tasks, err = tq.TaskStore.FetchOpenTasks(tq.ctx, pool.queue, n)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for _, task := range tasks {
+		pool.busy.Add(1)
+		select {
+		case pool.taskCh <- task:
+		case <-tq.ctx.Done():
+			// the tasks stay checked out and are picked up again once their checkout expires
+			pool.busy.Add(-1)
+			return 0, ErrClosed
 		}
 	}
+	return len(tasks), nil
 }
 
 func (tq *Runner) processTask(task Task) {
-	logger := tq.logger.With("user_id", task.UserID, "task_type", task.TaskType, "task_id", task.ID, "attempts", task.Attempts)
-	
-	var processErr error
-	switch task.TaskType {
-	// TODO add some task types
-	case "some predefined task":
-		// Task processing logic would go here
-		// For now, this is a placeholder
-	default:
-		processErr = fmt.Errorf("unknown task type: %s", task.TaskType)
-		logger.Error("unknown task", "task_type", task.TaskType)
-		// Don't mark unknown tasks as complete - they should be handled separately
-		// Could implement retry logic or dead letter queue here
+	log := tq.logger.With("user_id", task.UserID, "task_type", task.TaskType, "task_id", task.ID, "queue", task.Queue, "attempts", task.Attempts)
+	taskCtx, span := startTaskSpan(tq.ctx, task)
+	defer span.End()
+	taskCtx, log = withTaskLogger(taskCtx, log, task)
+	observeStartDelay(task)
+	tq.trackUser(task.UserID, 1)
+	defer tq.trackUser(task.UserID, -1)
+
+	reg, ok := tq.registrationFor(task.TaskType)
+	if !ok {
+		// Nothing can process this task. Mark it dead so it shows up with the other dead tasks
+		// instead of being re-checked out until the retry limit catches up with it.
+		log.Error("unknown task", "task_type", task.TaskType)
+		reason := "no handler registered for task type"
+		recordOutcome(span, task, tq.markDead(context.WithoutCancel(taskCtx), task, reason, log), errors.New(reason))
 		return
 	}
 
-	// If task processing failed, log and return without marking complete
+	ctx, cancelTask := context.WithCancelCause(withLease(taskCtx, tq.TaskStore, task))
+	defer cancelTask(nil)
+	tq.mu.Lock()
+	tq.inFlight[task.ID] = cancelTask
+	tq.mu.Unlock()
+	defer func() {
+		tq.mu.Lock()
+		delete(tq.inFlight, task.ID)
+		tq.mu.Unlock()
+	}()
+
+	if reg.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, reg.timeout)
+		defer cancel()
+	}
+
+	// bookkeeping must be recorded even if the attempt's context was cancelled by a timeout or Close
+	storeCtx := context.WithoutCancel(ctx)
+
+	start := time.Now()
+	result, processErr := runHandler(ctx, reg.handler, task)
+	observeHandlerDuration(task, time.Since(start))
+	if errors.Is(context.Cause(ctx), ErrTaskCancelled) {
+		// the task is already marked cancelled; whatever the handler returned is discarded
+		log.Info("task cancelled", "component", "taskqueue")
+		recordOutcome(span, task, outcomeCancelled, nil)
+		return
+	}
+	if processErr != nil && tq.ctx.Err() != nil {
+		// the runner is closing; the attempt was interrupted rather than failed
+		recordOutcome(span, task, tq.release(storeCtx, task, log), processErr)
+		return
+	}
+	if processErr != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		// report the timeout rather than whatever the handler returned after its context was cancelled
+		processErr = kverr.New(fmt.Errorf("%w after %s", ErrTaskTimeout, reg.timeout), "timeout", reg.timeout.String())
+	}
 	if processErr != nil {
-		logger.Error("task processing failed",
-			"error", processErr.Error(),
-			"component", "taskqueue",
-		)
-		// Task will be retried on next poll if it's still in checked_out status
+		log = log.With("component", "taskqueue")
+		log = log.With(kverr.Args(processErr)...)
+		log.Error("task processing failed", "error", processErr.Error())
+
+		// a payload that can't be decoded won't decode on the next attempt either
+		if task.Attempts >= reg.maxAttempts || errors.Is(processErr, ErrInvalidPayload) {
+			recordOutcome(span, task, tq.markDead(storeCtx, task, processErr.Error(), log), processErr)
+			return
+		}
+
+		nextAttemptAt := time.Now().Add(reg.backoff.Next(task.Attempts))
+		if err := tq.TaskStore.FailTask(storeCtx, task.ID, task.LeaseToken, processErr.Error(), nextAttemptAt); err != nil {
+			log = log.With(kverr.Args(err)...)
+			if errors.Is(err, ErrLeaseLost) {
+				log.Warn("task lease lost, failed attempt discarded")
+				recordOutcome(span, task, outcomeLeaseLost, processErr)
+				return
+			}
+			log.Error("unable to record failed task attempt", "error", err.Error())
+			// the task stays checked out and is retried once its checkout expires
+		}
+		recordOutcome(span, task, outcomeRetry, processErr)
 		return
 	}
 
 	// Mark task as complete only if processing succeeded
-	err := tq.TaskStore.MarkTaskComplete(task.ID)
+	err := tq.TaskStore.MarkTaskComplete(storeCtx, task.ID, task.LeaseToken, result)
+	if errors.Is(err, ErrLeaseLost) {
+		// another worker checked the task out after our lease expired; its outcome wins
+		log.Warn("task lease lost, result discarded", "component", "taskqueue")
+		recordOutcome(span, task, outcomeLeaseLost, nil)
+		return
+	}
 	if err != nil {
 		// Use structured error logging with kverr context.
 		// kverr.Args returns key-value pairs that we spread into the logger.
-		logger = logger.With("component", "taskqueue")
-		logger = logger.With(kverr.Args(err)...)
-		logger.Error("unable to mark task complete", "error", err.Error())
+		log = log.With("component", "taskqueue")
+		log = log.With(kverr.Args(err)...)
+		log.Error("unable to mark task complete", "error", err.Error())
 		// This is a critical error - the task was processed but we can't mark it complete
 		// The task may be reprocessed, which could cause duplicate work
 		// Consider implementing idempotency checks in task processing
 	}
+	recordOutcome(span, task, outcomeComplete, nil)
+}
+
+// runHandler calls the handler and waits for it to return or for its deadline to pass. A handler that
+// ignores its context is abandoned at the deadline so it can't hold the worker forever; whatever it
+// returns later is discarded, and it can no longer report on the task since its lease is gone.
+// Cancellation and Close are left for the handler to honor, so Close still waits for handlers to return.
+func runHandler(ctx context.Context, handler HandlerFunc, task Task) (string, error) {
+	type handlerResult struct {
+		result string
+		err    error
+	}
+	done := make(chan handlerResult, 1)
+	go func() {
+		result, err := handler(ctx, task)
+		done <- handlerResult{result: result, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.result, r.err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", ctx.Err()
+		}
+	}
+	r := <-done
+	return r.result, r.err
+}
+
+// release hands the task back to the store without using up its attempt and returns the
+// attempt's outcome: outcomeReleased, or outcomeLeaseLost if another worker holds the task now.
+// Stores that can't release leave the task checked out until its checkout expires.
+func (tq *Runner) release(ctx context.Context, task Task, log *slog.Logger) string {
+	releaser, ok := tq.TaskStore.(Releaser)
+	if !ok {
+		log.Info("task interrupted by close, left for its checkout to expire")
+		return outcomeReleased
+	}
+	if err := releaser.ReleaseTask(ctx, task.ID, task.LeaseToken); err != nil {
+		log = log.With("component", "taskqueue")
+		log = log.With(kverr.Args(err)...)
+		if errors.Is(err, ErrLeaseLost) {
+			log.Warn("task lease lost, release discarded")
+			return outcomeLeaseLost
+		}
+		// the task stays checked out and is fetched again once its checkout expires
+		log.Error("unable to release interrupted task", "error", err.Error())
+		return outcomeReleased
+	}
+	log.Info("task interrupted by close, released")
+	return outcomeReleased
+}
+
+// markDead marks the task dead and returns the attempt's outcome: outcomeDead, or outcomeLeaseLost
+// if another worker holds the task now.
+func (tq *Runner) markDead(ctx context.Context, task Task, reason string, log *slog.Logger) string {
+	if err := tq.TaskStore.MarkTaskDead(ctx, task.ID, task.LeaseToken, reason); err != nil {
+		log = log.With("component", "taskqueue")
+		log = log.With(kverr.Args(err)...)
+		if errors.Is(err, ErrLeaseLost) {
+			log.Warn("task lease lost, not marked dead")
+			return outcomeLeaseLost
+		}
+		log.Error("unable to mark task dead", "error", err.Error())
+	}
+	return outcomeDead
 }
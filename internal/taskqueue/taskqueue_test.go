@@ -1,69 +1,48 @@
 package taskqueue
 
 import (
-	"bytes"
-	"database/sql"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql" // used if we are manually testing the queue against the db via unit tests
-	"github.com/sethgrid/helloworld/internal/db"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sethgrid/helloworld/logger"
+	"github.com/sethgrid/helloworld/logger/lockbuffer"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
-// queueInSQL will swap out the test friendly in-memory queue to use local mysql.
-// i didn't want to spend time setting this up as an integration test yet. Can
-// run tests manually with this set to true if any changes are made
-var queueInSQL = false
-
+// TestTaskQueue exercises the runner; store behavior is covered by the taskqueuetest conformance suite.
 func TestTaskQueue(t *testing.T) {
 	var err error
-	var buf bytes.Buffer
 	var q Tasker
 
-	log := logger.New(&buf)
+	buf := lockbuffer.NewLockBuffer()
+	log := logger.New(buf)
 	retries := 3
 	workersCount := 3
 
 	itemExpiration := 500 * time.Millisecond
 	pollInterval := 100 * time.Millisecond
 
-	if queueInSQL {
-		dsn := "testuser:testuser@tcp(127.0.0.1:3306)/helloworld?parseTime=true"
-		sqlDB, err := sql.Open("mysql", dsn)
-		if err != nil {
-			t.Fatal(err)
-		}
-		if err = sqlDB.Ping(); err != nil {
-			t.Fatal(err)
-		}
-
-		// Create db manager from the connection
-		// For testing, we'll create a manager with the same DSN for reader/writer
-		dbManager, err := db.NewManager("", dsn, "", log)
-		if err != nil {
-			t.Fatal(err)
-		}
-		// Configure pool settings
-		dbManager.ConfigurePool(10, 5, 3*time.Minute, 3*time.Minute)
-
-		// give sql more time
-		itemExpiration *= 3
-		pollInterval *= 3
-
-		q = NewMySQLTaskQueue(dbManager, log, retries, itemExpiration)
-	} else {
-		q = NewInMemoryTaskQueue(retries, itemExpiration, log)
-	}
+	q = NewInMemoryTaskQueue(retries, itemExpiration, log)
 
 	runner := NewRunner(q, workersCount, log, pollInterval)
 	go runner.Start()
 
 	userA := 1
-	_, err = q.AddTask(userA, "use some pre-defined task type", "some payload")
+	_, err = q.AddTask(context.Background(), userA, "use some pre-defined task type", "some payload")
 	assert.NoError(t, err)
 
 	// give the task time to do its thing. gross to sleep in tests.
@@ -78,6 +57,973 @@ func TestTaskQueue(t *testing.T) {
 	assertLogged(t, buf.String(), `"msg":"unknown task"`, `"task_type":"use some pre-defined task type"`)
 }
 
+func TestRunnerRegisteredHandler(t *testing.T) {
+	buf := lockbuffer.NewLockBuffer()
+	log := logger.New(buf)
+	q := NewInMemoryTaskQueue(3, 500*time.Millisecond, log)
+
+	handled := make(chan Task, 1)
+	runner := NewRunner(q, 1, log, 10*time.Millisecond)
+	runner.Register("greet", func(ctx context.Context, task Task) (string, error) {
+		handled <- task
+		return "hello " + task.Payload, nil
+	})
+	go runner.Start()
+	defer runner.Close()
+
+	id, err := q.AddTask(context.Background(), 1, "greet", "hi")
+	assert.NoError(t, err)
+
+	select {
+	case task := <-handled:
+		assert.Equal(t, id, task.ID)
+		assert.Equal(t, "hi", task.Payload)
+	case <-time.After(time.Second):
+		t.Fatal("handler was not called")
+	}
+	waitForStatus(t, q, id, "complete", time.Second)
+
+	task, err := q.GetTask(context.Background(), id)
+	require.NoError(t, err)
+	assert.Equal(t, "hello hi", task.Result)
+
+	_, err = q.GetTask(context.Background(), id+1)
+	assert.ErrorIs(t, err, ErrTaskNotFound)
+}
+
+func TestRunnerMaxAttempts(t *testing.T) {
+	buf := lockbuffer.NewLockBuffer()
+	log := logger.New(buf)
+	q := NewInMemoryTaskQueue(10, 500*time.Millisecond, log)
+
+	runner := NewRunner(q, 1, log, 10*time.Millisecond)
+	runner.Register("flaky", func(ctx context.Context, task Task) (string, error) {
+		return "", errors.New("nope")
+	}, WithMaxAttempts(2), WithBackoff(FixedBackoff{Delay: 10 * time.Millisecond}))
+	go runner.Start()
+	defer runner.Close()
+
+	id, err := q.AddTask(context.Background(), 1, "flaky", "")
+	assert.NoError(t, err)
+
+	waitForStatus(t, q, id, "dead", time.Second)
+	assertLogged(t, buf.String(), `"msg":"dead task"`, `"reason":"nope"`)
+}
+
+// TestRunnerMaxAttemptsExpiredCheckout checks that the store's sweep for expired checkouts gives
+// up after the attempts registered for the task type rather than the store's retry limit.
+func TestRunnerMaxAttemptsExpiredCheckout(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	q := NewInMemoryTaskQueue(3, 10*time.Millisecond, log)
+
+	runner := NewRunner(q, 1, log, 10*time.Millisecond)
+	noop := func(ctx context.Context, task Task) (string, error) { return "", nil }
+	runner.Register("once", noop, WithMaxAttempts(1))
+	runner.Register("patient", noop, WithMaxAttempts(5))
+
+	onceID, err := q.AddTask(ctx, 1, "once", "")
+	require.NoError(t, err)
+	patientID, err := q.AddTask(ctx, 1, "patient", "")
+	require.NoError(t, err)
+	// the worker holding them "crashes": the checkouts expire without an outcome
+	tasks, err := q.FetchOpenTasks(ctx, DefaultQueue, 2)
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, q.CheckAndMarkDeadTasks(ctx))
+
+	task, err := q.GetTask(ctx, onceID)
+	require.NoError(t, err)
+	assert.Equal(t, "dead", task.Status)
+	assert.Equal(t, 1, task.Attempts, "one attempt, though the store's retry limit is 3")
+	task, err = q.GetTask(ctx, patientID)
+	require.NoError(t, err)
+	assert.Equal(t, "checked_out", task.Status)
+	assert.Equal(t, 1, task.Attempts)
+
+	// at the store's retry limit, the patient type still has attempts left
+	for range 2 {
+		_, err := q.FetchOpenTasks(ctx, DefaultQueue, 1)
+		require.NoError(t, err)
+		time.Sleep(20 * time.Millisecond)
+		require.NoError(t, q.CheckAndMarkDeadTasks(ctx))
+	}
+	task, err = q.GetTask(ctx, patientID)
+	require.NoError(t, err)
+	assert.Equal(t, "checked_out", task.Status)
+	assert.Equal(t, 3, task.Attempts)
+}
+
+// TestRunnerDoesNotRefetchLastAttempt checks that a poller doesn't run a task again after a
+// checkout on its last attempt expires, before the sweep for dead tasks gets to it.
+func TestRunnerDoesNotRefetchLastAttempt(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	q := NewInMemoryTaskQueue(3, 100*time.Millisecond, log)
+
+	// the sweep runs once on Start and then hourly, while the poller polls from every 10ms
+	runner := NewRunner(q, 1, log, time.Hour)
+	runner.SetMinPollInterval(10 * time.Millisecond)
+	var mu sync.Mutex
+	ran := make(map[string]int)
+	handler := func(ctx context.Context, task Task) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran[task.TaskType]++
+		return "", nil
+	}
+	runner.Register("once", handler, WithMaxAttempts(1))
+	runner.Register("twice", handler, WithMaxAttempts(2))
+
+	onceID, err := q.AddTask(ctx, 1, "once", "")
+	require.NoError(t, err)
+	twiceID, err := q.AddTask(ctx, 1, "twice", "")
+	require.NoError(t, err)
+	// a worker that then crashes checks both out, using their first attempt
+	tasks, err := q.FetchOpenTasks(ctx, DefaultQueue, 2)
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+
+	go runner.Start()
+	defer runner.Close()
+
+	// the task with an attempt left runs again once its checkout expires
+	waitForStatus(t, q, twiceID, "complete", 2*time.Second)
+	task, err := q.GetTask(ctx, onceID)
+	require.NoError(t, err)
+	assert.Equal(t, "checked_out", task.Status)
+	assert.Equal(t, 1, task.Attempts)
+	mu.Lock()
+	assert.Equal(t, map[string]int{"twice": 1}, ran)
+	mu.Unlock()
+
+	require.NoError(t, q.CheckAndMarkDeadTasks(ctx))
+	waitForStatus(t, q, onceID, "dead", time.Second)
+}
+
+func TestRunnerRetriesAfterBackoff(t *testing.T) {
+	buf := lockbuffer.NewLockBuffer()
+	log := logger.New(buf)
+	q := NewInMemoryTaskQueue(10, 500*time.Millisecond, log)
+
+	backoff := 100 * time.Millisecond
+	var attemptTimes []time.Time
+	runner := NewRunner(q, 1, log, 10*time.Millisecond)
+	runner.Register("flaky", func(ctx context.Context, task Task) (string, error) {
+		attemptTimes = append(attemptTimes, time.Now())
+		if task.Attempts == 1 {
+			return "", errors.New("first attempt fails")
+		}
+		return "", nil
+	}, WithBackoff(FixedBackoff{Delay: backoff}))
+	go runner.Start()
+	defer runner.Close()
+
+	id, err := q.AddTask(context.Background(), 1, "flaky", "")
+	assert.NoError(t, err)
+
+	waitForStatus(t, q, id, "complete", time.Second)
+	q.mu.Lock()
+	assert.Equal(t, "first attempt fails", q.tasks[id].LastError)
+	assert.Equal(t, 2, q.tasks[id].Attempts)
+	q.mu.Unlock()
+	// a single worker runs the attempts, so reading attemptTimes here does not race
+	if assert.Len(t, attemptTimes, 2) {
+		assert.GreaterOrEqual(t, attemptTimes[1].Sub(attemptTimes[0]), backoff)
+	}
+}
+
+func TestRunnerUnregisteredTaskIsDead(t *testing.T) {
+	buf := lockbuffer.NewLockBuffer()
+	log := logger.New(buf)
+	q := NewInMemoryTaskQueue(3, 500*time.Millisecond, log)
+
+	runner := NewRunner(q, 1, log, 10*time.Millisecond)
+	go runner.Start()
+	defer runner.Close()
+
+	id, err := q.AddTask(context.Background(), 1, "nobody handles this", "")
+	assert.NoError(t, err)
+
+	waitForStatus(t, q, id, "dead", time.Second)
+}
+
+func TestRunnerHandleUnregistered(t *testing.T) {
+	buf := lockbuffer.NewLockBuffer()
+	log := logger.New(buf)
+	q := NewInMemoryTaskQueue(3, 500*time.Millisecond, log)
+
+	runner := NewRunner(q, 1, log, 10*time.Millisecond)
+	runner.HandleUnregistered(func(ctx context.Context, task Task) (string, error) {
+		return "", nil
+	})
+	go runner.Start()
+	defer runner.Close()
+
+	id, err := q.AddTask(context.Background(), 1, "nobody handles this", "")
+	assert.NoError(t, err)
+
+	waitForStatus(t, q, id, "complete", time.Second)
+}
+
+func TestRunnerCloseCancelsTaskContext(t *testing.T) {
+	buf := lockbuffer.NewLockBuffer()
+	log := logger.New(buf)
+	q := NewInMemoryTaskQueue(3, 500*time.Millisecond, log)
+
+	started := make(chan struct{})
+	runner := NewRunner(q, 1, log, 10*time.Millisecond)
+	runner.Register("long", func(ctx context.Context, task Task) (string, error) {
+		close(started)
+		logger.FromCtx(ctx).Info("long task waiting")
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+	go runner.Start()
+
+	_, err := q.AddTask(context.Background(), 1, "long", "")
+	assert.NoError(t, err)
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("handler was not called")
+	}
+
+	// Close waits on in-flight work, so it only returns if the handler saw its context cancelled
+	assert.NoError(t, runner.Close())
+	assertLogged(t, buf.String(), `"msg":"long task waiting"`, `"task_type":"long"`)
+}
+
+func TestRunnerCloseReleasesInterruptedTask(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	// Close closes the task store, and the file store keeps its tasks for the next process
+	path := filepath.Join(t.TempDir(), "tasks.log")
+	q, err := NewFileTaskQueue(path, 3, time.Minute, log)
+	require.NoError(t, err)
+
+	started := make(chan struct{})
+	runner := NewRunner(q, 1, log, 10*time.Millisecond)
+	runner.Register("once", func(ctx context.Context, task Task) (string, error) {
+		close(started)
+		<-ctx.Done()
+		return "", ctx.Err()
+	}, WithMaxAttempts(1))
+	go runner.Start()
+
+	id, err := q.AddTask(ctx, 1, "once", "")
+	require.NoError(t, err)
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("handler was not called")
+	}
+	require.NoError(t, runner.Close())
+
+	// the last attempt was interrupted, not failed: the task is open again with its attempt back
+	q, err = NewFileTaskQueue(path, 3, time.Minute, log)
+	require.NoError(t, err)
+	defer q.Close()
+	task, err := q.GetTask(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "open", task.Status)
+	assert.Equal(t, 0, task.Attempts)
+	assert.Empty(t, task.LastError)
+}
+
+func TestRunnerTimeout(t *testing.T) {
+	// hung ignores its context until the test is over
+	hung := make(chan struct{})
+	t.Cleanup(func() { close(hung) })
+
+	tests := []struct {
+		name           string
+		defaultTimeout time.Duration
+		// handler is registered for "slow" tasks and must outlive the 50ms timeout
+		handler HandlerFunc
+		opts    []HandlerOption
+	}{
+		{
+			name:           "handler honors its context",
+			defaultTimeout: 50 * time.Millisecond,
+			handler: func(ctx context.Context, task Task) (string, error) {
+				<-ctx.Done()
+				return "", ctx.Err()
+			},
+		},
+		{
+			name:           "hung handler is abandoned",
+			defaultTimeout: 50 * time.Millisecond,
+			handler: func(ctx context.Context, task Task) (string, error) {
+				<-hung
+				return "", nil
+			},
+		},
+		{
+			name:           "type timeout overrides the default",
+			defaultTimeout: time.Hour,
+			handler: func(ctx context.Context, task Task) (string, error) {
+				<-ctx.Done()
+				return "", ctx.Err()
+			},
+			opts: []HandlerOption{WithTimeout(50 * time.Millisecond)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			log := logger.New(lockbuffer.NewLockBuffer())
+			q := NewInMemoryTaskQueue(3, time.Minute, log)
+
+			runner := NewRunner(q, 1, log, 10*time.Millisecond)
+			runner.SetDefaultTimeout(tt.defaultTimeout)
+			opts := append([]HandlerOption{WithBackoff(FixedBackoff{Delay: time.Hour})}, tt.opts...)
+			runner.Register("slow", tt.handler, opts...)
+			runner.Register("quick", func(ctx context.Context, task Task) (string, error) {
+				return "", nil
+			})
+			go runner.Start()
+			defer runner.Close()
+
+			slowID, err := q.AddTask(ctx, 1, "slow", "")
+			require.NoError(t, err)
+			quickID, err := q.AddTask(ctx, 1, "quick", "")
+			require.NoError(t, err)
+
+			// the single worker is freed by the timeout and moves on to the next task
+			waitForStatus(t, q, quickID, "complete", time.Second)
+			task, err := q.GetTask(ctx, slowID)
+			require.NoError(t, err)
+			assert.Equal(t, "open", task.Status, "a timed out attempt is retried")
+			assert.Equal(t, "task timed out after 50ms", task.LastError)
+		})
+	}
+}
+
+func TestDelayedTask(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(lockbuffer.NewLockBuffer())
+	q := NewInMemoryTaskQueue(3, 500*time.Millisecond, log)
+
+	delayedID, err := q.AddTask(ctx, 1, "later", "", RunAfter(100*time.Millisecond))
+	assert.NoError(t, err)
+	_, err = q.AddTask(ctx, 1, "past", "", RunAt(time.Now().Add(-time.Minute)))
+	assert.NoError(t, err)
+
+	task, err := q.FetchOpenTask(ctx, DefaultQueue)
+	assert.NoError(t, err)
+	if assert.NotNil(t, task) {
+		assert.Equal(t, "past", task.TaskType)
+	}
+
+	task, err = q.FetchOpenTask(ctx, DefaultQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, task, "delayed task should not be fetched before its run-at time")
+
+	time.Sleep(100 * time.Millisecond)
+	task, err = q.FetchOpenTask(ctx, DefaultQueue)
+	assert.NoError(t, err)
+	if assert.NotNil(t, task) {
+		assert.Equal(t, delayedID, task.ID)
+	}
+}
+
+func TestFetchOpenTaskPriority(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(lockbuffer.NewLockBuffer())
+	q := NewInMemoryTaskQueue(3, 500*time.Millisecond, log)
+
+	enqueued := []struct {
+		taskType string
+		opts     []EnqueueOption
+	}{
+		{"low", []EnqueueOption{WithPriority(-1)}},
+		{"normal first", nil},
+		{"bulk", []EnqueueOption{OnQueue("bulk"), WithPriority(10)}},
+		{"urgent", []EnqueueOption{WithPriority(5)}},
+		{"normal second", nil},
+	}
+	for _, e := range enqueued {
+		_, err := q.AddTask(ctx, 1, e.taskType, "", e.opts...)
+		require.NoError(t, err)
+	}
+
+	var got []string
+	for {
+		task, err := q.FetchOpenTask(ctx, DefaultQueue)
+		require.NoError(t, err)
+		if task == nil {
+			break
+		}
+		assert.Equal(t, DefaultQueue, task.Queue)
+		got = append(got, task.TaskType)
+	}
+	assert.Equal(t, []string{"urgent", "normal first", "normal second", "low"}, got)
+
+	task, err := q.FetchOpenTask(ctx, "bulk")
+	require.NoError(t, err)
+	if assert.NotNil(t, task) {
+		assert.Equal(t, "bulk", task.TaskType)
+		assert.Equal(t, 10, task.Priority)
+	}
+}
+
+func TestRunnerQueueWorkers(t *testing.T) {
+	log := logger.New(lockbuffer.NewLockBuffer())
+	q := NewInMemoryTaskQueue(3, 500*time.Millisecond, log)
+
+	// the default pool is blocked by a slow task; the bulk pool still makes progress
+	release := make(chan struct{})
+	runner := NewRunner(q, 1, log, 10*time.Millisecond)
+	runner.SetQueueWorkers("bulk", 1)
+	runner.Register("slow", func(ctx context.Context, task Task) (string, error) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return "", nil
+	})
+	runner.Register("quick", func(ctx context.Context, task Task) (string, error) {
+		return "", nil
+	})
+	go runner.Start()
+	defer runner.Close()
+	defer close(release)
+
+	slowID, err := q.AddTask(context.Background(), 1, "slow", "")
+	require.NoError(t, err)
+	waitForStatus(t, q, slowID, "checked_out", time.Second)
+
+	bulkID, err := q.AddTask(context.Background(), 1, "quick", "", OnQueue("bulk"))
+	require.NoError(t, err)
+	waitForStatus(t, q, bulkID, "complete", time.Second)
+
+	// with its only worker busy, the default queue does not check out more work
+	defaultID, err := q.AddTask(context.Background(), 1, "quick", "")
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	q.mu.Lock()
+	assert.Equal(t, "open", q.tasks[defaultID].Status)
+	q.mu.Unlock()
+}
+
+func TestFetchOpenTasks(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(lockbuffer.NewLockBuffer())
+	q := NewInMemoryTaskQueue(3, 500*time.Millisecond, log)
+
+	for i := 0; i < 5; i++ {
+		_, err := q.AddTask(ctx, 1, "batch", "", WithPriority(i%2))
+		require.NoError(t, err)
+	}
+
+	tasks, err := q.FetchOpenTasks(ctx, DefaultQueue, 3)
+	require.NoError(t, err)
+	var ids []int
+	for _, task := range tasks {
+		assert.Equal(t, "checked_out", task.Status)
+		assert.Equal(t, 1, task.Attempts)
+		ids = append(ids, task.ID)
+	}
+	assert.Equal(t, []int{2, 4, 1}, ids, "priority 1 tasks first, then oldest")
+
+	tasks, err = q.FetchOpenTasks(ctx, DefaultQueue, 3)
+	require.NoError(t, err)
+	assert.Len(t, tasks, 2, "checked out tasks are not handed out again")
+
+	tasks, err = q.FetchOpenTasks(ctx, DefaultQueue, 3)
+	require.NoError(t, err)
+	assert.Empty(t, tasks)
+}
+
+func TestAddTaskDedup(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(lockbuffer.NewLockBuffer())
+	q := NewInMemoryTaskQueue(3, 500*time.Millisecond, log)
+
+	first, err := q.AddTask(ctx, 1, "charge", "", WithDedupKey("order-1", 100*time.Millisecond))
+	require.NoError(t, err)
+
+	again, err := q.AddTask(ctx, 1, "charge", "", WithDedupKey("order-1", 100*time.Millisecond))
+	require.NoError(t, err)
+	assert.Equal(t, first, again, "same key within the window returns the existing task")
+
+	other, err := q.AddTask(ctx, 1, "charge", "", WithDedupKey("order-2", 100*time.Millisecond))
+	require.NoError(t, err)
+	assert.NotEqual(t, first, other)
+
+	undeduped, err := q.AddTask(ctx, 1, "charge", "")
+	require.NoError(t, err)
+	assert.NotEqual(t, first, undeduped)
+
+	time.Sleep(100 * time.Millisecond)
+	afterWindow, err := q.AddTask(ctx, 1, "charge", "", WithDedupKey("order-1", 100*time.Millisecond))
+	require.NoError(t, err)
+	assert.NotEqual(t, first, afterWindow, "an expired key adds a new task")
+
+	forever, err := q.AddTask(ctx, 1, "charge", "", WithDedupKey("order-3", 0))
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	foreverAgain, err := q.AddTask(ctx, 1, "charge", "", WithDedupKey("order-3", 0))
+	require.NoError(t, err)
+	assert.Equal(t, forever, foreverAgain, "a zero window never expires")
+}
+
+func TestInMemoryAddTaskTx(t *testing.T) {
+	ctx := context.Background()
+	q := NewInMemoryTaskQueue(3, time.Minute, logger.New(io.Discard))
+
+	// the in-memory queue has no transaction to join; the task is added right away
+	id, err := q.AddTaskTx(ctx, nil, 1, "welcome", "{}", WithDedupKey("welcome-1", 0))
+	require.NoError(t, err)
+	again, err := q.AddTaskTx(ctx, nil, 1, "welcome", "{}", WithDedupKey("welcome-1", 0))
+	require.NoError(t, err)
+	assert.Equal(t, id, again)
+
+	task, err := q.FetchOpenTask(ctx, DefaultQueue)
+	require.NoError(t, err)
+	require.NotNil(t, task)
+	assert.Equal(t, id, task.ID)
+}
+
+func TestStaleLeaseIsRejected(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(lockbuffer.NewLockBuffer())
+	q := NewInMemoryTaskQueue(3, 50*time.Millisecond, log)
+
+	id, err := q.AddTask(ctx, 1, "slow", "")
+	require.NoError(t, err)
+
+	zombie, err := q.FetchOpenTask(ctx, DefaultQueue)
+	require.NoError(t, err)
+	require.NotNil(t, zombie)
+	assert.NotEmpty(t, zombie.LeaseToken)
+
+	// the lease runs out and another worker checks the task out
+	time.Sleep(60 * time.Millisecond)
+	current, err := q.FetchOpenTask(ctx, DefaultQueue)
+	require.NoError(t, err)
+	require.NotNil(t, current)
+	assert.Equal(t, id, current.ID)
+	assert.NotEqual(t, zombie.LeaseToken, current.LeaseToken)
+
+	_, err = q.ExtendLease(ctx, id, zombie.LeaseToken, 0)
+	assert.ErrorIs(t, err, ErrLeaseLost)
+	assert.ErrorIs(t, q.FailTask(ctx, id, zombie.LeaseToken, "late", time.Now()), ErrLeaseLost)
+	assert.ErrorIs(t, q.MarkTaskComplete(ctx, id, zombie.LeaseToken, "zombie"), ErrLeaseLost)
+
+	require.NoError(t, q.MarkTaskComplete(ctx, id, current.LeaseToken, "current"))
+	task, err := q.GetTask(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "current", task.Result)
+
+	// once complete, even the winning token is stale
+	assert.ErrorIs(t, q.MarkTaskDead(ctx, id, current.LeaseToken, "late"), ErrLeaseLost)
+}
+
+func TestHeartbeatKeepsLease(t *testing.T) {
+	log := logger.New(lockbuffer.NewLockBuffer())
+	q := NewInMemoryTaskQueue(3, 50*time.Millisecond, log)
+
+	var mu sync.Mutex
+	calls := 0
+	// a second idle worker would pick the task up again if its lease ran out
+	runner := NewRunner(q, 2, log, 10*time.Millisecond)
+	runner.Register("long", func(ctx context.Context, task Task) (string, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		for i := 0; i < 6; i++ {
+			time.Sleep(25 * time.Millisecond)
+			if err := Heartbeat(ctx); err != nil {
+				return "", err
+			}
+		}
+		return "done", nil
+	})
+	go runner.Start()
+	defer runner.Close()
+
+	id, err := q.AddTask(context.Background(), 1, "long", "")
+	require.NoError(t, err)
+
+	waitForStatus(t, q, id, "complete", time.Second)
+	mu.Lock()
+	assert.Equal(t, 1, calls)
+	mu.Unlock()
+
+	assert.Error(t, Heartbeat(context.Background()), "heartbeat needs a task context")
+}
+
+func TestCancelTasks(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(lockbuffer.NewLockBuffer())
+	q := NewInMemoryTaskQueue(3, 500*time.Millisecond, log)
+
+	running, err := q.AddTask(ctx, 1, "report", "")
+	require.NoError(t, err)
+	checkedOut, err := q.FetchOpenTask(ctx, DefaultQueue)
+	require.NoError(t, err)
+	require.Equal(t, running, checkedOut.ID)
+
+	open, err := q.AddTask(ctx, 1, "report", "")
+	require.NoError(t, err)
+	otherUser, err := q.AddTask(ctx, 2, "report", "")
+	require.NoError(t, err)
+	done, err := q.AddTask(ctx, 1, "report", "")
+	require.NoError(t, err)
+	q.mu.Lock()
+	q.tasks[done].Status = "complete"
+	q.mu.Unlock()
+
+	ids, err := q.CancelTasks(ctx, TaskFilter{UserID: 1, Statuses: []string{"open"}})
+	require.NoError(t, err)
+	assert.Equal(t, []int{open}, ids)
+
+	ids, err = q.CancelTasks(ctx, TaskFilter{UserID: 1})
+	require.NoError(t, err)
+	assert.Equal(t, []int{running}, ids, "finished and already cancelled tasks are left alone")
+
+	for id, want := range map[int]string{running: "cancelled", open: "cancelled", otherUser: "open", done: "complete"} {
+		task, err := q.GetTask(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, want, task.Status, "task %d", id)
+	}
+
+	// the worker holding the cancelled checkout can no longer report on it
+	assert.ErrorIs(t, q.MarkTaskComplete(ctx, running, checkedOut.LeaseToken, ""), ErrLeaseLost)
+
+	task, err := q.FetchOpenTask(ctx, DefaultQueue)
+	require.NoError(t, err)
+	if assert.NotNil(t, task) {
+		assert.Equal(t, otherUser, task.ID)
+	}
+}
+
+func TestDeadTasksUpdatedBefore(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(lockbuffer.NewLockBuffer())
+	q := NewInMemoryTaskQueue(3, time.Minute, log)
+
+	// created long ago but only just killed
+	recent, err := q.AddTask(ctx, 1, "report", "")
+	require.NoError(t, err)
+	q.mu.Lock()
+	q.tasks[recent].CreatedAt = time.Now().Add(-48 * time.Hour)
+	q.mu.Unlock()
+	require.NoError(t, q.MarkTaskDead(ctx, recent, "", "gave up"))
+
+	old, err := q.AddTask(ctx, 1, "report", "")
+	require.NoError(t, err)
+	require.NoError(t, q.MarkTaskDead(ctx, old, "", "gave up"))
+	q.mu.Lock()
+	q.tasks[old].UpdatedAt = time.Now().Add(-2 * time.Hour)
+	q.mu.Unlock()
+
+	filter := TaskFilter{UpdatedBefore: time.Now().Add(-time.Hour)}
+	tasks, err := q.ListDeadTasks(ctx, filter)
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	assert.Equal(t, old, tasks[0].ID)
+
+	purged, err := q.PurgeDeadTasks(ctx, filter)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	_, err = q.GetTask(ctx, recent)
+	assert.NoError(t, err, "a task dead for less than the age is kept")
+}
+
+func TestRunnerCancelStopsHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		// cancel cancels the task with the given ID, either through the runner or behind its back
+		cancel func(ctx context.Context, runner *Runner, q *InMemoryTaskQueue, id int) error
+	}{
+		{
+			name: "through the runner",
+			cancel: func(ctx context.Context, runner *Runner, q *InMemoryTaskQueue, id int) error {
+				_, err := runner.CancelTasks(ctx, TaskFilter{IDs: []int{id}})
+				return err
+			},
+		},
+		{
+			name: "in the store, e.g. from another replica",
+			cancel: func(ctx context.Context, runner *Runner, q *InMemoryTaskQueue, id int) error {
+				_, err := q.CancelTasks(ctx, TaskFilter{IDs: []int{id}})
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := lockbuffer.NewLockBuffer()
+			log := logger.New(buf)
+			q := NewInMemoryTaskQueue(3, time.Second, log)
+
+			started := make(chan struct{})
+			stopped := make(chan error, 1)
+			runner := NewRunner(q, 1, log, 10*time.Millisecond)
+			runner.Register("long", func(ctx context.Context, task Task) (string, error) {
+				close(started)
+				<-ctx.Done()
+				stopped <- context.Cause(ctx)
+				return "", ctx.Err()
+			})
+			go runner.Start()
+			defer runner.Close()
+
+			id, err := q.AddTask(context.Background(), 1, "long", "")
+			require.NoError(t, err)
+			select {
+			case <-started:
+			case <-time.After(time.Second):
+				t.Fatal("handler was not called")
+			}
+
+			require.NoError(t, tt.cancel(context.Background(), runner, q, id))
+
+			select {
+			case cause := <-stopped:
+				assert.ErrorIs(t, cause, ErrTaskCancelled)
+			case <-time.After(time.Second):
+				t.Fatal("handler was not stopped")
+			}
+			waitForStatus(t, q, id, "cancelled", time.Second)
+		})
+	}
+}
+
+// waitForStatus polls the in-memory queue until the task reaches the given status.
+func TestRunnerSweepsFinishedTasks(t *testing.T) {
+	ctx := context.Background()
+	buf := lockbuffer.NewLockBuffer()
+	log := logger.New(buf)
+	q := NewInMemoryTaskQueue(3, time.Minute, log)
+
+	var ids []int
+	for _, status := range []string{"complete", "dead", "cancelled"} {
+		id, err := q.AddTask(ctx, 1, "report", "")
+		require.NoError(t, err)
+		ids = append(ids, id)
+		q.mu.Lock()
+		q.tasks[id].Status = status
+		q.tasks[id].UpdatedAt = time.Now().Add(-2 * time.Hour)
+		q.mu.Unlock()
+	}
+	recentID, err := q.AddTask(ctx, 1, "report", "")
+	require.NoError(t, err)
+	require.NoError(t, q.MarkTaskDead(ctx, recentID, "", "gave up"))
+
+	runner := NewRunner(q, 1, log, 10*time.Millisecond)
+	runner.SetRetention(RetentionPolicy{
+		Keep:     map[string]time.Duration{"complete": time.Hour, "dead": time.Hour},
+		Interval: 10 * time.Millisecond,
+	})
+	go runner.Start()
+	defer runner.Close()
+
+	require.Eventually(t, func() bool {
+		_, errComplete := q.GetTask(ctx, ids[0])
+		_, errDead := q.GetTask(ctx, ids[1])
+		return errors.Is(errComplete, ErrTaskNotFound) && errors.Is(errDead, ErrTaskNotFound)
+	}, time.Second, 10*time.Millisecond)
+
+	// cancelled tasks have no retention so they are kept, as are dead tasks younger than an hour
+	for _, id := range []int{ids[2], recentID} {
+		_, err := q.GetTask(ctx, id)
+		assert.NoError(t, err)
+	}
+	assertLogged(t, buf.String(), `"msg":"swept tasks"`, `"status":"dead"`, `"count":1`)
+	assert.Contains(t, scrapeMetrics(t), `taskqueue_tasks_swept_total{status="complete"}`)
+}
+
+// spanRecorder collects ended spans.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (r *spanRecorder) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+func (r *spanRecorder) Shutdown(context.Context) error                  { return nil }
+func (r *spanRecorder) ForceFlush(context.Context) error                { return nil }
+func (r *spanRecorder) OnEnd(s sdktrace.ReadOnlySpan) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+func (r *spanRecorder) ended(name string) sdktrace.ReadOnlySpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.spans {
+		if s.Name() == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestTaskTraceAndRequestID(t *testing.T) {
+	recorder := &spanRecorder{}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	buf := lockbuffer.NewLockBuffer()
+	log := logger.New(buf)
+	q := NewInMemoryTaskQueue(3, time.Minute, log)
+
+	// enqueue from what a request handler's context looks like after otelchi and logger.Middleware
+	reqCtx, reqSpan := tp.Tracer("test").Start(context.Background(), "GET /export")
+	reqCtx = logger.AddRequestIDToCtx(reqCtx, "rid-123")
+	id, err := q.AddTask(reqCtx, 1, "export", "{}")
+	require.NoError(t, err)
+	reqSpan.End()
+	reqSC := reqSpan.SpanContext()
+
+	task, err := q.GetTask(context.Background(), id)
+	require.NoError(t, err)
+	assert.Equal(t, "rid-123", task.RequestID)
+	assert.Equal(t, fmt.Sprintf("00-%s-%s-01", reqSC.TraceID(), reqSC.SpanID()), task.TraceParent)
+
+	handlerRID := make(chan string, 1)
+	runner := NewRunner(q, 1, log, 10*time.Millisecond)
+	runner.Register("export", func(ctx context.Context, task Task) (string, error) {
+		handlerRID <- logger.RequestIDFromCtx(ctx)
+		logger.FromCtx(ctx).Info("exporting")
+		return "", nil
+	})
+	go runner.Start()
+	defer runner.Close()
+
+	waitForStatus(t, q, id, "complete", time.Second)
+	assert.Equal(t, "rid-123", <-handlerRID, "tasks enqueued by the handler keep the rid")
+
+	var span sdktrace.ReadOnlySpan
+	require.Eventually(t, func() bool {
+		span = recorder.ended("task export")
+		return span != nil
+	}, time.Second, 10*time.Millisecond)
+	assert.NotEqual(t, reqSC.TraceID(), span.SpanContext().TraceID(), "the task starts its own trace")
+	require.Len(t, span.Links(), 1)
+	assert.Equal(t, reqSC.TraceID(), span.Links()[0].SpanContext.TraceID())
+	assert.Equal(t, reqSC.SpanID(), span.Links()[0].SpanContext.SpanID())
+	assert.Contains(t, span.Attributes(), attribute.String("task.outcome", "complete"))
+
+	assertLogged(t, buf.String(), `"msg":"exporting"`, `"rid":"rid-123"`, `"trace_id":"`+span.SpanContext().TraceID().String()+`"`, fmt.Sprintf(`"task_id":%d`, id))
+}
+
+func TestRunnerMetrics(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	q := NewInMemoryTaskQueue(3, time.Minute, log)
+
+	runner := NewRunner(q, 2, log, 10*time.Millisecond)
+	runner.Register("metrics_ok", func(ctx context.Context, task Task) (string, error) {
+		return "", nil
+	})
+	runner.Register("metrics_fail", func(ctx context.Context, task Task) (string, error) {
+		return "", errors.New("boom")
+	}, WithMaxAttempts(1))
+	go runner.Start()
+	defer runner.Close()
+
+	okID, err := q.AddTask(ctx, 1, "metrics_ok", "{}")
+	require.NoError(t, err)
+	failID, err := q.AddTask(ctx, 1, "metrics_fail", "{}")
+	require.NoError(t, err)
+	waitForStatus(t, q, okID, "complete", time.Second)
+	waitForStatus(t, q, failID, "dead", time.Second)
+
+	wantLines := []string{
+		`taskqueue_task_outcomes_total{outcome="complete",queue="default",task_type="metrics_ok"} 1`,
+		`taskqueue_task_outcomes_total{outcome="dead",queue="default",task_type="metrics_fail"} 1`,
+		`taskqueue_task_attempts_count{outcome="dead",task_type="metrics_fail"} 1`,
+		`taskqueue_handler_duration_seconds_count{queue="default",task_type="metrics_ok"} 1`,
+		`taskqueue_task_start_delay_seconds_count{queue="default",task_type="metrics_ok"} 1`,
+		`taskqueue_tasks{status="complete",task_type="metrics_ok"} 1`,
+		`taskqueue_tasks{status="dead",task_type="metrics_fail"} 1`,
+	}
+	require.Eventually(t, func() bool {
+		return containsAllTokens(scrapeMetrics(t), wantLines)
+	}, time.Second, 10*time.Millisecond)
+
+	// a status with no tasks left drops to zero instead of keeping its last count
+	_, err = q.PurgeDeadTasks(ctx, TaskFilter{TaskType: "metrics_fail"})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return strings.Contains(scrapeMetrics(t), `taskqueue_tasks{status="dead",task_type="metrics_fail"} 0`)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRunnerUserInFlightMetric(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	q := NewInMemoryTaskQueue(3, time.Minute, log)
+
+	runner := NewRunner(q, 2, log, 10*time.Millisecond)
+	release := make(chan struct{})
+	runner.Register("metrics_block", func(ctx context.Context, task Task) (string, error) {
+		<-release
+		return "", nil
+	})
+	go runner.Start()
+	defer runner.Close()
+
+	var ids []int
+	for i := 0; i < 2; i++ {
+		id, err := q.AddTask(ctx, 4242, "metrics_block", "{}")
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	require.Eventually(t, func() bool {
+		return strings.Contains(scrapeMetrics(t), `taskqueue_user_tasks_in_flight{user_id="4242"} 2`)
+	}, time.Second, 10*time.Millisecond)
+
+	// users with nothing running are dropped from the metric
+	close(release)
+	for _, id := range ids {
+		waitForStatus(t, q, id, "complete", time.Second)
+	}
+	require.Eventually(t, func() bool {
+		return !strings.Contains(scrapeMetrics(t), `user_id="4242"`)
+	}, time.Second, 10*time.Millisecond)
+}
+
+// scrapeMetrics returns the default registry in the Prometheus text format, as served on /metrics.
+func scrapeMetrics(t *testing.T) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return rec.Body.String()
+}
+
+func waitForStatus(t *testing.T, q *InMemoryTaskQueue, taskID int, status string, timeout time.Duration) {
+	t.Helper()
+	start := time.Now()
+	for {
+		q.mu.Lock()
+		got := ""
+		if task, ok := q.tasks[taskID]; ok {
+			got = task.Status
+		}
+		q.mu.Unlock()
+
+		if got == status {
+			return
+		}
+		if time.Since(start) >= timeout {
+			t.Fatalf("task %d never reached status %q, last status %q", taskID, status, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func assertLogged(t *testing.T, logLines string, tokens ...string) {
 	lines := strings.Split(logLines, "\n")
 
@@ -101,3 +1047,66 @@ func containsAllTokens(line string, tokens []string) bool {
 	}
 	return true
 }
+
+func TestRunnerWakesOnEnqueue(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	q := NewInMemoryTaskQueue(3, time.Minute, log)
+
+	// with an hour between polls, only the enqueue wakeup can get the task run in time
+	runner := NewRunner(q, 1, log, time.Hour)
+	done := make(chan int, 1)
+	runner.Register("greet", func(ctx context.Context, task Task) (string, error) {
+		done <- task.ID
+		return "", nil
+	})
+	go runner.Start()
+	defer runner.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	id, err := q.AddTask(ctx, 1, "greet", "")
+	require.NoError(t, err)
+	select {
+	case got := <-done:
+		assert.Equal(t, id, got)
+	case <-time.After(time.Second):
+		t.Fatal("task was not run after enqueue")
+	}
+}
+
+func TestRunnerAdaptivePoll(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(io.Discard)
+	q := NewInMemoryTaskQueue(3, time.Minute, log)
+	// hide OnEnqueue, like a task added by another replica, so only polling finds tasks
+	store := struct{ Tasker }{q}
+
+	_, err := q.AddTask(ctx, 1, "greet", "")
+	require.NoError(t, err)
+
+	runner := NewRunner(store, 1, log, time.Hour)
+	runner.SetMinPollInterval(10 * time.Millisecond)
+	done := make(chan int, 2)
+	runner.Register("greet", func(ctx context.Context, task Task) (string, error) {
+		done <- task.ID
+		return "", nil
+	})
+	go runner.Start()
+	defer runner.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("first task was not run")
+	}
+
+	// after a poll finds work, the next polls come well before the hour-long poll interval
+	id, err := q.AddTask(ctx, 1, "greet", "")
+	require.NoError(t, err)
+	select {
+	case got := <-done:
+		assert.Equal(t, id, got)
+	case <-time.After(time.Second):
+		t.Fatal("task added after activity was not found by polling")
+	}
+}
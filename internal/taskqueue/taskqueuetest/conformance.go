@@ -0,0 +1,501 @@
+// Package taskqueuetest is a conformance suite for taskqueue.Tasker implementations. Every store
+// runs the same suite so their behavior can't drift apart:
+//
+//	func TestConformance(t *testing.T) {
+//		taskqueuetest.Run(t, 50*time.Millisecond, func(t *testing.T, retryLimit int, expiration time.Duration) taskqueue.Tasker {
+//			return taskqueue.NewInMemoryTaskQueue(retryLimit, expiration, logger.New(io.Discard))
+//		})
+//	}
+//
+// Stores that support Fairness also run RunFairness.
+package taskqueuetest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sethgrid/helloworld/internal/taskqueue"
+)
+
+// Factory returns an empty Tasker whose checkouts expire after expiration and whose tasks are
+// marked dead by CheckAndMarkDeadTasks once a checkout expires after retryLimit attempts.
+type Factory func(t *testing.T, retryLimit int, expiration time.Duration) taskqueue.Tasker
+
+// retryLimit is the limit every Tasker in the suite is created with.
+const retryLimit = 2
+
+// Run runs the suite with a fresh Tasker from newTasker for each subtest. expiration is the
+// checkout expiration the suite asks for and then waits out, so keep it short; stores that keep
+// whole second timestamps, like MySQL DATETIME columns, need at least a second.
+func Run(t *testing.T, expiration time.Duration, newTasker Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, q taskqueue.Tasker, expiration time.Duration)
+	}{
+		{"add and get", testAddAndGet},
+		{"priority then oldest first", testOrdering},
+		{"queues are separate", testQueues},
+		{"delayed tasks", testDelayedTasks},
+		{"expired checkout is fetched again", testExpiredCheckout},
+		{"extended lease is not fetched again", testExtendLease},
+		{"fail task", testFailTask},
+		{"complete task", testCompleteTask},
+		{"retry limit", testRetryLimit},
+		{"dead letter queue", testDeadLetter},
+		{"cancel tasks", testCancelTasks},
+		{"dedup key", testDedup},
+		{"count tasks", testCountTasks},
+		{"sweep finished tasks", testSweepTasks},
+		{"concurrent fetches never share a task", testConcurrentFetch},
+		{"skipped task types stay open", testSkipTypes},
+		{"released task gets its attempt back", testReleaseTask},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTasker(t, retryLimit, expiration)
+			t.Cleanup(func() { q.Close() })
+			tt.fn(t, q, expiration)
+		})
+	}
+}
+
+// waitForExpiry sleeps until checkouts made before the call have expired.
+func waitForExpiry(expiration time.Duration) {
+	time.Sleep(2 * expiration)
+}
+
+func addTask(t *testing.T, q taskqueue.Tasker, userID int, taskType string, opts ...taskqueue.EnqueueOption) int {
+	t.Helper()
+	id, err := q.AddTask(context.Background(), userID, taskType, `{"n":1}`, opts...)
+	require.NoError(t, err)
+	return id
+}
+
+func fetch(t *testing.T, q taskqueue.Tasker) *taskqueue.Task {
+	t.Helper()
+	task, err := q.FetchOpenTask(context.Background(), taskqueue.DefaultQueue)
+	require.NoError(t, err)
+	return task
+}
+
+func requireStatus(t *testing.T, q taskqueue.Tasker, id int, status string) *taskqueue.Task {
+	t.Helper()
+	task, err := q.GetTask(context.Background(), id)
+	require.NoError(t, err)
+	require.Equal(t, status, task.Status, "task %d", id)
+	return task
+}
+
+func testAddAndGet(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	ctx := context.Background()
+	id := addTask(t, q, 7, "greet", taskqueue.WithPriority(3))
+
+	task, err := q.GetTask(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, id, task.ID)
+	assert.Equal(t, 7, task.UserID)
+	assert.Equal(t, "greet", task.TaskType)
+	assert.Equal(t, `{"n":1}`, task.Payload)
+	assert.Equal(t, taskqueue.DefaultQueue, task.Queue)
+	assert.Equal(t, 3, task.Priority)
+	assert.Equal(t, "open", task.Status)
+	assert.Equal(t, 0, task.Attempts)
+
+	_, err = q.GetTask(ctx, id+1000)
+	assert.ErrorIs(t, err, taskqueue.ErrTaskNotFound)
+}
+
+func testOrdering(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	low := addTask(t, q, 1, "low", taskqueue.WithPriority(-1))
+	first := addTask(t, q, 1, "first")
+	urgent := addTask(t, q, 1, "urgent", taskqueue.WithPriority(5))
+	second := addTask(t, q, 1, "second")
+
+	tasks, err := q.FetchOpenTasks(context.Background(), taskqueue.DefaultQueue, 3)
+	require.NoError(t, err)
+	var ids []int
+	for _, task := range tasks {
+		assert.Equal(t, "checked_out", task.Status)
+		assert.Equal(t, 1, task.Attempts)
+		assert.NotEmpty(t, task.LeaseToken)
+		ids = append(ids, task.ID)
+	}
+	assert.Equal(t, []int{urgent, first, second}, ids)
+
+	last := fetch(t, q)
+	require.NotNil(t, last)
+	assert.Equal(t, low, last.ID)
+	assert.Nil(t, fetch(t, q))
+}
+
+func testQueues(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	bulk := addTask(t, q, 1, "bulk", taskqueue.OnQueue("bulk"), taskqueue.WithPriority(100))
+	normal := addTask(t, q, 1, "normal")
+
+	task := fetch(t, q)
+	require.NotNil(t, task)
+	assert.Equal(t, normal, task.ID)
+	assert.Nil(t, fetch(t, q), "tasks on other queues are not fetched")
+
+	task, err := q.FetchOpenTask(context.Background(), "bulk")
+	require.NoError(t, err)
+	require.NotNil(t, task)
+	assert.Equal(t, bulk, task.ID)
+	assert.Equal(t, "bulk", task.Queue)
+}
+
+func testReleaseTask(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	releaser, ok := q.(taskqueue.Releaser)
+	if !ok {
+		t.Skip("store does not implement taskqueue.Releaser")
+	}
+	ctx := context.Background()
+	id := addTask(t, q, 1, "report")
+
+	task := fetch(t, q)
+	require.NotNil(t, task)
+	require.NoError(t, releaser.ReleaseTask(ctx, id, task.LeaseToken))
+	released := requireStatus(t, q, id, "open")
+	assert.Equal(t, 0, released.Attempts)
+	assert.Empty(t, released.LeaseToken)
+	assert.ErrorIs(t, releaser.ReleaseTask(ctx, id, task.LeaseToken), taskqueue.ErrLeaseLost, "releasing twice")
+	assert.ErrorIs(t, releaser.ReleaseTask(ctx, id+1000, ""), taskqueue.ErrTaskNotFound)
+
+	// the task is fetched again right away, on the attempt it got back
+	again := fetch(t, q)
+	require.NotNil(t, again)
+	assert.Equal(t, id, again.ID)
+	assert.Equal(t, 1, again.Attempts)
+}
+
+func testSkipTypes(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	skipper, ok := q.(taskqueue.TypeSkipper)
+	if !ok {
+		t.Skip("store does not implement taskqueue.TypeSkipper")
+	}
+	ctx := context.Background()
+	export := addTask(t, q, 1, "export", taskqueue.WithPriority(5))
+	greet := addTask(t, q, 1, "greet")
+	addTask(t, q, 1, "report")
+
+	tasks, err := skipper.FetchOpenTasksExcept(ctx, taskqueue.DefaultQueue, 3, []string{"export", "report"})
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	assert.Equal(t, greet, tasks[0].ID)
+
+	task, err := q.GetTask(ctx, export)
+	require.NoError(t, err)
+	assert.Equal(t, "open", task.Status)
+	assert.Equal(t, 0, task.Attempts)
+
+	task = fetch(t, q)
+	require.NotNil(t, task)
+	assert.Equal(t, export, task.ID, "skipped tasks are fetched once they aren't skipped")
+}
+
+func testDelayedTasks(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	addTask(t, q, 1, "later", taskqueue.RunAt(time.Now().Add(time.Hour)))
+	past := addTask(t, q, 1, "past", taskqueue.RunAt(time.Now().Add(-time.Hour)))
+
+	task := fetch(t, q)
+	require.NotNil(t, task)
+	assert.Equal(t, past, task.ID)
+	assert.Nil(t, fetch(t, q), "a task is not fetched before its run-at time")
+}
+
+func testExpiredCheckout(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	ctx := context.Background()
+	id := addTask(t, q, 1, "slow")
+
+	first := fetch(t, q)
+	require.NotNil(t, first)
+	assert.Nil(t, fetch(t, q), "a checked out task is not fetched again before its lease expires")
+
+	waitForExpiry(expiration)
+	second := fetch(t, q)
+	require.NotNil(t, second)
+	assert.Equal(t, id, second.ID)
+	assert.Equal(t, 2, second.Attempts)
+	assert.NotEqual(t, first.LeaseToken, second.LeaseToken)
+
+	// the first worker's lease is gone; only the second can report on the task
+	_, err := q.ExtendLease(ctx, id, first.LeaseToken, 0)
+	assert.ErrorIs(t, err, taskqueue.ErrLeaseLost)
+	assert.ErrorIs(t, q.MarkTaskComplete(ctx, id, first.LeaseToken, "stale"), taskqueue.ErrLeaseLost)
+	assert.ErrorIs(t, q.FailTask(ctx, id, first.LeaseToken, "stale", time.Now()), taskqueue.ErrLeaseLost)
+	assert.ErrorIs(t, q.MarkTaskDead(ctx, id, first.LeaseToken, "stale"), taskqueue.ErrLeaseLost)
+	require.NoError(t, q.MarkTaskComplete(ctx, id, second.LeaseToken, "fresh"))
+	assert.Equal(t, "fresh", requireStatus(t, q, id, "complete").Result)
+}
+
+func testExtendLease(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	ctx := context.Background()
+	addTask(t, q, 1, "slow")
+
+	task := fetch(t, q)
+	require.NotNil(t, task)
+	expiresAt, err := q.ExtendLease(ctx, task.ID, task.LeaseToken, time.Hour)
+	require.NoError(t, err)
+	assert.True(t, expiresAt.After(time.Now().Add(30*time.Minute)))
+
+	waitForExpiry(expiration)
+	assert.Nil(t, fetch(t, q))
+	require.NoError(t, q.CheckAndMarkDeadTasks(ctx))
+	requireStatus(t, q, task.ID, "checked_out")
+}
+
+func testFailTask(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	ctx := context.Background()
+	id := addTask(t, q, 1, "flaky")
+
+	task := fetch(t, q)
+	require.NotNil(t, task)
+	require.NoError(t, q.FailTask(ctx, id, task.LeaseToken, "boom", time.Now().Add(time.Hour)))
+	failed := requireStatus(t, q, id, "open")
+	assert.Equal(t, "boom", failed.LastError)
+	assert.Nil(t, fetch(t, q), "a failed task waits for its next attempt")
+
+	assert.ErrorIs(t, q.FailTask(ctx, id+1000, "", "boom", time.Now()), taskqueue.ErrTaskNotFound)
+
+	// an administrative retry with no lease brings it forward
+	require.NoError(t, q.FailTask(ctx, id, "", "boom", time.Now().Add(-time.Minute)))
+	retry := fetch(t, q)
+	require.NotNil(t, retry)
+	assert.Equal(t, id, retry.ID)
+	assert.Equal(t, 2, retry.Attempts)
+}
+
+func testCompleteTask(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	ctx := context.Background()
+	id := addTask(t, q, 1, "report")
+
+	task := fetch(t, q)
+	require.NotNil(t, task)
+	require.NoError(t, q.MarkTaskComplete(ctx, id, task.LeaseToken, `{"rows":10}`))
+	assert.Equal(t, `{"rows":10}`, requireStatus(t, q, id, "complete").Result)
+
+	assert.ErrorIs(t, q.MarkTaskComplete(ctx, id, task.LeaseToken, ""), taskqueue.ErrLeaseLost, "completing twice")
+	assert.ErrorIs(t, q.MarkTaskComplete(ctx, id+1000, "", ""), taskqueue.ErrTaskNotFound)
+	assert.ErrorIs(t, q.MarkTaskDead(ctx, id+1000, "", ""), taskqueue.ErrTaskNotFound)
+	assert.Nil(t, fetch(t, q))
+}
+
+func testRetryLimit(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	ctx := context.Background()
+	id := addTask(t, q, 1, "stuck")
+
+	for attempt := 1; attempt <= retryLimit; attempt++ {
+		if attempt > 1 {
+			waitForExpiry(expiration)
+		}
+		task := fetch(t, q)
+		require.NotNil(t, task)
+		assert.Equal(t, attempt, task.Attempts)
+	}
+
+	// the final attempt may still be running until its lease expires
+	require.NoError(t, q.CheckAndMarkDeadTasks(ctx))
+	requireStatus(t, q, id, "checked_out")
+
+	// once it expires, the task has no attempts left, so it isn't fetched again before the sweep
+	waitForExpiry(expiration)
+	assert.Nil(t, fetch(t, q))
+	require.NoError(t, q.CheckAndMarkDeadTasks(ctx))
+	assert.NotEmpty(t, requireStatus(t, q, id, "dead").LastError)
+	assert.Nil(t, fetch(t, q))
+}
+
+func testDeadLetter(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	ctx := context.Background()
+	a := addTask(t, q, 1, "email")
+	b := addTask(t, q, 1, "email")
+	c := addTask(t, q, 2, "sms")
+	for _, id := range []int{a, b, c} {
+		require.NoError(t, q.MarkTaskDead(ctx, id, "", "provider down"))
+	}
+
+	dead, err := q.ListDeadTasks(ctx, taskqueue.TaskFilter{TaskType: "email"})
+	require.NoError(t, err)
+	require.Len(t, dead, 2)
+	assert.Equal(t, a, dead[0].ID)
+	assert.Equal(t, "provider down", dead[0].LastError)
+
+	limited, err := q.ListDeadTasks(ctx, taskqueue.TaskFilter{Limit: 1})
+	require.NoError(t, err)
+	assert.Len(t, limited, 1)
+
+	count, err := q.RequeueDeadTasks(ctx, taskqueue.TaskFilter{IDs: []int{b}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, 0, requireStatus(t, q, b, "open").Attempts)
+
+	count, err = q.PurgeDeadTasks(ctx, taskqueue.TaskFilter{UserID: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	_, err = q.GetTask(ctx, c)
+	assert.ErrorIs(t, err, taskqueue.ErrTaskNotFound)
+
+	dead, err = q.ListDeadTasks(ctx, taskqueue.TaskFilter{})
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, a, dead[0].ID)
+}
+
+func testCancelTasks(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	ctx := context.Background()
+	running := addTask(t, q, 1, "export")
+	checkedOut := fetch(t, q)
+	require.NotNil(t, checkedOut)
+	open := addTask(t, q, 1, "export")
+	otherType := addTask(t, q, 1, "import")
+	otherUser := addTask(t, q, 2, "export")
+	done := addTask(t, q, 1, "export")
+	doneTask, err := q.FetchOpenTasks(ctx, taskqueue.DefaultQueue, 10)
+	require.NoError(t, err)
+	for _, task := range doneTask {
+		if task.ID == done {
+			require.NoError(t, q.MarkTaskComplete(ctx, done, task.LeaseToken, ""))
+		} else {
+			// put the others back so they are open again
+			require.NoError(t, q.FailTask(ctx, task.ID, task.LeaseToken, "", time.Now().Add(-time.Minute)))
+		}
+	}
+
+	ids, err := q.CancelTasks(ctx, taskqueue.TaskFilter{UserID: 1, TaskType: "export"})
+	require.NoError(t, err)
+	sort.Ints(ids)
+	assert.Equal(t, []int{running, open}, ids)
+
+	requireStatus(t, q, running, "cancelled")
+	requireStatus(t, q, open, "cancelled")
+	requireStatus(t, q, otherType, "open")
+	requireStatus(t, q, otherUser, "open")
+	requireStatus(t, q, done, "complete")
+	assert.ErrorIs(t, q.MarkTaskComplete(ctx, running, checkedOut.LeaseToken, ""), taskqueue.ErrLeaseLost)
+
+	ids, err = q.CancelTasks(ctx, taskqueue.TaskFilter{Statuses: []string{"complete", "cancelled"}})
+	require.NoError(t, err)
+	assert.Empty(t, ids, "finished tasks are never cancelled")
+
+	waitForExpiry(expiration)
+	tasks, err := q.FetchOpenTasks(ctx, taskqueue.DefaultQueue, 10)
+	require.NoError(t, err)
+	var fetched []int
+	for _, task := range tasks {
+		fetched = append(fetched, task.ID)
+	}
+	sort.Ints(fetched)
+	assert.Equal(t, []int{otherType, otherUser}, fetched)
+}
+
+func testDedup(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	first := addTask(t, q, 1, "charge", taskqueue.WithDedupKey("order-1", time.Hour))
+	assert.Equal(t, first, addTask(t, q, 1, "charge", taskqueue.WithDedupKey("order-1", time.Hour)))
+	assert.NotEqual(t, first, addTask(t, q, 1, "charge", taskqueue.WithDedupKey("order-2", time.Hour)))
+	assert.NotEqual(t, first, addTask(t, q, 1, "charge"))
+
+	expired := addTask(t, q, 1, "charge", taskqueue.WithDedupKey("order-3", time.Nanosecond))
+	waitForExpiry(expiration)
+	assert.NotEqual(t, expired, addTask(t, q, 1, "charge", taskqueue.WithDedupKey("order-3", time.Nanosecond)))
+}
+
+func testCountTasks(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	ctx := context.Background()
+	counts, err := q.CountTasks(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, counts)
+
+	addTask(t, q, 1, "email")
+	addTask(t, q, 1, "email")
+	addTask(t, q, 1, "sms")
+	task := fetch(t, q)
+	require.NotNil(t, task)
+	require.NoError(t, q.MarkTaskComplete(ctx, task.ID, task.LeaseToken, ""))
+	require.NotNil(t, fetch(t, q))
+
+	counts, err = q.CountTasks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []taskqueue.TaskCount{
+		{Status: "checked_out", TaskType: "email", Count: 1},
+		{Status: "complete", TaskType: "email", Count: 1},
+		{Status: "open", TaskType: "sms", Count: 1},
+	}, counts)
+}
+
+func testSweepTasks(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	ctx := context.Background()
+	var complete []int
+	for i := 0; i < 3; i++ {
+		id := addTask(t, q, 1, "report")
+		task := fetch(t, q)
+		require.NotNil(t, task)
+		require.NoError(t, q.MarkTaskComplete(ctx, id, task.LeaseToken, ""))
+		complete = append(complete, id)
+	}
+	dead := addTask(t, q, 1, "report")
+	require.NoError(t, q.MarkTaskDead(ctx, dead, "", "gave up"))
+	open := addTask(t, q, 1, "report")
+
+	count, err := q.SweepTasks(ctx, "complete", time.Now().Add(-time.Hour), 10)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count, "tasks that finished recently are kept")
+
+	// batches are removed oldest first
+	count, err = q.SweepTasks(ctx, "complete", time.Now().Add(time.Hour), 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	_, err = q.GetTask(ctx, complete[0])
+	assert.ErrorIs(t, err, taskqueue.ErrTaskNotFound)
+	requireStatus(t, q, complete[2], "complete")
+
+	count, err = q.SweepTasks(ctx, "complete", time.Now().Add(time.Hour), 2)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	requireStatus(t, q, dead, "dead")
+	requireStatus(t, q, open, "open")
+
+	_, err = q.SweepTasks(ctx, "open", time.Now().Add(time.Hour), 10)
+	assert.Error(t, err, "only finished tasks can be swept")
+	requireStatus(t, q, open, "open")
+}
+
+func testConcurrentFetch(t *testing.T, q taskqueue.Tasker, expiration time.Duration) {
+	const taskCount = 40
+	for i := 0; i < taskCount; i++ {
+		addTask(t, q, i%4, "fanout")
+	}
+
+	var mu sync.Mutex
+	seen := make(map[int]int)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				tasks, err := q.FetchOpenTasks(context.Background(), taskqueue.DefaultQueue, 3)
+				if !assert.NoError(t, err) || len(tasks) == 0 {
+					return
+				}
+				mu.Lock()
+				for _, task := range tasks {
+					seen[task.ID]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, seen, taskCount)
+	for id, n := range seen {
+		assert.Equal(t, 1, n, "task %d was checked out %d times", id, n)
+	}
+}
@@ -0,0 +1,125 @@
+package taskqueuetest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sethgrid/helloworld/internal/taskqueue"
+)
+
+// FairnessFactory returns an empty Tasker that checks out tasks following fairness.
+type FairnessFactory func(t *testing.T, fairness taskqueue.Fairness) taskqueue.Tasker
+
+// RunFairness runs the fairness suite with a fresh Tasker from newTasker for each subtest.
+func RunFairness(t *testing.T, newTasker FairnessFactory) {
+	tests := []struct {
+		name     string
+		fairness taskqueue.Fairness
+		fn       func(t *testing.T, q taskqueue.Tasker)
+	}{
+		{"round robin one at a time", taskqueue.Fairness{RoundRobin: true}, testRoundRobin},
+		{"round robin batch", taskqueue.Fairness{RoundRobin: true}, testRoundRobinBatch},
+		{"max per user", taskqueue.Fairness{MaxPerUser: 2}, testMaxPerUser},
+		{"round robin with max per user", taskqueue.Fairness{RoundRobin: true, MaxPerUser: 1}, testRoundRobinMaxPerUser},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTasker(t, tt.fairness)
+			t.Cleanup(func() { q.Close() })
+			tt.fn(t, q)
+		})
+	}
+}
+
+// addUserTasks adds count tasks for each user, in order, and returns their IDs per user.
+func addUserTasks(t *testing.T, q taskqueue.Tasker, counts ...[2]int) map[int][]int {
+	t.Helper()
+	ids := make(map[int][]int)
+	for _, c := range counts {
+		userID, count := c[0], c[1]
+		for i := 0; i < count; i++ {
+			ids[userID] = append(ids[userID], addTask(t, q, userID, "export"))
+		}
+	}
+	return ids
+}
+
+func userIDs(tasks []*taskqueue.Task) []int {
+	users := make([]int, 0, len(tasks))
+	for _, task := range tasks {
+		users = append(users, task.UserID)
+	}
+	return users
+}
+
+func testRoundRobin(t *testing.T, q taskqueue.Tasker) {
+	ctx := context.Background()
+	// user 1 enqueued first, so strict age order would run all of their tasks before anyone else's
+	addUserTasks(t, q, [2]int{1, 4}, [2]int{2, 2}, [2]int{3, 1})
+
+	var users []int
+	for {
+		task := fetch(t, q)
+		if task == nil {
+			break
+		}
+		users = append(users, task.UserID)
+		require.NoError(t, q.MarkTaskComplete(ctx, task.ID, task.LeaseToken, ""))
+	}
+	assert.Equal(t, []int{1, 2, 3, 1, 2, 1, 1}, users)
+}
+
+func testRoundRobinBatch(t *testing.T, q taskqueue.Tasker) {
+	ids := addUserTasks(t, q, [2]int{1, 4}, [2]int{2, 2}, [2]int{3, 1})
+
+	tasks, err := q.FetchOpenTasks(context.Background(), taskqueue.DefaultQueue, 4)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []int{1, 1, 2, 3}, userIDs(tasks))
+	// each user's own tasks still come oldest first
+	var user1 []int
+	for _, task := range tasks {
+		if task.UserID == 1 {
+			user1 = append(user1, task.ID)
+		}
+	}
+	assert.ElementsMatch(t, ids[1][:2], user1)
+
+	// the next batch carries on after the last user served
+	tasks, err = q.FetchOpenTasks(context.Background(), taskqueue.DefaultQueue, 2)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []int{2, 1}, userIDs(tasks))
+}
+
+func testMaxPerUser(t *testing.T, q taskqueue.Tasker) {
+	ctx := context.Background()
+	addUserTasks(t, q, [2]int{1, 4}, [2]int{2, 1})
+
+	tasks, err := q.FetchOpenTasks(ctx, taskqueue.DefaultQueue, 10)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []int{1, 1, 2}, userIDs(tasks))
+	assert.Nil(t, fetch(t, q), "user 1 is at the cap and user 2 has nothing left")
+
+	// finishing one of user 1's tasks frees a slot
+	for _, task := range tasks {
+		if task.UserID == 1 {
+			require.NoError(t, q.MarkTaskComplete(ctx, task.ID, task.LeaseToken, ""))
+			break
+		}
+	}
+	task := fetch(t, q)
+	require.NotNil(t, task)
+	assert.Equal(t, 1, task.UserID)
+	assert.Nil(t, fetch(t, q))
+}
+
+func testRoundRobinMaxPerUser(t *testing.T, q taskqueue.Tasker) {
+	addUserTasks(t, q, [2]int{1, 3}, [2]int{2, 1})
+
+	tasks, err := q.FetchOpenTasks(context.Background(), taskqueue.DefaultQueue, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, userIDs(tasks))
+}
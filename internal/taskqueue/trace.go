@@ -0,0 +1,72 @@
+package taskqueue
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/sethgrid/helloworld/logger"
+)
+
+const tracerName = "github.com/sethgrid/helloworld/internal/taskqueue"
+
+// traceContext is the W3C trace context format. It is used directly rather than through the
+// global propagator so a traceparent is captured the same way whether or not tracing is installed.
+var traceContext = propagation.TraceContext{}
+
+// traceParentFromCtx returns the W3C traceparent of the span active in ctx, or "" if there is none.
+//
+//	00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func traceParentFromCtx(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	traceContext.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// startTaskSpan starts the span for one attempt at task. Tasks can run long after the request that
+// enqueued them has returned, so the span starts a new trace linked to the enqueuing span instead
+// of growing the request's trace.
+func startTaskSpan(ctx context.Context, task Task) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.Int("task.id", task.ID),
+			attribute.String("task.type", task.TaskType),
+			attribute.String("task.queue", task.Queue),
+			attribute.Int("task.attempt", task.Attempts),
+		),
+	}
+	if task.TraceParent != "" {
+		enqueued := traceContext.Extract(context.Background(), propagation.MapCarrier{"traceparent": task.TraceParent})
+		if sc := trace.SpanContextFromContext(enqueued); sc.IsValid() {
+			opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+		}
+	}
+	if task.RequestID != "" {
+		opts = append(opts, trace.WithAttributes(attribute.String("task.request_id", task.RequestID)))
+	}
+	return otel.Tracer(tracerName).Start(ctx, "task "+task.TaskType, opts...)
+}
+
+// withTaskLogger adds log to ctx for one attempt at task. Like logger.Middleware does for requests,
+// the logger carries a rid and the IDs of the active span. The rid is the one of the request that
+// enqueued the task, or a new one for tasks enqueued elsewhere, and is added to ctx as well so
+// tasks the handler enqueues keep it.
+func withTaskLogger(ctx context.Context, log *slog.Logger, task Task) (context.Context, *slog.Logger) {
+	rid := task.RequestID
+	if rid == "" {
+		// if we change rid, also change rid init in logger.NewRequestLogger
+		rid = uuid.NewString()
+	}
+	log = log.With("rid", rid)
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		log = log.With("trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+	}
+	return logger.AddRequestIDToCtx(logger.AddToCtx(ctx, log), rid), log
+}
@@ -0,0 +1,75 @@
+package taskqueue
+
+import (
+	"sync"
+	"time"
+)
+
+// EnqueueNotifier is implemented by Taskers that can tell a Runner in the same process that a task
+// was added, so the Runner fetches it right away instead of waiting out its poll interval. Tasks
+// added by other processes, or with AddTaskTx, are still found by polling.
+type EnqueueNotifier interface {
+	// OnEnqueue registers fn to be called with the queue of each task added that is ready to run.
+	// fn is called after the task is stored and must not block.
+	OnEnqueue(fn func(queue string))
+}
+
+// enqueueListeners implements EnqueueNotifier for the task stores.
+type enqueueListeners struct {
+	fnsMu sync.Mutex
+	fns   []func(queue string)
+}
+
+func (l *enqueueListeners) OnEnqueue(fn func(queue string)) {
+	l.fnsMu.Lock()
+	defer l.fnsMu.Unlock()
+	l.fns = append(l.fns, fn)
+}
+
+// notifyEnqueue tells the listeners a task was added to queue, unless it is held until runAt.
+func (l *enqueueListeners) notifyEnqueue(queue string, runAt time.Time) {
+	if runAt.After(time.Now()) {
+		return
+	}
+
+	l.fnsMu.Lock()
+	fns := l.fns
+	l.fnsMu.Unlock()
+	for _, fn := range fns {
+		fn(queue)
+	}
+}
+
+// SetMinPollInterval makes polling adaptive: after a poll finds tasks, the next empty poll waits d,
+// and each empty poll after that doubles the wait up to the poll interval. A busy queue is checked
+// often while an idle one backs off to the poll interval, so replicas find each other's tasks quickly
+// without hammering the database. It defaults to the poll interval, which polls at a fixed rate.
+// SetMinPollInterval should be called before Start.
+func (tq *Runner) SetMinPollInterval(d time.Duration) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	tq.minPollInterval = d
+}
+
+// wake tells the queue's poller a task was added, if the runner has a pool for the queue.
+// It never blocks; a poller that already has a wakeup pending doesn't need another.
+func (p *queuePool) wake() {
+	select {
+	case p.woken <- struct{}{}:
+	default:
+	}
+}
+
+// waitForTasks waits d for the next poll, returning early if a task is added to the pool's queue
+// in this process. It reports whether it was woken.
+func (tq *Runner) waitForTasks(pool *queuePool, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-tq.ctx.Done():
+	case <-pool.woken:
+		return true
+	case <-t.C:
+	}
+	return false
+}
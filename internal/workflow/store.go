@@ -0,0 +1,294 @@
+package workflow
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sethgrid/kverr"
+
+	"github.com/sethgrid/helloworld/internal/db"
+)
+
+// Store persists workflows and the progress of their steps.
+type Store interface {
+	// CreateWorkflow stores a running workflow with every step waiting and returns its ID. Steps
+	// are kept in the given order.
+	CreateWorkflow(ctx context.Context, userID int, name string, steps []Step) (int, error)
+	// GetWorkflow returns the workflow with the given ID, or ErrWorkflowNotFound.
+	GetWorkflow(ctx context.Context, id int) (*Workflow, error)
+	// RunningWorkflows returns the IDs of the workflows that are still running, oldest first.
+	RunningWorkflows(ctx context.Context) ([]int, error)
+	// UpdateStep sets the step's status, task ID, and error if its status is still from. It
+	// returns false when another process changed the step first.
+	UpdateStep(ctx context.Context, workflowID int, name string, from string, to StepStatus) (bool, error)
+	// FinishWorkflow sets the final status of a running workflow.
+	FinishWorkflow(ctx context.Context, id int, status string) error
+}
+
+// MemoryStore keeps workflows in memory. It suits tests and single process development;
+// workflows are lost on restart.
+type MemoryStore struct {
+	mu        sync.Mutex
+	workflows map[int]*Workflow
+	nextID    int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{workflows: make(map[int]*Workflow), nextID: 1}
+}
+
+func (m *MemoryStore) CreateWorkflow(ctx context.Context, userID int, name string, steps []Step) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	wf := &Workflow{ID: m.nextID, UserID: userID, Name: name, Status: StatusRunning, CreatedAt: now, UpdatedAt: now}
+	for _, step := range steps {
+		wf.Steps = append(wf.Steps, StepStatus{Step: step, Status: StepWaiting, UpdatedAt: now})
+	}
+	m.workflows[wf.ID] = wf
+	m.nextID++
+	return wf.ID, nil
+}
+
+func (m *MemoryStore) GetWorkflow(ctx context.Context, id int) (*Workflow, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wf, ok := m.workflows[id]
+	if !ok {
+		return nil, kverr.New(ErrWorkflowNotFound, "workflow_id", id)
+	}
+	// hand out a copy so callers never race with the store
+	cpy := *wf
+	cpy.Steps = append([]StepStatus(nil), wf.Steps...)
+	return &cpy, nil
+}
+
+func (m *MemoryStore) RunningWorkflows(ctx context.Context) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	for id, wf := range m.workflows {
+		if wf.Status == StatusRunning {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (m *MemoryStore) UpdateStep(ctx context.Context, workflowID int, name string, from string, to StepStatus) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wf, ok := m.workflows[workflowID]
+	if !ok {
+		return false, kverr.New(ErrWorkflowNotFound, "workflow_id", workflowID)
+	}
+	step := wf.step(name)
+	if step == nil {
+		return false, kverr.New(errors.New("step not found"), "workflow_id", workflowID, "step", name)
+	}
+	if step.Status != from {
+		return false, nil
+	}
+	step.Status = to.Status
+	step.TaskID = to.TaskID
+	step.Error = to.Error
+	step.UpdatedAt = time.Now()
+	wf.UpdatedAt = step.UpdatedAt
+	return true, nil
+}
+
+func (m *MemoryStore) FinishWorkflow(ctx context.Context, id int, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wf, ok := m.workflows[id]
+	if !ok {
+		return kverr.New(ErrWorkflowNotFound, "workflow_id", id)
+	}
+	if wf.Status == StatusRunning {
+		wf.Status = status
+		wf.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+// MySQLStore keeps workflows in the workflows and workflow_steps tables so they are shared
+// across replicas.
+type MySQLStore struct {
+	DBManager *db.Manager
+}
+
+func NewMySQLStore(dbManager *db.Manager) *MySQLStore {
+	return &MySQLStore{DBManager: dbManager}
+}
+
+func (m *MySQLStore) CreateWorkflow(ctx context.Context, userID int, name string, steps []Step) (int, error) {
+	var id int
+	err := timeDBOperation("create_workflow", func() error {
+		tx, err := m.DBManager.Writer.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to start transaction: %w", err)
+		}
+		defer tx.Rollback()
+
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO workflows (user_id, name, status, created_at, updated_at) VALUES (?, ?, ?, NOW(), NOW())
+		`, userID, name, StatusRunning)
+		if err != nil {
+			return fmt.Errorf("failed to insert workflow: %w", err)
+		}
+		lastID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		id = int(lastID)
+
+		for i, step := range steps {
+			after, err := json.Marshal(step.After)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO workflow_steps (workflow_id, position, name, task_type, payload, after_steps, status, updated_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, NOW())
+			`, id, i, step.Name, step.TaskType, step.Payload, string(after), StepWaiting)
+			if err != nil {
+				return fmt.Errorf("failed to insert workflow step: %w", err)
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, kverr.New(err, "user_id", userID, "workflow", name)
+	}
+	return id, nil
+}
+
+func (m *MySQLStore) GetWorkflow(ctx context.Context, id int) (*Workflow, error) {
+	var wf Workflow
+	err := timeDBOperation("get_workflow", func() error {
+		// read from the writer so a workflow is visible right after it is created or advanced
+		err := m.DBManager.Writer.QueryRowContext(ctx, `
+			SELECT id, user_id, name, status, created_at, updated_at FROM workflows WHERE id = ?
+		`, id).Scan(&wf.ID, &wf.UserID, &wf.Name, &wf.Status, &wf.CreatedAt, &wf.UpdatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrWorkflowNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		rows, err := m.DBManager.Writer.QueryContext(ctx, `
+			SELECT name, task_type, payload, after_steps, status, task_id, last_error, updated_at
+			FROM workflow_steps WHERE workflow_id = ? ORDER BY position ASC
+		`, id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var step StepStatus
+			var after string
+			var taskID sql.NullInt64
+			var lastError sql.NullString
+			if err := rows.Scan(&step.Name, &step.TaskType, &step.Payload, &after, &step.Status, &taskID, &lastError, &step.UpdatedAt); err != nil {
+				return err
+			}
+			if err := json.Unmarshal([]byte(after), &step.After); err != nil {
+				return fmt.Errorf("invalid after_steps: %w", err)
+			}
+			step.TaskID = int(taskID.Int64)
+			step.Error = lastError.String
+			wf.Steps = append(wf.Steps, step)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, kverr.New(err, "workflow_id", id)
+	}
+	return &wf, nil
+}
+
+func (m *MySQLStore) RunningWorkflows(ctx context.Context) ([]int, error) {
+	var ids []int
+	err := timeDBOperation("running_workflows", func() error {
+		rows, err := m.DBManager.Reader.QueryContext(ctx, `
+			SELECT id FROM workflows WHERE status = ? ORDER BY id ASC
+		`, StatusRunning)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (m *MySQLStore) UpdateStep(ctx context.Context, workflowID int, name string, from string, to StepStatus) (bool, error) {
+	var res sql.Result
+	err := timeDBOperation("update_step", func() error {
+		var taskID any
+		if to.TaskID != 0 {
+			taskID = to.TaskID
+		}
+		var err error
+		res, err = m.DBManager.Writer.ExecContext(ctx, `
+			UPDATE workflow_steps SET status = ?, task_id = ?, last_error = ?, updated_at = NOW()
+			WHERE workflow_id = ? AND name = ? AND status = ?
+		`, to.Status, taskID, to.Error, workflowID, name, from)
+		if err != nil {
+			return err
+		}
+		_, err = m.DBManager.Writer.ExecContext(ctx, `
+			UPDATE workflows SET updated_at = NOW() WHERE id = ?
+		`, workflowID)
+		return err
+	})
+	if err != nil {
+		return false, kverr.New(err, "workflow_id", workflowID, "step", name)
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, kverr.New(err, "workflow_id", workflowID, "step", name)
+	}
+	return count == 1, nil
+}
+
+func (m *MySQLStore) FinishWorkflow(ctx context.Context, id int, status string) error {
+	err := timeDBOperation("finish_workflow", func() error {
+		_, err := m.DBManager.Writer.ExecContext(ctx, `
+			UPDATE workflows SET status = ?, updated_at = NOW() WHERE id = ? AND status = ?
+		`, status, id, StatusRunning)
+		return err
+	})
+	if err != nil {
+		return kverr.New(err, "workflow_id", id)
+	}
+	return nil
+}
@@ -0,0 +1,494 @@
+// Package workflow runs groups of tasks that depend on each other, e.g. verify an email, then
+// create an API key and send a welcome mail in parallel, then record the signup. Each step is a
+// task on the task queue, so steps get the queue's retries and dead lettering; the workflow only
+// decides when a step is enqueued. A step is enqueued once every step it runs after has completed,
+// and a step whose task dies or is cancelled cancels every step that runs after it.
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sethgrid/kverr"
+
+	"github.com/sethgrid/helloworld/internal/taskqueue"
+)
+
+// Workflow statuses. A workflow is running until all of its steps are finished; it then is
+// complete if every step completed, failed if any step's task died, and cancelled otherwise.
+const (
+	StatusRunning   = "running"
+	StatusComplete  = "complete"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// Step statuses. A step is waiting until the steps it runs after have completed, then enqueued
+// until its task finishes, then takes the task's final status: complete, dead, or cancelled.
+const (
+	StepWaiting   = "waiting"
+	StepEnqueued  = "enqueued"
+	StepComplete  = "complete"
+	StepDead      = "dead"
+	StepCancelled = "cancelled"
+)
+
+var (
+	ErrWorkflowNotFound = errors.New("workflow not found")
+	ErrInvalidWorkflow  = errors.New("invalid workflow")
+)
+
+// Step is one task in a workflow.
+type Step struct {
+	// Name identifies the step within its workflow.
+	Name     string
+	TaskType string
+	Payload  string
+	// After lists the names of the steps that must complete before this one is enqueued. Steps
+	// with nothing to run after are enqueued as soon as the workflow is created.
+	After []string
+}
+
+// StepStatus is a step and its progress.
+type StepStatus struct {
+	Step
+	Status string
+	// TaskID is the step's task once it has been enqueued.
+	TaskID int
+	// Error is why the step didn't complete: its task's last error, or the step it ran after that failed.
+	Error     string
+	UpdatedAt time.Time
+}
+
+// Workflow is a group of steps enqueued on behalf of a user.
+type Workflow struct {
+	ID     int
+	UserID int
+	Name   string
+	Status string
+	// Steps are ordered so each step comes after the steps it runs after.
+	Steps     []StepStatus
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (w *Workflow) step(name string) *StepStatus {
+	for i := range w.Steps {
+		if w.Steps[i].Name == name {
+			return &w.Steps[i]
+		}
+	}
+	return nil
+}
+
+// Canceller cancels tasks. A taskqueue.Runner is one that also stops the handlers it is running
+// for the tasks right away, where a Tasker only marks them cancelled.
+type Canceller interface {
+	CancelTasks(ctx context.Context, filter taskqueue.TaskFilter) ([]int, error)
+}
+
+// Engine creates workflows and moves them along as their tasks finish. Every replica can run an
+// Engine against the same Store; steps only change through the Store's compare and swap, and a
+// step's task is enqueued with a dedup key, so replicas advancing the same workflow agree.
+type Engine struct {
+	tasker    taskqueue.Tasker
+	canceller Canceller
+	store     Store
+	logger    *slog.Logger
+	tick      time.Duration
+
+	mu sync.Mutex
+	wg sync.WaitGroup
+	// ctx is cancelled on Close
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// New creates an engine that checks running workflows for finished steps every tick.
+func New(tasker taskqueue.Tasker, store Store, logger *slog.Logger, tick time.Duration) *Engine {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Engine{
+		tasker:    tasker,
+		canceller: tasker,
+		store:     store,
+		logger:    logger.With("component", "workflow"),
+		tick:      tick,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// SetCanceller sets what Cancel cancels step tasks with; by default it is the engine's Tasker.
+// Pass the Runner processing the tasks so Cancel stops their handlers right away. It should be
+// called before Start.
+func (e *Engine) SetCanceller(canceller Canceller) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.canceller = canceller
+}
+
+// Create stores a new workflow for the user and enqueues the steps that don't run after any other.
+func (e *Engine) Create(ctx context.Context, userID int, name string, steps []Step) (int, error) {
+	ordered, err := sortSteps(steps)
+	if err != nil {
+		return 0, kverr.New(err, "workflow", name)
+	}
+	id, err := e.store.CreateWorkflow(ctx, userID, name, ordered)
+	if err != nil {
+		return 0, kverr.New(err, "workflow", name)
+	}
+	e.logger.Info("workflow created", "workflow_id", id, "workflow", name, "user_id", userID, "steps", len(ordered))
+
+	if err := e.advance(ctx, id); err != nil {
+		// the workflow is stored, so the next tick enqueues its first steps instead
+		log := e.logger.With(kverr.Args(err)...)
+		log.Error("unable to advance workflow", "workflow_id", id, "error", err.Error())
+	}
+	return id, nil
+}
+
+// Get returns the workflow with the given ID, or ErrWorkflowNotFound.
+func (e *Engine) Get(ctx context.Context, id int) (*Workflow, error) {
+	return e.store.GetWorkflow(ctx, id)
+}
+
+// Cancel cancels the workflow's unfinished steps and their tasks. Handlers already running are
+// stopped right away by a Runner set with SetCanceller, and otherwise the next time their runner
+// checks for cancelled tasks.
+func (e *Engine) Cancel(ctx context.Context, id int) (*Workflow, error) {
+	wf, err := e.store.GetWorkflow(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// steps are cancelled before their tasks, so an advance can't enqueue a step whose task is
+	// missed here
+	var taskIDs []int
+	for _, step := range wf.Steps {
+		taskID, err := e.cancelStep(ctx, id, step)
+		if err != nil {
+			return nil, kverr.New(err, "workflow_id", id, "step", step.Name)
+		}
+		if taskID != 0 {
+			taskIDs = append(taskIDs, taskID)
+		}
+	}
+	if len(taskIDs) > 0 {
+		if err := e.cancelTasks(ctx, taskIDs); err != nil {
+			return nil, kverr.New(err, "workflow_id", id)
+		}
+	}
+	e.logger.Info("workflow cancelled", "workflow_id", id, "workflow", wf.Name)
+
+	if err := e.advance(ctx, id); err != nil {
+		return nil, err
+	}
+	return e.store.GetWorkflow(ctx, id)
+}
+
+// cancelTasks cancels the tasks with the canceller set by SetCanceller.
+func (e *Engine) cancelTasks(ctx context.Context, taskIDs []int) error {
+	e.mu.Lock()
+	canceller := e.canceller
+	e.mu.Unlock()
+	_, err := canceller.CancelTasks(ctx, taskqueue.TaskFilter{IDs: taskIDs})
+	return err
+}
+
+// cancelStep moves an unfinished step to cancelled and returns the task it had enqueued, or 0.
+// When an advance moves the step first, e.g. enqueues it, the step is reloaded and tried again.
+func (e *Engine) cancelStep(ctx context.Context, id int, step StepStatus) (int, error) {
+	for step.Status == StepWaiting || step.Status == StepEnqueued {
+		to := step
+		to.Status = StepCancelled
+		to.Error = "workflow cancelled"
+		changed, err := e.store.UpdateStep(ctx, id, step.Name, step.Status, to)
+		if err != nil {
+			return 0, err
+		}
+		if changed {
+			return step.TaskID, nil
+		}
+
+		wf, err := e.store.GetWorkflow(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		step = *wf.step(step.Name)
+	}
+	return 0, nil
+}
+
+// Start advances running workflows until Close is called. It blocks, so call it in a goroutine.
+func (e *Engine) Start() {
+	e.mu.Lock()
+	if e.ctx.Err() != nil {
+		e.mu.Unlock()
+		return
+	}
+	e.wg.Add(1)
+	e.mu.Unlock()
+	defer e.wg.Done()
+
+	t := time.NewTicker(e.tick)
+	defer t.Stop()
+
+	for {
+		e.advanceRunning()
+
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Close stops the engine and waits for a pass in progress to finish.
+func (e *Engine) Close() error {
+	// cancel under the lock so Start can't begin once Wait starts
+	e.mu.Lock()
+	e.cancel()
+	e.mu.Unlock()
+
+	e.wg.Wait()
+	return nil
+}
+
+// advanceRunning advances every running workflow once.
+func (e *Engine) advanceRunning() {
+	ids, err := e.store.RunningWorkflows(e.ctx)
+	if err != nil {
+		if e.ctx.Err() == nil {
+			log := e.logger.With(kverr.Args(err)...)
+			log.Error("unable to list running workflows", "error", err.Error())
+		}
+		return
+	}
+	for _, id := range ids {
+		if e.ctx.Err() != nil {
+			return
+		}
+		if err := e.advance(e.ctx, id); err != nil && e.ctx.Err() == nil {
+			log := e.logger.With(kverr.Args(err)...)
+			log.Error("unable to advance workflow", "workflow_id", id, "error", err.Error())
+		}
+	}
+}
+
+// advance records the steps whose tasks finished, enqueues or cancels the steps waiting on them,
+// and finishes the workflow once every step is finished. Steps are in dependency order, so one
+// pass carries a finished step through everything that runs after it.
+func (e *Engine) advance(ctx context.Context, id int) error {
+	wf, err := e.store.GetWorkflow(ctx, id)
+	if err != nil {
+		return err
+	}
+	if wf.Status != StatusRunning {
+		return nil
+	}
+	log := e.logger.With("workflow_id", wf.ID, "workflow", wf.Name)
+
+	for i := range wf.Steps {
+		step := &wf.Steps[i]
+		var to StepStatus
+		switch step.Status {
+		case StepWaiting:
+			var ok bool
+			if to, ok, err = e.enqueueIfReady(ctx, wf, *step); err != nil {
+				return kverr.New(err, "workflow_id", wf.ID, "step", step.Name)
+			}
+			if !ok {
+				continue
+			}
+		case StepEnqueued:
+			var ok bool
+			if to, ok, err = e.checkTask(ctx, *step); err != nil {
+				return kverr.New(err, "workflow_id", wf.ID, "step", step.Name)
+			}
+			if !ok {
+				continue
+			}
+		default:
+			continue
+		}
+
+		changed, err := e.store.UpdateStep(ctx, wf.ID, step.Name, step.Status, to)
+		if err != nil {
+			return kverr.New(err, "workflow_id", wf.ID, "step", step.Name)
+		}
+		if !changed {
+			// another replica moved the step first; it carries on from there
+			if to.Status == StepEnqueued {
+				return e.cancelUnclaimedTask(ctx, wf.ID, to)
+			}
+			return nil
+		}
+		log.Info("workflow step changed", "step", step.Name, "status", to.Status, "task_id", to.TaskID, "reason", to.Error)
+		*step = to
+	}
+
+	status := finalStatus(wf.Steps)
+	if status == "" {
+		return nil
+	}
+	if err := e.store.FinishWorkflow(ctx, wf.ID, status); err != nil {
+		return kverr.New(err, "workflow_id", wf.ID)
+	}
+	log.Info("workflow finished", "status", status)
+	return nil
+}
+
+// enqueueIfReady enqueues a waiting step once the steps it runs after have completed, or cancels
+// it if one of them won't. It reports whether the step changed.
+func (e *Engine) enqueueIfReady(ctx context.Context, wf *Workflow, step StepStatus) (StepStatus, bool, error) {
+	ready := true
+	for _, name := range step.After {
+		parent := wf.step(name)
+		switch parent.Status {
+		case StepComplete:
+		case StepDead, StepCancelled:
+			// cancel right away rather than waiting on the other steps, which can't save this one
+			step.Status = StepCancelled
+			step.Error = fmt.Sprintf("step %s is %s", parent.Name, parent.Status)
+			return step, true, nil
+		default:
+			ready = false
+		}
+	}
+	if !ready {
+		return step, false, nil
+	}
+
+	// the dedup key makes enqueueing idempotent, so replicas racing here share one task
+	taskID, err := e.tasker.AddTask(ctx, wf.UserID, step.TaskType, step.Payload, taskqueue.WithDedupKey(dedupKey(wf.ID, step.Name), 0))
+	if err != nil {
+		return step, false, err
+	}
+	step.Status = StepEnqueued
+	step.TaskID = taskID
+	return step, true, nil
+}
+
+// cancelUnclaimedTask cancels the task enqueued for a step that was moved by someone else
+// before the step could record it, e.g. cancelled by Cancel. A replica that enqueued the step
+// shares the task through its dedup key, so the task is kept when the step holds it.
+func (e *Engine) cancelUnclaimedTask(ctx context.Context, id int, enqueued StepStatus) error {
+	wf, err := e.store.GetWorkflow(ctx, id)
+	if err != nil {
+		return err
+	}
+	if wf.step(enqueued.Name).TaskID == enqueued.TaskID {
+		return nil
+	}
+
+	if err := e.cancelTasks(ctx, []int{enqueued.TaskID}); err != nil {
+		return kverr.New(err, "workflow_id", id, "step", enqueued.Name, "task_id", enqueued.TaskID)
+	}
+	e.logger.Info("workflow step task cancelled", "workflow_id", id, "step", enqueued.Name, "task_id", enqueued.TaskID)
+	return nil
+}
+
+// checkTask moves an enqueued step to its task's final status once the task has one. It reports
+// whether the step changed.
+func (e *Engine) checkTask(ctx context.Context, step StepStatus) (StepStatus, bool, error) {
+	task, err := e.tasker.GetTask(ctx, step.TaskID)
+	if errors.Is(err, taskqueue.ErrTaskNotFound) {
+		// finished tasks are only deleted by retention, long after a workflow would have seen them
+		step.Status = StepDead
+		step.Error = "task not found"
+		return step, true, nil
+	}
+	if err != nil {
+		return step, false, err
+	}
+
+	switch task.Status {
+	case "complete":
+		step.Status = StepComplete
+	case "dead":
+		step.Status = StepDead
+		step.Error = task.LastError
+	case "cancelled":
+		step.Status = StepCancelled
+		step.Error = "task cancelled"
+	default:
+		return step, false, nil
+	}
+	return step, true, nil
+}
+
+// finalStatus returns the workflow's status once all of its steps are finished, or "" while any
+// step is still waiting or enqueued.
+func finalStatus(steps []StepStatus) string {
+	status := StatusComplete
+	for _, step := range steps {
+		switch step.Status {
+		case StepComplete:
+		case StepDead:
+			status = StatusFailed
+		case StepCancelled:
+			if status == StatusComplete {
+				status = StatusCancelled
+			}
+		default:
+			return ""
+		}
+	}
+	return status
+}
+
+func dedupKey(workflowID int, step string) string {
+	return fmt.Sprintf("workflow:%d:%s", workflowID, step)
+}
+
+// sortSteps checks the steps form a DAG and returns them so each step comes after the steps it
+// runs after, keeping the given order otherwise.
+func sortSteps(steps []Step) ([]Step, error) {
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%w: no steps", ErrInvalidWorkflow)
+	}
+	names := make(map[string]bool, len(steps))
+	for _, step := range steps {
+		if step.Name == "" || step.TaskType == "" {
+			return nil, fmt.Errorf("%w: every step needs a name and task type", ErrInvalidWorkflow)
+		}
+		if names[step.Name] {
+			return nil, kverr.New(fmt.Errorf("%w: duplicate step", ErrInvalidWorkflow), "step", step.Name)
+		}
+		names[step.Name] = true
+	}
+	for _, step := range steps {
+		for _, name := range step.After {
+			if !names[name] {
+				return nil, kverr.New(fmt.Errorf("%w: step runs after unknown step %q", ErrInvalidWorkflow, name), "step", step.Name)
+			}
+		}
+	}
+
+	ordered := make([]Step, 0, len(steps))
+	placed := make(map[string]bool, len(steps))
+	for len(ordered) < len(steps) {
+		progressed := false
+		for _, step := range steps {
+			if placed[step.Name] {
+				continue
+			}
+			ready := !slices.ContainsFunc(step.After, func(name string) bool { return !placed[name] })
+			if ready {
+				ordered = append(ordered, step)
+				placed[step.Name] = true
+				progressed = true
+			}
+		}
+		if !progressed {
+			return nil, fmt.Errorf("%w: steps depend on each other in a cycle", ErrInvalidWorkflow)
+		}
+	}
+	return ordered, nil
+}
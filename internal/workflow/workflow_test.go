@@ -0,0 +1,355 @@
+package workflow
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sethgrid/helloworld/internal/taskqueue"
+)
+
+// signup is the diamond from the package doc: verify, then key and welcome in parallel, then record.
+var signup = []Step{
+	{Name: "record", TaskType: "record_signup", After: []string{"key", "welcome"}},
+	{Name: "verify", TaskType: "verify_email"},
+	{Name: "key", TaskType: "create_api_key", After: []string{"verify"}},
+	{Name: "welcome", TaskType: "send_welcome", Payload: `{"template":"welcome"}`, After: []string{"verify"}},
+}
+
+func newTestEngine(q taskqueue.Tasker, store Store) *Engine {
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	return New(q, store, log, time.Hour)
+}
+
+// stepStatuses returns each step's status by name.
+func stepStatuses(t *testing.T, e *Engine, id int) map[string]string {
+	t.Helper()
+	wf, err := e.Get(context.Background(), id)
+	require.NoError(t, err)
+	statuses := make(map[string]string)
+	for _, step := range wf.Steps {
+		statuses[step.Name] = step.Status
+	}
+	return statuses
+}
+
+// finishStep gives the step's task a final status the way a worker or an admin would.
+func finishStep(t *testing.T, e *Engine, q taskqueue.Tasker, id int, name string, status string) {
+	t.Helper()
+	ctx := context.Background()
+	wf, err := e.Get(ctx, id)
+	require.NoError(t, err)
+	step := wf.step(name)
+	require.Equal(t, StepEnqueued, step.Status, "step %s", name)
+
+	switch status {
+	case "complete":
+		require.NoError(t, q.MarkTaskComplete(ctx, step.TaskID, "", ""))
+	case "dead":
+		require.NoError(t, q.MarkTaskDead(ctx, step.TaskID, "", "smtp down"))
+	}
+	require.NoError(t, e.advance(ctx, id))
+}
+
+func TestWorkflowRunsStepsInOrder(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)
+	e := newTestEngine(q, NewMemoryStore())
+
+	id, err := e.Create(ctx, 7, "signup", signup)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"verify": StepEnqueued, "key": StepWaiting, "welcome": StepWaiting, "record": StepWaiting}, stepStatuses(t, e, id))
+
+	finishStep(t, e, q, id, "verify", "complete")
+	assert.Equal(t, map[string]string{"verify": StepComplete, "key": StepEnqueued, "welcome": StepEnqueued, "record": StepWaiting}, stepStatuses(t, e, id))
+
+	finishStep(t, e, q, id, "welcome", "complete")
+	assert.Equal(t, StepWaiting, stepStatuses(t, e, id)["record"], "record waits for every step it runs after")
+
+	finishStep(t, e, q, id, "key", "complete")
+	finishStep(t, e, q, id, "record", "complete")
+
+	wf, err := e.Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, StatusComplete, wf.Status)
+	assert.Equal(t, []string{"verify", "key", "welcome", "record"}, []string{wf.Steps[0].Name, wf.Steps[1].Name, wf.Steps[2].Name, wf.Steps[3].Name}, "steps are kept in dependency order")
+
+	task, err := q.GetTask(ctx, wf.step("welcome").TaskID)
+	require.NoError(t, err)
+	assert.Equal(t, 7, task.UserID)
+	assert.Equal(t, "send_welcome", task.TaskType)
+	assert.Equal(t, `{"template":"welcome"}`, task.Payload)
+}
+
+func TestWorkflowDeadStepCancelsDependents(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)
+	e := newTestEngine(q, NewMemoryStore())
+
+	id, err := e.Create(ctx, 7, "signup", signup)
+	require.NoError(t, err)
+	finishStep(t, e, q, id, "verify", "complete")
+	finishStep(t, e, q, id, "welcome", "dead")
+
+	// record runs after welcome so it is cancelled; key doesn't, so it keeps running
+	assert.Equal(t, map[string]string{"verify": StepComplete, "key": StepEnqueued, "welcome": StepDead, "record": StepCancelled}, stepStatuses(t, e, id))
+	wf, err := e.Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, StatusRunning, wf.Status)
+	assert.Equal(t, "smtp down", wf.step("welcome").Error)
+	assert.Equal(t, "step welcome is dead", wf.step("record").Error)
+
+	finishStep(t, e, q, id, "key", "complete")
+	wf, err = e.Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, StatusFailed, wf.Status)
+}
+
+func TestWorkflowCancel(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)
+	e := newTestEngine(q, NewMemoryStore())
+
+	id, err := e.Create(ctx, 7, "signup", signup)
+	require.NoError(t, err)
+	wf, err := e.Cancel(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, StatusCancelled, wf.Status)
+	for _, step := range wf.Steps {
+		assert.Equal(t, StepCancelled, step.Status, "step %s", step.Name)
+	}
+
+	task, err := q.GetTask(ctx, wf.step("verify").TaskID)
+	require.NoError(t, err)
+	assert.Equal(t, "cancelled", task.Status)
+}
+
+// racingStore lets a test act at the points where Cancel and advance race each other.
+type racingStore struct {
+	Store
+	// stale, when set, is returned by the next GetWorkflow in place of the stored workflow
+	stale *Workflow
+	// beforeEnqueue, when set, runs once before a step is moved to enqueued
+	beforeEnqueue func()
+}
+
+func (s *racingStore) GetWorkflow(ctx context.Context, id int) (*Workflow, error) {
+	if wf := s.stale; wf != nil {
+		s.stale = nil
+		return wf, nil
+	}
+	return s.Store.GetWorkflow(ctx, id)
+}
+
+func (s *racingStore) UpdateStep(ctx context.Context, workflowID int, name string, from string, to StepStatus) (bool, error) {
+	if fn := s.beforeEnqueue; fn != nil && to.Status == StepEnqueued {
+		s.beforeEnqueue = nil
+		fn()
+	}
+	return s.Store.UpdateStep(ctx, workflowID, name, from, to)
+}
+
+func TestWorkflowCancelRacesAdvance(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	steps := []Step{
+		{Name: "verify", TaskType: "verify_email"},
+		{Name: "welcome", TaskType: "send_welcome", After: []string{"verify"}},
+	}
+
+	t.Run("step enqueued after cancel loaded it", func(t *testing.T) {
+		q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)
+		store := &racingStore{Store: NewMemoryStore()}
+		e := newTestEngine(q, store)
+		id, err := e.Create(ctx, 7, "signup", steps)
+		require.NoError(t, err)
+		loaded, err := e.Get(ctx, id)
+		require.NoError(t, err)
+		finishStep(t, e, q, id, "verify", "complete")
+
+		// Cancel sees welcome waiting, but it was enqueued since
+		store.stale = loaded
+		wf, err := e.Cancel(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, StatusCancelled, wf.Status)
+		welcome := wf.step("welcome")
+		assert.Equal(t, StepCancelled, welcome.Status)
+		require.NotZero(t, welcome.TaskID)
+		task, err := q.GetTask(ctx, welcome.TaskID)
+		require.NoError(t, err)
+		assert.Equal(t, "cancelled", task.Status)
+	})
+
+	t.Run("cancelled while its task is enqueued", func(t *testing.T) {
+		q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)
+		store := &racingStore{Store: NewMemoryStore()}
+		e := newTestEngine(q, store)
+		id, err := e.Create(ctx, 7, "signup", steps)
+		require.NoError(t, err)
+		wf, err := e.Get(ctx, id)
+		require.NoError(t, err)
+		require.NoError(t, q.MarkTaskComplete(ctx, wf.step("verify").TaskID, "", ""))
+
+		// advance adds welcome's task, then finds the step cancelled before it can record it
+		store.beforeEnqueue = func() {
+			_, err := e.Cancel(ctx, id)
+			require.NoError(t, err)
+		}
+		require.NoError(t, e.advance(ctx, id))
+
+		counts, err := q.CountTasks(ctx)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []taskqueue.TaskCount{
+			{Status: "complete", TaskType: "verify_email", Count: 1},
+			{Status: "cancelled", TaskType: "send_welcome", Count: 1},
+		}, counts)
+	})
+}
+
+func TestWorkflowCancelStopsHandler(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)
+
+	// the runner wakes on enqueue but only polls for cancelled tasks hourly, so only Cancel
+	// going through it can stop the handler in time
+	runner := taskqueue.NewRunner(q, 1, log, time.Hour)
+	started := make(chan struct{})
+	stopped := make(chan error, 1)
+	runner.Register("verify_email", func(ctx context.Context, task taskqueue.Task) (string, error) {
+		close(started)
+		<-ctx.Done()
+		stopped <- context.Cause(ctx)
+		return "", ctx.Err()
+	})
+	go runner.Start()
+	defer runner.Close()
+
+	e := newTestEngine(q, NewMemoryStore())
+	e.SetCanceller(runner)
+	id, err := e.Create(ctx, 7, "signup", signup)
+	require.NoError(t, err)
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("handler was not called")
+	}
+
+	_, err = e.Cancel(ctx, id)
+	require.NoError(t, err)
+	select {
+	case cause := <-stopped:
+		assert.ErrorIs(t, cause, taskqueue.ErrTaskCancelled)
+	case <-time.After(time.Second):
+		t.Fatal("handler was not stopped")
+	}
+}
+
+func TestWorkflowReplicasEnqueueOnce(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)
+	store := NewMemoryStore()
+	a := newTestEngine(q, store)
+	b := newTestEngine(q, store)
+
+	id, err := a.Create(ctx, 7, "signup", signup)
+	require.NoError(t, err)
+	finishStep(t, a, q, id, "verify", "complete")
+
+	var wg sync.WaitGroup
+	for _, e := range []*Engine{a, b, a, b} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, e.advance(ctx, id))
+		}()
+	}
+	wg.Wait()
+
+	counts, err := q.CountTasks(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []taskqueue.TaskCount{
+		{Status: "complete", TaskType: "verify_email", Count: 1},
+		{Status: "open", TaskType: "create_api_key", Count: 1},
+		{Status: "open", TaskType: "send_welcome", Count: 1},
+	}, counts)
+}
+
+func TestWorkflowWithRunner(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)
+
+	runner := taskqueue.NewRunner(q, 2, log, 10*time.Millisecond)
+	var mu sync.Mutex
+	var ran []string
+	for _, step := range signup {
+		runner.Register(step.TaskType, func(ctx context.Context, task taskqueue.Task) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, task.TaskType)
+			return "", nil
+		})
+	}
+	go runner.Start()
+	defer runner.Close()
+
+	e := New(q, NewMemoryStore(), log, 10*time.Millisecond)
+	go e.Start()
+	defer e.Close()
+
+	id, err := e.Create(ctx, 7, "signup", signup)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		wf, err := e.Get(ctx, id)
+		require.NoError(t, err)
+		return wf.Status == StatusComplete
+	}, 2*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, ran, 4)
+	assert.Equal(t, "verify_email", ran[0])
+	assert.Equal(t, "record_signup", ran[3])
+}
+
+func TestCreateInvalidWorkflow(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []Step
+	}{
+		{name: "no steps"},
+		{name: "missing task type", steps: []Step{{Name: "a"}}},
+		{name: "duplicate step", steps: []Step{{Name: "a", TaskType: "t"}, {Name: "a", TaskType: "t"}}},
+		{name: "unknown step", steps: []Step{{Name: "a", TaskType: "t", After: []string{"b"}}}},
+		{name: "cycle", steps: []Step{
+			{Name: "a", TaskType: "t", After: []string{"c"}},
+			{Name: "b", TaskType: "t", After: []string{"a"}},
+			{Name: "c", TaskType: "t", After: []string{"b"}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+			q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)
+			e := newTestEngine(q, NewMemoryStore())
+
+			_, err := e.Create(context.Background(), 7, "bad", tt.steps)
+			assert.ErrorIs(t, err, ErrInvalidWorkflow)
+			counts, err := q.CountTasks(context.Background())
+			require.NoError(t, err)
+			assert.Empty(t, counts)
+		})
+	}
+}
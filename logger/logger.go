@@ -23,6 +23,10 @@ type contextKey string
 
 var CtxLogger contextKey = "logger"
 
+// CtxRequestID holds the rid of the request logger so it can outlive the request, e.g. when
+// the request enqueues a background task.
+var CtxRequestID contextKey = "rid"
+
 func New(logWriter ...io.Writer) *slog.Logger {
 	var writer io.Writer = os.Stdout
 	if len(logWriter) == 1 {
@@ -35,6 +39,17 @@ func AddToCtx(ctx context.Context, l *slog.Logger) context.Context {
 	return context.WithValue(ctx, CtxLogger, l)
 }
 
+// AddRequestIDToCtx stores the rid that the context's logger was created with.
+func AddRequestIDToCtx(ctx context.Context, rid string) context.Context {
+	return context.WithValue(ctx, CtxRequestID, rid)
+}
+
+// RequestIDFromCtx returns the rid set by NewRequestLogger, or "" if the context did not come from a request.
+func RequestIDFromCtx(ctx context.Context) string {
+	rid, _ := ctx.Value(CtxRequestID).(string)
+	return rid
+}
+
 // FromRequest takes the server logger instance as a backup logger if none are found.
 // notice that the backup is variadic; that allows you to _exclude_ the final parameter.
 // this is a hack to allow FromRequest(ctx) and FromRequest(ctx, backupLogger).
@@ -79,8 +94,10 @@ func NewRequestLogger(ctx context.Context, r *http.Request, log *slog.Logger) (*
 	}
 
 	// No logger exists, create a new one
-	newLogger := log.With("rid", uuid.NewString())
+	rid := uuid.NewString()
+	newLogger := log.With("rid", rid)
 	ctx = context.WithValue(ctx, CtxLogger, newLogger)
+	ctx = AddRequestIDToCtx(ctx, rid)
 
 	return newLogger, ctx, r.WithContext(ctx)
 }
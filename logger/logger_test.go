@@ -2,6 +2,7 @@ package logger
 
 import (
 	"bytes"
+	"context"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
@@ -116,3 +117,28 @@ func TestPrintable(t *testing.T) {
 		})
 	}
 }
+
+// TestMiddlewareRequestID verifies the rid logged for a request can be read back from its
+// context, which is how it follows the request into background tasks.
+func TestMiddlewareRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	var rid string
+	router := chi.NewRouter()
+	router.Use(Middleware(log, true))
+	router.Get("/api/users", func(w http.ResponseWriter, r *http.Request) {
+		rid = RequestIDFromCtx(r.Context())
+	})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/users", nil))
+
+	if rid == "" {
+		t.Fatal("expected a request id in the request context")
+	}
+	if !strings.Contains(buf.String(), `"rid":"`+rid+`"`) {
+		t.Errorf("expected rid %s in log output, got: %s", rid, buf.String())
+	}
+	if got := RequestIDFromCtx(context.Background()); got != "" {
+		t.Errorf("RequestIDFromCtx() = %q outside a request, want empty", got)
+	}
+}
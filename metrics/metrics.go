@@ -97,6 +97,85 @@ var (
 		[]string{"store", "operation"},
 	)
 
+	// Task queue metrics, labeled by the named queue a task runs on
+	TaskQueueOperationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "taskqueue_operation_duration_seconds",
+			Help:    "Histogram of task queue store operation duration per queue",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"queue", "operation"},
+	)
+
+	TaskWorkersBusy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "taskqueue_workers_busy",
+			Help: "Current number of task runner workers processing a task",
+		},
+		[]string{"queue"},
+	)
+
+	// TaskUserInFlight is per runner process, so aggregate it with sum
+	TaskUserInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "taskqueue_user_tasks_in_flight",
+			Help: "Current number of tasks being processed per user",
+		},
+		[]string{"user_id"},
+	)
+
+	// TaskCount is refreshed by every runner from the shared task store, so aggregate it with max, not sum
+	TaskCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "taskqueue_tasks",
+			Help: "Current number of tasks in the task store per status and task type",
+		},
+		[]string{"status", "task_type"},
+	)
+
+	TaskStartDelay = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "taskqueue_task_start_delay_seconds",
+			Help:    "Histogram of time from when a task could first run (enqueue or run-at time) to its first attempt starting",
+			Buckets: []float64{.01, .05, .1, .5, 1, 5, 15, 30, 60, 300, 900, 1800, 3600},
+		},
+		[]string{"queue", "task_type"},
+	)
+
+	TaskHandlerDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "taskqueue_handler_duration_seconds",
+			Help:    "Histogram of task handler duration per attempt",
+			Buckets: []float64{.005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 900},
+		},
+		[]string{"queue", "task_type"},
+	)
+
+	TaskOutcomes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "taskqueue_task_outcomes_total",
+			Help: "Total number of task attempts per outcome: complete, retry, dead, cancelled, lease_lost, or released",
+		},
+		[]string{"queue", "task_type", "outcome"},
+	)
+
+	TasksSwept = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "taskqueue_tasks_swept_total",
+			Help: "Total number of finished tasks removed from the task store by the retention sweeper",
+		},
+		[]string{"status"},
+	)
+
+	TaskAttempts = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "taskqueue_task_attempts",
+			Help:    "Histogram of attempts a task took once it completed or died",
+			Buckets: []float64{1, 2, 3, 5, 10, 20},
+		},
+		[]string{"task_type", "outcome"},
+	)
+
 	// External API call timing metrics
 	APICallDuration = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -134,6 +213,16 @@ func init() {
 	prometheus.MustRegister(DBConnectionsMaxLifetimeClosed)
 	// Database query timing
 	prometheus.MustRegister(DBQueryDuration)
+	// Task queue metrics
+	prometheus.MustRegister(TaskQueueOperationDuration)
+	prometheus.MustRegister(TaskWorkersBusy)
+	prometheus.MustRegister(TaskUserInFlight)
+	prometheus.MustRegister(TaskCount)
+	prometheus.MustRegister(TaskStartDelay)
+	prometheus.MustRegister(TaskHandlerDuration)
+	prometheus.MustRegister(TaskOutcomes)
+	prometheus.MustRegister(TaskAttempts)
+	prometheus.MustRegister(TasksSwept)
 	// External API call metrics
 	prometheus.MustRegister(APICallDuration)
 	prometheus.MustRegister(APICallCount)
@@ -0,0 +1,23 @@
+-- tasks was only created by sql/bootstrap.sql; the task migrations that follow alter it, so
+-- migrated databases need it first. These are its columns before those migrations.
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS `tasks` (
+  `id` BIGINT(20) UNSIGNED NOT NULL AUTO_INCREMENT,
+  `user_id` BIGINT(20) NOT NULL,
+  `task_type` VARCHAR(255) NOT NULL,
+  `payload` TEXT NOT NULL,
+  `status` VARCHAR(32) NOT NULL DEFAULT 'open',
+  `attempts` INT NOT NULL DEFAULT 0,
+  `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  primary key (`id`),
+  index `status_created` (`status`, `created_at`),
+  index `uid` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS `tasks`;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  ADD COLUMN `next_attempt_at` DATETIME NULL DEFAULT NULL AFTER `attempts`,
+  ADD COLUMN `last_error` TEXT NULL AFTER `next_attempt_at`;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  DROP COLUMN `last_error`,
+  DROP COLUMN `next_attempt_at`;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- next_attempt_at doubles as the run-at time for delayed tasks, so fetching due tasks
+-- filters on status and next_attempt_at together.
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  ADD INDEX `status_next_attempt` (`status`, `next_attempt_at`);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  DROP INDEX `status_next_attempt`;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- last_run_at is the scheduled time of the most recent run. Replicas claim a run by moving it
+-- forward from the value they read, so only one of them enqueues the task.
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE `scheduled_jobs` (
+  `name` VARCHAR(255) NOT NULL,
+  `last_run_at` DATETIME NOT NULL,
+  `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  primary key (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE `scheduled_jobs`;
+-- +goose StatementEnd
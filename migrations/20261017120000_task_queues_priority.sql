@@ -0,0 +1,16 @@
+-- Tasks are fetched per queue, highest priority first, then oldest first.
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  ADD COLUMN `queue` VARCHAR(64) NOT NULL DEFAULT 'default' AFTER `payload`,
+  ADD COLUMN `priority` INT NOT NULL DEFAULT 0 AFTER `queue`,
+  ADD INDEX `queue_status_priority` (`queue`, `status`, `priority`, `created_at`);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  DROP INDEX `queue_status_priority`,
+  DROP COLUMN `priority`,
+  DROP COLUMN `queue`;
+-- +goose StatementEnd
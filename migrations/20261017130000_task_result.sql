@@ -0,0 +1,12 @@
+-- result holds the output a handler returned when the task completed, for clients polling the task.
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  ADD COLUMN `result` TEXT NULL AFTER `last_error`;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  DROP COLUMN `result`;
+-- +goose StatementEnd
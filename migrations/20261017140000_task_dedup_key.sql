@@ -0,0 +1,17 @@
+-- dedup_key makes enqueueing idempotent. The unique index is the backstop for concurrent
+-- enqueues; NULL keys are not unique checked, so tasks without a key are unaffected.
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  ADD COLUMN `dedup_key` VARCHAR(255) NULL DEFAULT NULL AFTER `result`,
+  ADD COLUMN `dedup_expires_at` DATETIME NULL DEFAULT NULL AFTER `dedup_key`,
+  ADD UNIQUE KEY `dedup_key` (`dedup_key`);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  DROP INDEX `dedup_key`,
+  DROP COLUMN `dedup_expires_at`,
+  DROP COLUMN `dedup_key`;
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- A checkout is now a lease: lease_token identifies the worker holding the task and
+-- lease_expires_at replaces updated_at as the re-checkout deadline. Tasks checked out before the
+-- migration get the deadline they would have had under the old 30s re-checkout rule.
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  ADD COLUMN `lease_token` VARCHAR(36) NULL DEFAULT NULL AFTER `dedup_expires_at`,
+  ADD COLUMN `lease_expires_at` DATETIME NULL DEFAULT NULL AFTER `lease_token`,
+  ADD INDEX `status_lease` (`status`, `lease_expires_at`);
+-- +goose StatementEnd
+-- +goose StatementBegin
+UPDATE `tasks`
+  SET `lease_expires_at` = DATE_ADD(`updated_at`, INTERVAL 30 SECOND)
+  WHERE `status` = 'checked_out';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  DROP INDEX `status_lease`,
+  DROP COLUMN `lease_expires_at`,
+  DROP COLUMN `lease_token`;
+-- +goose StatementEnd
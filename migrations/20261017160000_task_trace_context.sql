@@ -0,0 +1,15 @@
+-- trace_parent and request_id record where a task was enqueued from so each attempt can be
+-- correlated with the request that created it. trace_parent is a W3C traceparent, 55 chars.
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  ADD COLUMN `trace_parent` VARCHAR(55) NULL DEFAULT NULL AFTER `lease_expires_at`,
+  ADD COLUMN `request_id` VARCHAR(64) NULL DEFAULT NULL AFTER `trace_parent`;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  DROP COLUMN `request_id`,
+  DROP COLUMN `trace_parent`;
+-- +goose StatementEnd
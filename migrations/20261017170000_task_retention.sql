@@ -0,0 +1,40 @@
+-- The retention sweeper deletes finished tasks by status and age, optionally copying them into
+-- tasks_archive first. updated_at is when a finished task finished.
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  ADD INDEX `status_updated` (`status`, `updated_at`);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TABLE `tasks_archive` (
+  `id` BIGINT(20) UNSIGNED NOT NULL,
+  `user_id` BIGINT(20) NOT NULL,
+  `status` VARCHAR(32) NOT NULL,
+  `task_type` VARCHAR(255) NOT NULL,
+  `payload` TEXT NOT NULL,
+  `queue` VARCHAR(64) NOT NULL,
+  `priority` INT NOT NULL,
+  `attempts` INT NOT NULL,
+  `last_error` TEXT NULL,
+  `result` TEXT NULL,
+  `trace_parent` VARCHAR(55) NULL DEFAULT NULL,
+  `request_id` VARCHAR(64) NULL DEFAULT NULL,
+  `created_at` DATETIME NULL,
+  `updated_at` DATETIME NULL,
+  `archived_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+  primary key (`id`),
+  index `archived` (`archived_at`),
+  index `uid` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE `tasks_archive`;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  DROP INDEX `status_updated`;
+-- +goose StatementEnd
@@ -0,0 +1,12 @@
+-- Round-robin checkouts count and fetch due tasks per user within a queue.
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  ADD INDEX `queue_user_status` (`queue`, `user_id`, `status`);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE `tasks`
+  DROP INDEX `queue_user_status`;
+-- +goose StatementEnd
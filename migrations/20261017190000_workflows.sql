@@ -0,0 +1,40 @@
+-- A workflow is a group of tasks that run after each other. Steps are enqueued as tasks once the
+-- steps listed in after_steps (a JSON array of step names) have completed.
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE `workflows` (
+  `id` BIGINT(20) UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT(20) NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `status` VARCHAR(32) NOT NULL,
+  `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  index `status` (`status`),
+  index `uid` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TABLE `workflow_steps` (
+  `workflow_id` BIGINT(20) UNSIGNED NOT NULL,
+  `position` INT NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `task_type` VARCHAR(255) NOT NULL,
+  `payload` TEXT NOT NULL,
+  `after_steps` TEXT NOT NULL,
+  `status` VARCHAR(32) NOT NULL,
+  `task_id` BIGINT(20) UNSIGNED NULL DEFAULT NULL,
+  `last_error` TEXT NULL,
+  `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  primary key (`workflow_id`, `name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE `workflow_steps`;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP TABLE `workflows`;
+-- +goose StatementEnd
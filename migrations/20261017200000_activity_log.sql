@@ -0,0 +1,22 @@
+-- activity_log was only created by sql/bootstrap.sql; events.UserEvent now writes to it, so
+-- migrated databases need it too.
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS `activity_log` (
+    `id` BIGINT(20) UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+    `type` VARCHAR(255) NOT NULL,
+    `user_id` BIGINT NOT NULL,
+    `message` VARCHAR(255) NOT NULL,
+    `request_path` VARCHAR(255),
+    `request_verb` VARCHAR(6),
+    `matcher_id` BIGINT NOT NULL,
+    `apikey_id` BIGINT NOT NULL,
+    `is_public` TINYINT(1) NOT NULL DEFAULT 1,
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS `activity_log`;
+-- +goose StatementEnd
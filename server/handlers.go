@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/sethgrid/helloworld/internal/events"
 	"github.com/sethgrid/helloworld/logger"
 
 	"github.com/sethgrid/kverr"
@@ -113,7 +114,12 @@ func someWorkThatChecksContextDeadline(ctx context.Context) error {
 // showing how faked dependencies bubble up in test assertions.
 // This is a standalone function that receives dependencies as parameters.
 func DoSomethingWithEvents(eventStore eventWriter, logger *slog.Logger) error {
-	err := eventStore.Write(180, "a message in a bottle")
+	err := eventStore.Write(context.Background(), events.Event{
+		Type:     events.TypeMessage,
+		UserID:   180,
+		Message:  "a message in a bottle",
+		IsPublic: true,
+	})
 	if err != nil {
 		logger.Error(err.Error())
 		return fmt.Errorf("unable to DoSomethingWithEvents: %w", err)
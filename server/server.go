@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -29,8 +30,10 @@ import (
 
 	"github.com/sethgrid/helloworld/internal/db"
 	"github.com/sethgrid/helloworld/internal/events"
+	"github.com/sethgrid/helloworld/internal/scheduler"
 	"github.com/sethgrid/helloworld/internal/taskqueue"
 	"github.com/sethgrid/helloworld/internal/tracing"
+	"github.com/sethgrid/helloworld/internal/workflow"
 	"github.com/sethgrid/helloworld/logger"
 )
 
@@ -51,14 +54,15 @@ func maskDSN(dsn string) string {
 }
 
 type eventWriter interface {
-	Write(userID int64, message string) error
+	Write(ctx context.Context, event events.Event) error
+	ScheduledWork(ctx context.Context) error
 	Close() error
 	IsAvailable() bool
 }
 
 type Server struct {
 	config     Config
-	taskq      taskqueue.Tasker
+	taskq      taskqueue.TxTasker
 	eventStore eventWriter
 	addr       string
 	protocol   string
@@ -73,8 +77,12 @@ type Server struct {
 	internalHTTPServer *http.Server
 	publicHTTPServer   *http.Server
 
-	parentLogger *slog.Logger
-	taskRunner   *taskqueue.Runner // Task queue runner for graceful shutdown
+	parentLogger  *slog.Logger
+	taskRunner    *taskqueue.Runner    // Task queue runner for graceful shutdown
+	scheduler     *scheduler.Scheduler // Enqueues recurring jobs; closed on shutdown
+	scheduleStore scheduler.Store      // Persists scheduled job last runs
+	workflows     *workflow.Engine     // Advances workflows as their tasks finish; closed on shutdown
+	workflowStore workflow.Store       // Persists workflows and their steps
 
 	tracerShutdown func(context.Context) error
 	tracingEnabled bool
@@ -185,7 +193,22 @@ func New(conf Config) (*Server, error) {
 	}
 
 	addr := fmt.Sprintf("%s:%d", conf.Hostname, conf.Port)
-	taskq := taskqueue.NewMySQLTaskQueue(dbManager, rootLogger, 3, 30*time.Second)
+	fairness := taskqueue.Fairness{RoundRobin: conf.TaskRoundRobin, MaxPerUser: conf.TaskMaxPerUser}
+	var taskq taskqueue.TxTasker
+	if conf.TaskFile != "" {
+		fileq, err := taskqueue.NewFileTaskQueue(conf.TaskFile, 3, conf.TaskExpiration, rootLogger)
+		if err != nil {
+			dbManager.Close()
+			return nil, fmt.Errorf("unable to open task file: %w", err)
+		}
+		fileq.Fairness = fairness
+		taskq = fileq
+	} else {
+		mysqlq := taskqueue.NewMySQLTaskQueue(dbManager, rootLogger, 3, conf.TaskExpiration)
+		mysqlq.Archive = conf.TaskArchive
+		mysqlq.Fairness = fairness
+		taskq = mysqlq
+	}
 	eventStore := events.NewUserEvent(dbManager, 2, rootLogger)
 
 	return &Server{config: conf,
@@ -197,6 +220,8 @@ func New(conf Config) (*Server, error) {
 		secureCookies:  conf.ShouldSecure,
 		taskq:          taskq,
 		eventStore:     eventStore,
+		scheduleStore:  scheduler.NewMySQLStore(dbManager),
+		workflowStore:  workflow.NewMySQLStore(dbManager),
 		dbManager:      dbManager,
 		tracerShutdown: tracerShutdown,
 		tracingEnabled: tracingEnabled,
@@ -257,16 +282,30 @@ func (s *Server) Close() error {
 		})
 	}
 
-	if s.taskRunner != nil {
-		// Launch a goroutine to close the task queue runner
-		g.Go(func() error {
-			err := s.taskRunner.Close()
-			if err != nil {
+	// Launch a goroutine to close the task queue runner. The scheduler and workflow engine enqueue
+	// tasks, so they are stopped first rather than left running against a closed task store.
+	g.Go(func() error {
+		var errs []error
+		if s.scheduler != nil {
+			if err := s.scheduler.Close(); err != nil {
+				s.parentLogger.Error("unable to close scheduler", "error", err.Error())
+				errs = append(errs, err)
+			}
+		}
+		if s.workflows != nil {
+			if err := s.workflows.Close(); err != nil {
+				s.parentLogger.Error("unable to close workflow engine", "error", err.Error())
+				errs = append(errs, err)
+			}
+		}
+		if s.taskRunner != nil {
+			if err := s.taskRunner.Close(); err != nil {
 				s.parentLogger.Error("unable to close task queue runner", "error", err.Error())
+				errs = append(errs, err)
 			}
-			return err
-		})
-	}
+		}
+		return errors.Join(errs...)
+	})
 
 	if s.dbManager != nil {
 		g.Go(func() error {
@@ -357,6 +396,41 @@ func (s *Server) InDebug() bool {
 }
 
 func (s *Server) Serve() error {
+	// recurring jobs enqueue tasks on a schedule; their work is done by the task handlers registered below
+	sched := scheduler.New(s.taskq, s.scheduleStore, s.parentLogger, time.Second)
+	if err := sched.Register(scheduler.Job{Name: "events_scheduled_work", Spec: "@hourly", TaskType: taskTypeEventsScheduledWork}); err != nil {
+		return fmt.Errorf("unable to register scheduled job: %w", err)
+	}
+
+	runner := taskqueue.NewRunner(s.taskq, 1, s.parentLogger, 15*time.Second)
+	// tasks added by this replica wake the runner; tasks added by other replicas are found by a poll
+	// that tightens to every 500ms while tasks are flowing and relaxes to 15s when idle
+	runner.SetMinPollInterval(500 * time.Millisecond)
+	runner.SetDefaultTimeout(s.config.TaskTimeout)
+	runner.SetRetention(taskqueue.RetentionPolicy{Keep: map[string]time.Duration{
+		"complete":  s.config.TaskRetentionComplete,
+		"dead":      s.config.TaskRetentionDead,
+		"cancelled": s.config.TaskRetentionCancelled,
+	}})
+	if s.config.TaskTimeout > 0 && s.config.TaskExpiration > 0 && s.config.TaskTimeout >= s.config.TaskExpiration {
+		s.parentLogger.Warn("task timeout is not below task expiration; long attempts can be checked out again before they time out",
+			"task_timeout", s.config.TaskTimeout.String(), "task_expiration", s.config.TaskExpiration.String())
+	}
+	// all task handlers should be registered below, before the runner starts
+	userEventTask.Register(runner, handleUserEventTask(s.eventStore))
+	runner.Register(taskTypeEventsScheduledWork, handleEventsScheduledWork(s.eventStore), taskqueue.WithMaxAttempts(1))
+
+	// workflows enqueue each step once the steps it runs after complete; see internal/workflow
+	workflows := workflow.New(s.taskq, s.workflowStore, s.parentLogger, time.Second)
+	// cancelling goes through the runner so handlers of steps running here stop right away
+	workflows.SetCanceller(runner)
+
+	s.mu.Lock()
+	s.scheduler = sched
+	s.taskRunner = runner
+	s.workflows = workflows
+	s.mu.Unlock()
+
 	// privateRouter is for internal only endpoints
 	// this mux server will be spun up at the end of Serve() along side the standard router
 	privateRouter := chi.NewRouter()
@@ -364,7 +438,18 @@ func (s *Server) Serve() error {
 	// Health check uses eventStore to check DB connectivity
 	// Both taskq and eventStore use the same DB, so either works
 	privateRouter.Get("/healthcheck", handleHealthcheck(s.eventStore))
-	privateRouter.Get("/status", handleStatus(s.eventStore, s.config.Version))
+	privateRouter.Get("/status", handleStatus(s.eventStore, sched, runner, s.config.Version))
+	// dead letter queue inspection; see taskFilterFromRequest for the supported filters
+	privateRouter.Get("/tasks/dead", handleListDeadTasks(s.taskq))
+	privateRouter.Post("/tasks/dead/requeue", handleRequeueDeadTasks(s.taskq))
+	privateRouter.Delete("/tasks/dead", handlePurgeDeadTasks(s.taskq))
+	// cancelling goes through the runner so handlers of tasks running here stop right away
+	privateRouter.Post("/tasks/cancel", handleCancelTasks(runner))
+	// incident controls for this replica's runner; each responds with the state also shown on /status
+	privateRouter.Post("/tasks/pause", handlePauseTasks(runner))
+	privateRouter.Post("/tasks/resume", handleResumeTasks(runner))
+	privateRouter.Post("/tasks/drain", handleDrainTasks(runner))
+	privateRouter.Post("/workflows/{id}/cancel", handleCancelWorkflow(workflows))
 
 	// all application routes should be defined below
 	router := s.newRouter()
@@ -375,6 +460,11 @@ func (s *Server) Serve() error {
 	// Logger is injected via middleware and accessed through request context.
 	// Rate limiting is applied only to the hello world endpoint
 	router.With(rateLimitMiddleware(s.config.RateLimitRPS)).Get("/", handleHelloworld(s.eventStore))
+	// task status polling and workflows are scoped to the user in the request context (ctxUser); they
+	// respond 401 without one
+	router.Get("/tasks/{id}", handleGetTask(s.taskq))
+	router.Post("/workflows", handleCreateWorkflow(workflows, userWorkflowTaskTypes))
+	router.Get("/workflows/{id}", handleGetWorkflow(workflows))
 
 	// normally we use a defer for unlocking
 	// we are not doing that here because http.Serve below is a blocking call
@@ -457,9 +547,9 @@ func (s *Server) Serve() error {
 		)
 	}()
 
-	runner := taskqueue.NewRunner(s.taskq, 1, s.parentLogger, 15*time.Second)
-	s.taskRunner = runner
 	go runner.Start()
+	go sched.Start()
+	go workflows.Start()
 
 	publicHTTP := http.Server{
 		ReadTimeout:       s.config.RequestTimeout,
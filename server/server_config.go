@@ -26,11 +26,24 @@ type Config struct {
 	EnableSocialLogin bool          `default:"false" envconfig:"enable_social_login"`
 	ShouldSecure      bool          `default:"false" envconfig:"should_secure"`
 	EnableDebug       bool          `default:"true" envconfig:"enable_debug"`
-	TaskExpiration    time.Duration `default:"1m" envconfig:"task_expiration"`
+	TaskFile          string        `default:"" envconfig:"task_file"`         // when set, tasks are kept in this local file instead of MySQL
+	TaskExpiration    time.Duration `default:"1m" envconfig:"task_expiration"` // task checkout length before another worker can take it
+	TaskTimeout       time.Duration `default:"30s" envconfig:"task_timeout"`   // default max run time of one attempt; keep below TaskExpiration
 	ShutdownTimeout   time.Duration `default:"30s" envconfig:"shutdown_timeout"`
 	RequestTimeout    time.Duration `default:"30s" envconfig:"request_timeout"`
 	RateLimitRPS      int           `default:"100" envconfig:"rate_limit_rps"` // Requests per second
 
+	// Finished tasks are swept from the task store once older than their status's retention; zero keeps them forever.
+	// With TaskArchive they are copied to tasks_archive first.
+	TaskRetentionComplete  time.Duration `default:"168h" envconfig:"task_retention_complete"`
+	TaskRetentionDead      time.Duration `default:"720h" envconfig:"task_retention_dead"`
+	TaskRetentionCancelled time.Duration `default:"168h" envconfig:"task_retention_cancelled"`
+	TaskArchive            bool          `default:"false" envconfig:"task_archive"`
+
+	// Task checkouts round-robin between users and cap each user's concurrent tasks, so one user's backlog can't hold every worker.
+	TaskRoundRobin bool `default:"false" envconfig:"task_round_robin"`
+	TaskMaxPerUser int  `default:"0" envconfig:"task_max_per_user"` // zero is no cap
+
 	SGAPIKey string `default:"" envconfig:"sendgrid_apikey"`
 
 	// OpenTelemetry: when OtelExporterOTLPEndpoint is non-empty, traces export via OTLP gRPC (e.g. Tempo or collector on 4317).
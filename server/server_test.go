@@ -3,6 +3,7 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
@@ -13,7 +14,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/sethgrid/helloworld/internal/events"
+	"github.com/sethgrid/helloworld/internal/scheduler"
 	"github.com/sethgrid/helloworld/internal/taskqueue"
+	"github.com/sethgrid/helloworld/internal/workflow"
 	"github.com/sethgrid/helloworld/logger/lockbuffer"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -240,14 +244,16 @@ func newTestServer(opts ...func(*Server)) (*Server, error) {
 
 	// Create server with default values
 	srv := &Server{
-		port:         0, // OS will bind a random available port
-		config:       defaultConfig,
-		internalPort: 0,
-		protocol:     "http://",
-		taskq:        q,
-		parentLogger: log,
-		eventStore:   &fakeEventStore{},
-		mu:           sync.Mutex{},
+		port:          0, // OS will bind a random available port
+		config:        defaultConfig,
+		internalPort:  0,
+		protocol:      "http://",
+		taskq:         q,
+		scheduleStore: scheduler.NewMemoryStore(),
+		workflowStore: workflow.NewMemoryStore(),
+		parentLogger:  log,
+		eventStore:    &fakeEventStore{},
+		mu:            sync.Mutex{},
 	}
 
 	// Apply optional arguments
@@ -281,9 +287,22 @@ func newTestServer(opts ...func(*Server)) (*Server, error) {
 type fakeEventStore struct {
 	err       error
 	available bool
+	// written holds the events passed to Write
+	written []events.Event
 }
 
-func (f *fakeEventStore) Write(userID int64, message string) error {
+func (f *fakeEventStore) Write(ctx context.Context, event events.Event) error {
+	if f.err != nil {
+		return f.err
+	}
+	if err := event.Validate(); err != nil {
+		return err
+	}
+	f.written = append(f.written, event)
+	return nil
+}
+
+func (f *fakeEventStore) ScheduledWork(ctx context.Context) error {
 	return f.err
 }
 
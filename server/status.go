@@ -6,17 +6,21 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/sethgrid/helloworld/internal/scheduler"
+	"github.com/sethgrid/helloworld/internal/taskqueue"
 	"github.com/sethgrid/helloworld/logger"
 )
 
 // StatusResponse represents the status page response
 type StatusResponse struct {
-	Status      string                 `json:"status"`
-	Version     string                 `json:"version"`
-	Uptime      string                 `json:"uptime"`
-	Timestamp   time.Time              `json:"timestamp"`
-	Components  map[string]ComponentStatus `json:"components"`
-	System      SystemInfo             `json:"system"`
+	Status     string                     `json:"status"`
+	Version    string                     `json:"version"`
+	Uptime     string                     `json:"uptime"`
+	Timestamp  time.Time                  `json:"timestamp"`
+	Components map[string]ComponentStatus `json:"components"`
+	Schedule   []scheduler.JobStatus      `json:"schedule,omitempty"`
+	TaskRunner *taskqueue.RunnerState     `json:"task_runner,omitempty"`
+	System     SystemInfo                 `json:"system"`
 }
 
 // ComponentStatus represents the status of a component
@@ -28,20 +32,30 @@ type ComponentStatus struct {
 
 // SystemInfo represents system-level information
 type SystemInfo struct {
-	GoVersion   string `json:"go_version"`
+	GoVersion    string `json:"go_version"`
 	NumGoroutine int    `json:"num_goroutines"`
-	NumCPU      int    `json:"num_cpu"`
+	NumCPU       int    `json:"num_cpu"`
 }
 
 var serverStartTime = time.Now()
 
+// scheduleReporter reports the recurring jobs shown on the status page
+type scheduleReporter interface {
+	Jobs() []scheduler.JobStatus
+}
+
+// runnerStateReporter reports whether the task runner is paused or draining, shown on the status page
+type runnerStateReporter interface {
+	State() taskqueue.RunnerState
+}
+
 // handleStatus returns a comprehensive status page with component health checks
-func handleStatus(eventStore eventWriter, version string) http.HandlerFunc {
+func handleStatus(eventStore eventWriter, schedule scheduleReporter, runner runnerStateReporter, version string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log := logger.FromRequest(r)
-		
+
 		components := make(map[string]ComponentStatus)
-		
+
 		// Check event store
 		eventStoreStatus := ComponentStatus{
 			Status:      "healthy",
@@ -55,7 +69,7 @@ func handleStatus(eventStore eventWriter, version string) http.HandlerFunc {
 			eventStoreStatus.Message = "Database unreachable"
 		}
 		components["event_store"] = eventStoreStatus
-		
+
 		// Determine overall status
 		overallStatus := "healthy"
 		for _, comp := range components {
@@ -67,16 +81,16 @@ func handleStatus(eventStore eventWriter, version string) http.HandlerFunc {
 				}
 			}
 		}
-		
+
 		// Get system info
 		var m runtime.MemStats
 		runtime.ReadMemStats(&m)
-		
+
 		status := StatusResponse{
-			Status:    overallStatus,
-			Version:   version,
-			Uptime:    time.Since(serverStartTime).String(),
-			Timestamp: time.Now(),
+			Status:     overallStatus,
+			Version:    version,
+			Uptime:     time.Since(serverStartTime).String(),
+			Timestamp:  time.Now(),
 			Components: components,
 			System: SystemInfo{
 				GoVersion:    runtime.Version(),
@@ -84,7 +98,15 @@ func handleStatus(eventStore eventWriter, version string) http.HandlerFunc {
 				NumCPU:       runtime.NumCPU(),
 			},
 		}
-		
+
+		if schedule != nil {
+			status.Schedule = schedule.Jobs()
+		}
+		if runner != nil {
+			state := runner.State()
+			status.TaskRunner = &state
+		}
+
 		// Set appropriate status code
 		statusCode := http.StatusOK
 		if overallStatus == "unhealthy" {
@@ -92,10 +114,10 @@ func handleStatus(eventStore eventWriter, version string) http.HandlerFunc {
 		} else if overallStatus == "degraded" {
 			statusCode = http.StatusOK // Still return 200 but indicate degraded status
 		}
-		
+
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(statusCode)
-		
+
 		if err := json.NewEncoder(w).Encode(status); err != nil {
 			log.Error("failed to encode status response", "error", err)
 		}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sethgrid/kverr"
+
+	"github.com/sethgrid/helloworld/internal/taskqueue"
+	"github.com/sethgrid/helloworld/logger"
+)
+
+const (
+	defaultTaskLimit = 100
+	maxTaskLimit     = 1000
+	// drainWait is how long the drain endpoint waits for running tasks before responding
+	drainWait = time.Second
+)
+
+// taskResp is the JSON representation of a task returned by the task endpoints.
+type taskResp struct {
+	ID            int        `json:"id"`
+	UserID        int        `json:"user_id"`
+	Status        string     `json:"status"`
+	TaskType      string     `json:"task_type"`
+	Payload       string     `json:"payload"`
+	Queue         string     `json:"queue"`
+	Priority      int        `json:"priority"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	Result        string     `json:"result,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+func newTaskResp(task taskqueue.Task) taskResp {
+	resp := taskResp{
+		ID:        task.ID,
+		UserID:    task.UserID,
+		Status:    task.Status,
+		TaskType:  task.TaskType,
+		Payload:   task.Payload,
+		Queue:     task.Queue,
+		Priority:  task.Priority,
+		Attempts:  task.Attempts,
+		LastError: task.LastError,
+		Result:    task.Result,
+		CreatedAt: task.CreatedAt,
+		UpdatedAt: task.UpdatedAt,
+	}
+	if !task.NextAttemptAt.IsZero() {
+		resp.NextAttemptAt = &task.NextAttemptAt
+	}
+	return resp
+}
+
+type deadTasksResp struct {
+	Tasks []taskResp `json:"tasks"`
+}
+
+type tasksChangedResp struct {
+	Count int `json:"count"`
+}
+
+type tasksCancelledResp struct {
+	Count int   `json:"count"`
+	IDs   []int `json:"ids"`
+}
+
+// taskCanceller cancels tasks and stops their in-flight handlers; implemented by taskqueue.Runner.
+type taskCanceller interface {
+	CancelTasks(ctx context.Context, filter taskqueue.TaskFilter) ([]int, error)
+}
+
+// runnerControl pauses, resumes, and drains task processing; implemented by taskqueue.Runner.
+type runnerControl interface {
+	Pause()
+	Resume()
+	PauseTaskType(taskType string) error
+	ResumeTaskType(taskType string)
+	Drain(ctx context.Context) error
+	State() taskqueue.RunnerState
+}
+
+// taskFilterFromRequest builds a filter from query params:
+//
+//	id          repeatable task id, e.g. ?id=1&id=2
+//	user_id     owning user
+//	task_type   task type
+//	status      repeatable task status, e.g. ?status=open&status=checked_out
+//	older_than  duration, e.g. 24h, matches tasks last changed, e.g. killed, more than the duration ago
+//	limit       max tasks, defaults to 100 and is capped at 1000
+func taskFilterFromRequest(r *http.Request) (taskqueue.TaskFilter, error) {
+	q := r.URL.Query()
+	filter := taskqueue.TaskFilter{
+		TaskType: q.Get("task_type"),
+		Statuses: q["status"],
+		Limit:    defaultTaskLimit,
+	}
+
+	for _, raw := range q["id"] {
+		id, err := strconv.Atoi(raw)
+		if err != nil {
+			return filter, kverr.New(fmt.Errorf("invalid id: %w", err), "id", raw)
+		}
+		filter.IDs = append(filter.IDs, id)
+	}
+
+	if raw := q.Get("user_id"); raw != "" {
+		userID, err := strconv.Atoi(raw)
+		if err != nil {
+			return filter, kverr.New(fmt.Errorf("invalid user_id: %w", err), "user_id", raw)
+		}
+		filter.UserID = userID
+	}
+
+	if raw := q.Get("older_than"); raw != "" {
+		age, err := time.ParseDuration(raw)
+		if err != nil {
+			return filter, kverr.New(fmt.Errorf("invalid older_than: %w", err), "older_than", raw)
+		}
+		filter.UpdatedBefore = time.Now().Add(-age)
+	}
+
+	if raw := q.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			return filter, kverr.New(fmt.Errorf("invalid limit"), "limit", raw)
+		}
+		filter.Limit = min(limit, maxTaskLimit)
+	}
+
+	return filter, nil
+}
+
+// userIDFromCtx returns the authenticated user placed in the request context under ctxUser.
+func userIDFromCtx(ctx context.Context) (int, bool) {
+	userID, ok := ctx.Value(ctxUser).(int)
+	return userID, ok && userID != 0
+}
+
+// handleGetTask lets a user poll a task they own for its status and result.
+// Tasks owned by other users are reported as not found so their IDs can't be probed.
+func handleGetTask(taskq taskqueue.Tasker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := userIDFromCtx(r.Context())
+		if !ok {
+			errorJSON(w, r, http.StatusUnauthorized, "unauthorized", nil)
+			return
+		}
+
+		taskID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			errorJSON(w, r, http.StatusBadRequest, "invalid task id", err)
+			return
+		}
+
+		task, err := taskq.GetTask(r.Context(), taskID)
+		if errors.Is(err, taskqueue.ErrTaskNotFound) {
+			errorJSON(w, r, http.StatusNotFound, "task not found", nil)
+			return
+		}
+		if err != nil {
+			errorJSON(w, r, http.StatusInternalServerError, "unable to get task", err)
+			return
+		}
+		if task.UserID != userID {
+			errorJSON(w, r, http.StatusNotFound, "task not found", nil)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(newTaskResp(*task)); err != nil {
+			logger.FromRequest(r).Error("unable to encode json", "error", err.Error())
+		}
+	}
+}
+
+// handleListDeadTasks lists dead tasks matching the query param filters.
+func handleListDeadTasks(taskq taskqueue.Tasker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := taskFilterFromRequest(r)
+		if err != nil {
+			errorJSON(w, r, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+
+		tasks, err := taskq.ListDeadTasks(r.Context(), filter)
+		if err != nil {
+			errorJSON(w, r, http.StatusInternalServerError, "unable to list dead tasks", err)
+			return
+		}
+
+		resp := deadTasksResp{Tasks: make([]taskResp, 0, len(tasks))}
+		for _, task := range tasks {
+			resp.Tasks = append(resp.Tasks, newTaskResp(task))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			logger.FromRequest(r).Error("unable to encode json", "error", err.Error())
+		}
+	}
+}
+
+// handleRequeueDeadTasks reopens dead tasks matching the query param filters with their attempts reset.
+func handleRequeueDeadTasks(taskq taskqueue.Tasker) http.HandlerFunc {
+	return handleChangeDeadTasks("requeue", taskq.RequeueDeadTasks)
+}
+
+// handlePurgeDeadTasks permanently deletes dead tasks matching the query param filters.
+func handlePurgeDeadTasks(taskq taskqueue.Tasker) http.HandlerFunc {
+	return handleChangeDeadTasks("purge", taskq.PurgeDeadTasks)
+}
+
+// handleCancelTasks cancels open and checked out tasks matching the query param filters.
+// Like the dead task changes, cancelling without a filter requires an explicit ?all=true.
+func handleCancelTasks(canceller taskCanceller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := taskFilterFromRequest(r)
+		if err != nil {
+			errorJSON(w, r, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+		if filter.IsEmpty() && r.URL.Query().Get("all") != "true" {
+			errorJSON(w, r, http.StatusBadRequest, "a filter or all=true is required", nil)
+			return
+		}
+
+		ids, err := canceller.CancelTasks(r.Context(), filter)
+		if err != nil {
+			errorJSON(w, r, http.StatusInternalServerError, "unable to cancel tasks", err)
+			return
+		}
+		logger.FromRequest(r).Info("tasks cancelled", "count", len(ids))
+
+		resp := tasksCancelledResp{Count: len(ids), IDs: ids}
+		if resp.IDs == nil {
+			resp.IDs = []int{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			logger.FromRequest(r).Error("unable to encode json", "error", err.Error())
+		}
+	}
+}
+
+// handlePauseTasks stops this replica's runner from fetching tasks, or only tasks of the type
+// given by ?task_type=. Tasks already running are left to finish.
+func handlePauseTasks(runner runnerControl) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if taskType := r.URL.Query().Get("task_type"); taskType != "" {
+			if err := runner.PauseTaskType(taskType); err != nil {
+				errorJSON(w, r, http.StatusInternalServerError, "unable to pause task type", err)
+				return
+			}
+		} else {
+			runner.Pause()
+		}
+		writeRunnerState(w, r, http.StatusOK, runner.State())
+	}
+}
+
+// handleResumeTasks undoes handlePauseTasks and handleDrainTasks, or with ?task_type= resumes
+// only that type.
+func handleResumeTasks(runner runnerControl) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if taskType := r.URL.Query().Get("task_type"); taskType != "" {
+			runner.ResumeTaskType(taskType)
+		} else {
+			runner.Resume()
+		}
+		writeRunnerState(w, r, http.StatusOK, runner.State())
+	}
+}
+
+// handleDrainTasks stops this replica's runner from fetching tasks and lets the running ones
+// finish. It waits up to drainWait for them; when they take longer it responds 202 and the
+// runner keeps draining, with /status reporting draining until the runner is drained.
+func handleDrainTasks(runner runnerControl) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), drainWait)
+		defer cancel()
+
+		status := http.StatusOK
+		err := runner.Drain(ctx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusAccepted
+		} else if err != nil {
+			errorJSON(w, r, http.StatusConflict, err.Error(), err)
+			return
+		}
+		writeRunnerState(w, r, status, runner.State())
+	}
+}
+
+func writeRunnerState(w http.ResponseWriter, r *http.Request, status int, state taskqueue.RunnerState) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		logger.FromRequest(r).Error("unable to encode json", "error", err.Error())
+	}
+}
+
+// handleChangeDeadTasks applies a bulk change to dead tasks. Changing every dead task requires
+// an explicit ?all=true so a missing filter doesn't requeue or purge the whole queue by accident.
+func handleChangeDeadTasks(action string, change func(ctx context.Context, filter taskqueue.TaskFilter) (int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := taskFilterFromRequest(r)
+		if err != nil {
+			errorJSON(w, r, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+		if filter.IsEmpty() && r.URL.Query().Get("all") != "true" {
+			errorJSON(w, r, http.StatusBadRequest, "a filter or all=true is required", nil)
+			return
+		}
+
+		count, err := change(r.Context(), filter)
+		if err != nil {
+			errorJSON(w, r, http.StatusInternalServerError, fmt.Sprintf("unable to %s dead tasks", action), err)
+			return
+		}
+		logger.FromRequest(r).Info("dead tasks changed", "action", action, "count", count)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(tasksChangedResp{Count: count}); err != nil {
+			logger.FromRequest(r).Error("unable to encode json", "error", err.Error())
+		}
+	}
+}
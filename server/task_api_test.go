@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sethgrid/helloworld/internal/taskqueue"
+)
+
+// newDeadTaskQueue returns an in-memory queue holding two dead tasks for user 1 and one for user 2.
+func newDeadTaskQueue(t *testing.T) *taskqueue.InMemoryTaskQueue {
+	t.Helper()
+	ctx := context.Background()
+	q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+
+	for _, userID := range []int{1, 1, 2} {
+		id, err := q.AddTask(ctx, userID, "send_email", "{}")
+		require.NoError(t, err)
+		require.NoError(t, q.MarkTaskDead(ctx, id, "", "smtp down"))
+	}
+	return q
+}
+
+func TestListDeadTasks(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantIDs    []int
+	}{
+		{name: "all dead tasks", query: "", wantStatus: http.StatusOK, wantIDs: []int{1, 2, 3}},
+		{name: "by user", query: "?user_id=2", wantStatus: http.StatusOK, wantIDs: []int{3}},
+		{name: "by type", query: "?task_type=other", wantStatus: http.StatusOK, wantIDs: []int{}},
+		{name: "by id", query: "?id=1&id=3", wantStatus: http.StatusOK, wantIDs: []int{1, 3}},
+		{name: "limit", query: "?limit=1", wantStatus: http.StatusOK, wantIDs: []int{1}},
+		{name: "not old enough", query: "?older_than=1h", wantStatus: http.StatusOK, wantIDs: []int{}},
+		{name: "invalid user", query: "?user_id=abc", wantStatus: http.StatusBadRequest},
+		{name: "invalid age", query: "?older_than=forever", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newDeadTaskQueue(t)
+
+			req := httptest.NewRequest(http.MethodGet, "/tasks/dead"+tt.query, nil)
+			rec := httptest.NewRecorder()
+			handleListDeadTasks(q).ServeHTTP(rec, req)
+
+			require.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var resp deadTasksResp
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			ids := []int{}
+			for _, task := range resp.Tasks {
+				ids = append(ids, task.ID)
+				assert.Equal(t, "dead", task.Status)
+				assert.Equal(t, "smtp down", task.LastError)
+			}
+			assert.Equal(t, tt.wantIDs, ids)
+		})
+	}
+}
+
+func TestRequeueAndPurgeDeadTasks(t *testing.T) {
+	ctx := context.Background()
+	q := newDeadTaskQueue(t)
+
+	// a filter is required unless all=true
+	rec := httptest.NewRecorder()
+	handleRequeueDeadTasks(q).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/tasks/dead/requeue", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handleRequeueDeadTasks(q).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/tasks/dead/requeue?user_id=1", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"count":2}`, rec.Body.String())
+
+	task, err := q.FetchOpenTask(ctx, taskqueue.DefaultQueue)
+	require.NoError(t, err)
+	require.NotNil(t, task)
+	assert.Equal(t, 1, task.UserID)
+	assert.Equal(t, 1, task.Attempts, "requeue resets attempts")
+
+	rec = httptest.NewRecorder()
+	handlePurgeDeadTasks(q).ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/tasks/dead?all=true", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"count":1}`, rec.Body.String())
+
+	dead, err := q.ListDeadTasks(ctx, taskqueue.TaskFilter{})
+	require.NoError(t, err)
+	assert.Empty(t, dead)
+}
+
+func TestGetTask(t *testing.T) {
+	ctx := context.Background()
+	q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	id, err := q.AddTask(ctx, 1, "export", "{}")
+	require.NoError(t, err)
+	task, err := q.FetchOpenTask(ctx, taskqueue.DefaultQueue)
+	require.NoError(t, err)
+	require.NoError(t, q.MarkTaskComplete(ctx, id, task.LeaseToken, `{"url":"/exports/1.csv"}`))
+
+	router := chi.NewRouter()
+	router.Get("/tasks/{id}", handleGetTask(q))
+
+	tests := []struct {
+		name       string
+		path       string
+		userID     int
+		wantStatus int
+	}{
+		{name: "owner", path: fmt.Sprintf("/tasks/%d", id), userID: 1, wantStatus: http.StatusOK},
+		{name: "no user", path: fmt.Sprintf("/tasks/%d", id), wantStatus: http.StatusUnauthorized},
+		{name: "other user", path: fmt.Sprintf("/tasks/%d", id), userID: 2, wantStatus: http.StatusNotFound},
+		{name: "missing task", path: "/tasks/999", userID: 1, wantStatus: http.StatusNotFound},
+		{name: "invalid id", path: "/tasks/abc", userID: 1, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.userID != 0 {
+				req = req.WithContext(context.WithValue(req.Context(), ctxUser, tt.userID))
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			require.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var resp taskResp
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, id, resp.ID)
+			assert.Equal(t, "complete", resp.Status)
+			assert.Equal(t, `{"url":"/exports/1.csv"}`, resp.Result)
+		})
+	}
+}
+
+func TestCancelTasks(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantIDs    []int
+	}{
+		{name: "filter required", query: "", wantStatus: http.StatusBadRequest},
+		{name: "all", query: "?all=true", wantStatus: http.StatusOK, wantIDs: []int{1, 2, 3}},
+		{name: "by user", query: "?user_id=1", wantStatus: http.StatusOK, wantIDs: []int{1, 2}},
+		{name: "by status", query: "?status=checked_out", wantStatus: http.StatusOK, wantIDs: []int{1}},
+		{name: "finished status", query: "?status=complete", wantStatus: http.StatusOK, wantIDs: []int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+			for _, userID := range []int{1, 1, 2} {
+				_, err := q.AddTask(ctx, userID, "export", "{}")
+				require.NoError(t, err)
+			}
+			_, err := q.FetchOpenTask(ctx, taskqueue.DefaultQueue)
+			require.NoError(t, err)
+
+			rec := httptest.NewRecorder()
+			handleCancelTasks(q).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/tasks/cancel"+tt.query, nil))
+
+			require.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var resp tasksCancelledResp
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, tt.wantIDs, resp.IDs)
+			assert.Equal(t, len(tt.wantIDs), resp.Count)
+		})
+	}
+}
+
+func TestPauseResumeAndDrainTasks(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)
+	runner := taskqueue.NewRunner(q, 1, log, 10*time.Millisecond)
+	release := make(chan struct{})
+	runner.Register("export", func(ctx context.Context, task taskqueue.Task) (string, error) {
+		<-release
+		return "", nil
+	})
+	go runner.Start()
+	defer runner.Close()
+
+	post := func(handler http.HandlerFunc, query string) (int, taskqueue.RunnerState) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/tasks/control"+query, nil))
+		var state taskqueue.RunnerState
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+		return rec.Code, state
+	}
+
+	code, state := post(handlePauseTasks(runner), "?task_type=export")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, taskqueue.RunnerState{Status: taskqueue.RunnerRunning, PausedTaskTypes: []string{"export"}}, state)
+
+	code, state = post(handlePauseTasks(runner), "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, taskqueue.RunnerPaused, state.Status)
+
+	// resuming the runner leaves the task type paused
+	_, state = post(handleResumeTasks(runner), "")
+	assert.Equal(t, taskqueue.RunnerState{Status: taskqueue.RunnerRunning, PausedTaskTypes: []string{"export"}}, state)
+
+	id, err := q.AddTask(ctx, 1, "export", "{}")
+	require.NoError(t, err)
+	_, state = post(handleResumeTasks(runner), "?task_type=export")
+	assert.Empty(t, state.PausedTaskTypes)
+	require.Eventually(t, func() bool { return runner.State().InFlight == 1 }, time.Second, 5*time.Millisecond)
+
+	// the export is still running when the drain endpoint stops waiting for it
+	code, state = post(handleDrainTasks(runner), "")
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, taskqueue.RunnerState{Status: taskqueue.RunnerDraining, InFlight: 1}, state)
+
+	rec := httptest.NewRecorder()
+	handleStatus(&fakeEventStore{}, nil, runner, "v1").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var status StatusResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	require.NotNil(t, status.TaskRunner)
+	assert.Equal(t, taskqueue.RunnerDraining, status.TaskRunner.Status)
+
+	close(release)
+	code, state = post(handleDrainTasks(runner), "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, taskqueue.RunnerState{Status: taskqueue.RunnerDrained}, state)
+	task, err := q.GetTask(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "complete", task.Status)
+}
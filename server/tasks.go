@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/sethgrid/helloworld/internal/events"
+	"github.com/sethgrid/helloworld/internal/taskqueue"
+)
+
+// Task handlers follow the same pattern as HTTP handlers: standalone functions that receive
+// their dependencies via closure and are registered with the task runner in Serve.
+
+type userEventPayload struct {
+	Message string `json:"message"`
+}
+
+func (p userEventPayload) Validate() error {
+	if p.Message == "" {
+		return errors.New("message is required")
+	}
+	if utf8.RuneCountInString(p.Message) > events.MaxMessageLength {
+		return fmt.Errorf("message is longer than %d characters", events.MaxMessageLength)
+	}
+	return nil
+}
+
+// userEventTask is enqueued with userEventTask.Enqueue so its payload is versioned. Version 1 has
+// the same shape as the bare JSON payloads enqueued before versioning, which decode as version 0.
+var userEventTask = taskqueue.NewPayloadType[userEventPayload]("user_event", 1,
+	taskqueue.WithUpgrade(0, func(data json.RawMessage) (json.RawMessage, error) { return data, nil }))
+
+// handleUserEventTask writes the payload's message to the event store as a public event for the
+// task's user.
+func handleUserEventTask(eventStore eventWriter) func(ctx context.Context, task taskqueue.Task, payload userEventPayload) (string, error) {
+	return func(ctx context.Context, task taskqueue.Task, payload userEventPayload) (string, error) {
+		err := eventStore.Write(ctx, events.Event{
+			Type:     events.TypeMessage,
+			UserID:   int64(task.UserID),
+			Message:  payload.Message,
+			IsPublic: true,
+		})
+		if errors.Is(err, events.ErrInvalidEvent) {
+			// retrying can't make the event fit, so let the runner mark the task dead now
+			return "", fmt.Errorf("%w: %w", taskqueue.ErrInvalidPayload, err)
+		}
+		return "", err
+	}
+}
+
+// userWorkflowTaskTypes are the task types users may run as steps of the workflows they create,
+// each with how its payload is checked.
+var userWorkflowTaskTypes = map[string]checkStepPayload{
+	userEventTask.TaskType(): func(payload string) error {
+		_, err := userEventTask.Decode(payload)
+		return err
+	},
+}
+
+const taskTypeEventsScheduledWork = "events_scheduled_work"
+
+// handleEventsScheduledWork runs the event store's periodic maintenance. It is enqueued by the scheduler.
+func handleEventsScheduledWork(eventStore eventWriter) taskqueue.HandlerFunc {
+	return func(ctx context.Context, task taskqueue.Task) (string, error) {
+		return "", eventStore.ScheduledWork(ctx)
+	}
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sethgrid/helloworld/internal/events"
+	"github.com/sethgrid/helloworld/internal/taskqueue"
+)
+
+func TestHandleUserEventTask(t *testing.T) {
+	store := &fakeEventStore{}
+	handler := handleUserEventTask(store)
+
+	_, err := handler(context.Background(), taskqueue.Task{ID: 1, UserID: 7}, userEventPayload{Message: "export ready"})
+	require.NoError(t, err)
+	require.Len(t, store.written, 1)
+	assert.Equal(t, events.Event{Type: events.TypeMessage, UserID: 7, Message: "export ready", IsPublic: true}, store.written[0])
+
+	// an event activity_log can't hold fails the task for good rather than being retried
+	_, err = handler(context.Background(), taskqueue.Task{ID: 2}, userEventPayload{Message: "no user"})
+	assert.ErrorIs(t, err, taskqueue.ErrInvalidPayload)
+	assert.ErrorIs(t, err, events.ErrInvalidEvent)
+
+	assert.Error(t, userEventPayload{Message: strings.Repeat("a", events.MaxMessageLength+1)}.Validate())
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/sethgrid/helloworld/internal/workflow"
+	"github.com/sethgrid/helloworld/logger"
+)
+
+// workflowResp is the JSON representation of a workflow returned by the workflow endpoints.
+type workflowResp struct {
+	ID        int                `json:"id"`
+	UserID    int                `json:"user_id"`
+	Name      string             `json:"name"`
+	Status    string             `json:"status"`
+	Steps     []workflowStepResp `json:"steps"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+type workflowStepResp struct {
+	Name      string    `json:"name"`
+	TaskType  string    `json:"task_type"`
+	After     []string  `json:"after"`
+	Status    string    `json:"status"`
+	TaskID    int       `json:"task_id,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newWorkflowResp(wf workflow.Workflow) workflowResp {
+	resp := workflowResp{
+		ID:        wf.ID,
+		UserID:    wf.UserID,
+		Name:      wf.Name,
+		Status:    wf.Status,
+		Steps:     make([]workflowStepResp, 0, len(wf.Steps)),
+		CreatedAt: wf.CreatedAt,
+		UpdatedAt: wf.UpdatedAt,
+	}
+	for _, step := range wf.Steps {
+		after := step.After
+		if after == nil {
+			after = []string{}
+		}
+		resp.Steps = append(resp.Steps, workflowStepResp{
+			Name:      step.Name,
+			TaskType:  step.TaskType,
+			After:     after,
+			Status:    step.Status,
+			TaskID:    step.TaskID,
+			Error:     step.Error,
+			UpdatedAt: step.UpdatedAt,
+		})
+	}
+	return resp
+}
+
+// workflowEngine creates, looks up, and cancels workflows; implemented by workflow.Engine.
+type workflowEngine interface {
+	Create(ctx context.Context, userID int, name string, steps []workflow.Step) (int, error)
+	Get(ctx context.Context, id int) (*workflow.Workflow, error)
+	Cancel(ctx context.Context, id int) (*workflow.Workflow, error)
+}
+
+// createWorkflowReq is the body of a create workflow request. A step's payload is any JSON value and
+// is passed to its task as is.
+type createWorkflowReq struct {
+	Name  string `json:"name"`
+	Steps []struct {
+		Name     string          `json:"name"`
+		TaskType string          `json:"task_type"`
+		Payload  json.RawMessage `json:"payload"`
+		After    []string        `json:"after"`
+	} `json:"steps"`
+}
+
+// maxCreateWorkflowBody bounds the body of a create workflow request.
+const maxCreateWorkflowBody = 1 << 20
+
+// checkStepPayload returns an error if payload isn't valid for a step's task type.
+type checkStepPayload func(payload string) error
+
+// handleCreateWorkflow creates a workflow for the user in the request context and responds with it.
+// Steps may only use the task types in taskTypes, so users can't enqueue the service's internal tasks,
+// and each step's payload is checked up front so a bad one doesn't kill its task partway through.
+func handleCreateWorkflow(workflows workflowEngine, taskTypes map[string]checkStepPayload) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := userIDFromCtx(r.Context())
+		if !ok {
+			errorJSON(w, r, http.StatusUnauthorized, "unauthorized", nil)
+			return
+		}
+
+		var req createWorkflowReq
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCreateWorkflowBody)).Decode(&req); err != nil {
+			errorJSON(w, r, http.StatusBadRequest, "invalid workflow json", err)
+			return
+		}
+		if req.Name == "" {
+			errorJSON(w, r, http.StatusBadRequest, "name is required", nil)
+			return
+		}
+		steps := make([]workflow.Step, 0, len(req.Steps))
+		for _, step := range req.Steps {
+			check, ok := taskTypes[step.TaskType]
+			if !ok {
+				errorJSON(w, r, http.StatusBadRequest, fmt.Sprintf("step %q has unsupported task type %q", step.Name, step.TaskType), nil)
+				return
+			}
+			if err := check(string(step.Payload)); err != nil {
+				errorJSON(w, r, http.StatusBadRequest, fmt.Sprintf("step %q has an invalid payload: %s", step.Name, err), err)
+				return
+			}
+			steps = append(steps, workflow.Step{Name: step.Name, TaskType: step.TaskType, Payload: string(step.Payload), After: step.After})
+		}
+
+		id, err := workflows.Create(r.Context(), userID, req.Name, steps)
+		if errors.Is(err, workflow.ErrInvalidWorkflow) {
+			errorJSON(w, r, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+		if err != nil {
+			errorJSON(w, r, http.StatusInternalServerError, "unable to create workflow", err)
+			return
+		}
+		wf, err := workflows.Get(r.Context(), id)
+		if err != nil {
+			errorJSON(w, r, http.StatusInternalServerError, "unable to get workflow", err)
+			return
+		}
+		logger.FromRequest(r).Info("workflow created", "workflow_id", id, "workflow", req.Name)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(newWorkflowResp(*wf)); err != nil {
+			logger.FromRequest(r).Error("unable to encode json", "error", err.Error())
+		}
+	}
+}
+
+// handleGetWorkflow lets a user poll a workflow they own for the status of each step.
+// Workflows owned by other users are reported as not found so their IDs can't be probed.
+func handleGetWorkflow(workflows workflowEngine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := userIDFromCtx(r.Context())
+		if !ok {
+			errorJSON(w, r, http.StatusUnauthorized, "unauthorized", nil)
+			return
+		}
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			errorJSON(w, r, http.StatusBadRequest, "invalid workflow id", err)
+			return
+		}
+
+		wf, err := workflows.Get(r.Context(), id)
+		if errors.Is(err, workflow.ErrWorkflowNotFound) {
+			errorJSON(w, r, http.StatusNotFound, "workflow not found", nil)
+			return
+		}
+		if err != nil {
+			errorJSON(w, r, http.StatusInternalServerError, "unable to get workflow", err)
+			return
+		}
+		if wf.UserID != userID {
+			errorJSON(w, r, http.StatusNotFound, "workflow not found", nil)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(newWorkflowResp(*wf)); err != nil {
+			logger.FromRequest(r).Error("unable to encode json", "error", err.Error())
+		}
+	}
+}
+
+// handleCancelWorkflow cancels a workflow's unfinished steps and their tasks.
+func handleCancelWorkflow(workflows workflowEngine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			errorJSON(w, r, http.StatusBadRequest, "invalid workflow id", err)
+			return
+		}
+
+		wf, err := workflows.Cancel(r.Context(), id)
+		if errors.Is(err, workflow.ErrWorkflowNotFound) {
+			errorJSON(w, r, http.StatusNotFound, "workflow not found", nil)
+			return
+		}
+		if err != nil {
+			errorJSON(w, r, http.StatusInternalServerError, "unable to cancel workflow", err)
+			return
+		}
+		logger.FromRequest(r).Info("workflow cancelled", "workflow_id", id, "status", wf.Status)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(newWorkflowResp(*wf)); err != nil {
+			logger.FromRequest(r).Error("unable to encode json", "error", err.Error())
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sethgrid/helloworld/internal/taskqueue"
+	"github.com/sethgrid/helloworld/internal/workflow"
+)
+
+// newTestWorkflow returns an engine holding one running workflow for user 1: verify, then welcome.
+func newTestWorkflow(t *testing.T) (*workflow.Engine, *taskqueue.InMemoryTaskQueue, int) {
+	t.Helper()
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	q := taskqueue.NewInMemoryTaskQueue(3, time.Minute, log)
+	workflows := workflow.New(q, workflow.NewMemoryStore(), log, time.Hour)
+
+	id, err := workflows.Create(context.Background(), 1, "signup", []workflow.Step{
+		{Name: "verify", TaskType: "verify_email"},
+		{Name: "welcome", TaskType: "send_welcome", After: []string{"verify"}},
+	})
+	require.NoError(t, err)
+	return workflows, q, id
+}
+
+func TestGetWorkflow(t *testing.T) {
+	workflows, _, id := newTestWorkflow(t)
+
+	router := chi.NewRouter()
+	router.Get("/workflows/{id}", handleGetWorkflow(workflows))
+
+	tests := []struct {
+		name       string
+		path       string
+		userID     int
+		wantStatus int
+	}{
+		{name: "owner", path: fmt.Sprintf("/workflows/%d", id), userID: 1, wantStatus: http.StatusOK},
+		{name: "no user", path: fmt.Sprintf("/workflows/%d", id), wantStatus: http.StatusUnauthorized},
+		{name: "other user", path: fmt.Sprintf("/workflows/%d", id), userID: 2, wantStatus: http.StatusNotFound},
+		{name: "missing workflow", path: "/workflows/999", userID: 1, wantStatus: http.StatusNotFound},
+		{name: "invalid id", path: "/workflows/abc", userID: 1, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.userID != 0 {
+				req = req.WithContext(context.WithValue(req.Context(), ctxUser, tt.userID))
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			require.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var resp workflowResp
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, id, resp.ID)
+			assert.Equal(t, workflow.StatusRunning, resp.Status)
+			require.Len(t, resp.Steps, 2)
+			assert.Equal(t, workflow.StepEnqueued, resp.Steps[0].Status)
+			assert.NotZero(t, resp.Steps[0].TaskID)
+			assert.Equal(t, workflow.StepWaiting, resp.Steps[1].Status)
+			assert.Equal(t, []string{"verify"}, resp.Steps[1].After)
+		})
+	}
+}
+
+func TestCancelWorkflow(t *testing.T) {
+	workflows, q, id := newTestWorkflow(t)
+
+	router := chi.NewRouter()
+	router.Post("/workflows/{id}/cancel", handleCancelWorkflow(workflows))
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/workflows/999/cancel", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/workflows/%d/cancel", id), nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var resp workflowResp
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, workflow.StatusCancelled, resp.Status)
+	for _, step := range resp.Steps {
+		assert.Equal(t, workflow.StepCancelled, step.Status, "step %s", step.Name)
+	}
+
+	task, err := q.GetTask(context.Background(), resp.Steps[0].TaskID)
+	require.NoError(t, err)
+	assert.Equal(t, "cancelled", task.Status)
+}
+
+func TestCreateWorkflow(t *testing.T) {
+	workflows, q, _ := newTestWorkflow(t)
+
+	taskTypes := map[string]checkStepPayload{
+		"verify_email": func(payload string) error {
+			var p struct {
+				Email string `json:"email"`
+			}
+			if err := json.Unmarshal([]byte(payload), &p); err != nil {
+				return err
+			}
+			if p.Email == "" {
+				return errors.New("email is required")
+			}
+			return nil
+		},
+		"send_welcome": func(payload string) error { return nil },
+	}
+	router := chi.NewRouter()
+	router.Post("/workflows", handleCreateWorkflow(workflows, taskTypes))
+
+	tests := []struct {
+		name       string
+		body       string
+		userID     int
+		wantStatus int
+	}{
+		{
+			name:       "created",
+			body:       `{"name":"signup","steps":[{"name":"verify","task_type":"verify_email","payload":{"email":"a@b.c"}},{"name":"welcome","task_type":"send_welcome","after":["verify"]}]}`,
+			userID:     7,
+			wantStatus: http.StatusCreated,
+		},
+		{name: "no user", body: `{"name":"signup","steps":[{"name":"verify","task_type":"verify_email"}]}`, wantStatus: http.StatusUnauthorized},
+		{name: "invalid json", body: `{"name":`, userID: 7, wantStatus: http.StatusBadRequest},
+		{name: "no name", body: `{"steps":[{"name":"verify","task_type":"verify_email"}]}`, userID: 7, wantStatus: http.StatusBadRequest},
+		{name: "no steps", body: `{"name":"signup"}`, userID: 7, wantStatus: http.StatusBadRequest},
+		{name: "unsupported task type", body: `{"name":"signup","steps":[{"name":"sweep","task_type":"events_scheduled_work"}]}`, userID: 7, wantStatus: http.StatusBadRequest},
+		{name: "invalid payload", body: `{"name":"signup","steps":[{"name":"verify","task_type":"verify_email","payload":{"email":""}}]}`, userID: 7, wantStatus: http.StatusBadRequest},
+		{name: "missing payload", body: `{"name":"signup","steps":[{"name":"verify","task_type":"verify_email"}]}`, userID: 7, wantStatus: http.StatusBadRequest},
+		{name: "cycle", body: `{"name":"signup","steps":[{"name":"a","task_type":"verify_email","payload":{"email":"a@b.c"},"after":["b"]},{"name":"b","task_type":"send_welcome","after":["a"]}]}`, userID: 7, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/workflows", strings.NewReader(tt.body))
+			if tt.userID != 0 {
+				req = req.WithContext(context.WithValue(req.Context(), ctxUser, tt.userID))
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			require.Equal(t, tt.wantStatus, rec.Code, rec.Body.String())
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+
+			var resp workflowResp
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, tt.userID, resp.UserID)
+			assert.Equal(t, "signup", resp.Name)
+			require.Len(t, resp.Steps, 2)
+			assert.Equal(t, workflow.StepEnqueued, resp.Steps[0].Status)
+
+			task, err := q.GetTask(context.Background(), resp.Steps[0].TaskID)
+			require.NoError(t, err)
+			assert.Equal(t, tt.userID, task.UserID)
+			assert.Equal(t, `{"email":"a@b.c"}`, task.Payload)
+		})
+	}
+}
+
+func TestCreateWorkflowChecksUserEventPayload(t *testing.T) {
+	workflows, q, _ := newTestWorkflow(t)
+
+	router := chi.NewRouter()
+	router.Post("/workflows", handleCreateWorkflow(workflows, userWorkflowTaskTypes))
+
+	create := func(payload string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"name":"notify","steps":[{"name":"event","task_type":"user_event","payload":%s}]}`, payload)
+		req := httptest.NewRequest(http.MethodPost, "/workflows", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), ctxUser, 7))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := create(`{"message":""}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "message is required")
+
+	rec = create(`{"message":"hello"}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var resp workflowResp
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	task, err := q.GetTask(context.Background(), resp.Steps[0].TaskID)
+	require.NoError(t, err)
+	payload, err := userEventTask.Decode(task.Payload)
+	require.NoError(t, err, "the task's handler can decode the payload it was created with")
+	assert.Equal(t, "hello", payload.Message)
+}
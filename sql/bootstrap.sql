@@ -64,4 +64,88 @@ CREATE TABLE `activity_log` (
     `apikey_id` BIGINT NOT NULL,
     `is_public` TINYINT(1) NOT NULL DEFAULT 1,
     `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP
-);
\ No newline at end of file
+);
+
+CREATE TABLE `tasks` (
+  `id` BIGINT(20) UNSIGNED NOT NULL AUTO_INCREMENT,
+  `user_id` BIGINT(20) NOT NULL,
+  `task_type` VARCHAR(255) NOT NULL,
+  `payload` TEXT NOT NULL,
+  `queue` VARCHAR(64) NOT NULL DEFAULT 'default',
+  `priority` INT NOT NULL DEFAULT 0,
+  `status` VARCHAR(32) NOT NULL DEFAULT 'open',
+  `attempts` INT NOT NULL DEFAULT 0,
+  `next_attempt_at` DATETIME NULL DEFAULT NULL,
+  `last_error` TEXT NULL,
+  `result` TEXT NULL,
+  `dedup_key` VARCHAR(255) NULL DEFAULT NULL,
+  `dedup_expires_at` DATETIME NULL DEFAULT NULL,
+  `lease_token` VARCHAR(36) NULL DEFAULT NULL,
+  `lease_expires_at` DATETIME NULL DEFAULT NULL,
+  `trace_parent` VARCHAR(55) NULL DEFAULT NULL,
+  `request_id` VARCHAR(64) NULL DEFAULT NULL,
+  `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  primary key (`id`),
+  unique key `dedup_key` (`dedup_key`),
+  index `status_created` (`status`, `created_at`),
+  index `status_updated` (`status`, `updated_at`),
+  index `status_next_attempt` (`status`, `next_attempt_at`),
+  index `status_lease` (`status`, `lease_expires_at`),
+  index `queue_status_priority` (`queue`, `status`, `priority`, `created_at`),
+  index `queue_user_status` (`queue`, `user_id`, `status`),
+  index `uid` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `tasks_archive` (
+  `id` BIGINT(20) UNSIGNED NOT NULL,
+  `user_id` BIGINT(20) NOT NULL,
+  `status` VARCHAR(32) NOT NULL,
+  `task_type` VARCHAR(255) NOT NULL,
+  `payload` TEXT NOT NULL,
+  `queue` VARCHAR(64) NOT NULL,
+  `priority` INT NOT NULL,
+  `attempts` INT NOT NULL,
+  `last_error` TEXT NULL,
+  `result` TEXT NULL,
+  `trace_parent` VARCHAR(55) NULL DEFAULT NULL,
+  `request_id` VARCHAR(64) NULL DEFAULT NULL,
+  `created_at` DATETIME NULL,
+  `updated_at` DATETIME NULL,
+  `archived_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+  primary key (`id`),
+  index `archived` (`archived_at`),
+  index `uid` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `scheduled_jobs` (
+  `name` VARCHAR(255) NOT NULL,
+  `last_run_at` DATETIME NOT NULL,
+  `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  primary key (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `workflows` (
+  `id` BIGINT(20) UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT(20) NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `status` VARCHAR(32) NOT NULL,
+  `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  index `status` (`status`),
+  index `uid` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `workflow_steps` (
+  `workflow_id` BIGINT(20) UNSIGNED NOT NULL,
+  `position` INT NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `task_type` VARCHAR(255) NOT NULL,
+  `payload` TEXT NOT NULL,
+  `after_steps` TEXT NOT NULL,
+  `status` VARCHAR(32) NOT NULL,
+  `task_id` BIGINT(20) UNSIGNED NULL DEFAULT NULL,
+  `last_error` TEXT NULL,
+  `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  primary key (`workflow_id`, `name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;